@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// msgResponse is a message in flight as the admin API returns it.
+type msgResponse struct {
+	MsgInfo
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+func newMsgResponse(info MsgInfo) msgResponse {
+	return msgResponse{MsgInfo: info, AgeSeconds: info.Age().Seconds()}
+}
+
+// adminAPI serves the admin endpoints for inspecting and managing the
+// messages in flight.
+type adminAPI struct {
+	handler *MsgHandler
+	server  *Server
+	// traces are the messages' timelines, nil when tracing is off
+	traces *TraceRecorder
+}
+
+// register adds the admin endpoints to mux:
+//
+//	GET  /admin/messages                 every message in flight, oldest first
+//	GET  /admin/messages/{id}            one message
+//	POST /admin/messages/{id}/expire     expire a message now
+//	POST /admin/messages/{id}/extend?by= move a message's deadline back by a duration
+//	GET  /admin/messages/{id}/timeline   a message's lifecycle events, when tracing
+//	GET  /admin/errors                   the server's recent errors, oldest first
+func (a *adminAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/messages", a.list)
+	mux.HandleFunc("GET /admin/messages/{id}", a.get)
+	mux.HandleFunc("POST /admin/messages/{id}/expire", a.expire)
+	mux.HandleFunc("POST /admin/messages/{id}/extend", a.extend)
+	mux.HandleFunc("GET /admin/messages/{id}/timeline", a.timeline)
+	mux.HandleFunc("GET /admin/errors", a.errors)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// transID parses the message's transaction ID from the path, writing the
+// error response if it isn't valid.
+func transID(w http.ResponseWriter, r *http.Request) (uint32, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid transaction ID %q", r.PathValue("id")))
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+func notFound(w http.ResponseWriter, id uint32) {
+	writeError(w, http.StatusNotFound, fmt.Errorf("message %d is not in flight", id))
+}
+
+func (a *adminAPI) list(w http.ResponseWriter, r *http.Request) {
+	infos := a.handler.Messages()
+	msgs := make([]msgResponse, len(infos))
+	for i, info := range infos {
+		msgs[i] = newMsgResponse(info)
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+func (a *adminAPI) get(w http.ResponseWriter, r *http.Request) {
+	id, ok := transID(w, r)
+	if !ok {
+		return
+	}
+	info, ok := a.handler.Message(id)
+	if !ok {
+		notFound(w, id)
+		return
+	}
+	writeJSON(w, http.StatusOK, newMsgResponse(info))
+}
+
+func (a *adminAPI) expire(w http.ResponseWriter, r *http.Request) {
+	id, ok := transID(w, r)
+	if !ok {
+		return
+	}
+	if !a.handler.Expire(id) {
+		notFound(w, id)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) extend(w http.ResponseWriter, r *http.Request) {
+	id, ok := transID(w, r)
+	if !ok {
+		return
+	}
+	by, err := time.ParseDuration(r.URL.Query().Get("by"))
+	if err != nil || by <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("by must be a positive duration like 30s"))
+		return
+	}
+	deadline, ok := a.handler.ExtendDeadline(id, by)
+	if !ok {
+		notFound(w, id)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]time.Time{"deadline": deadline})
+}
+
+func (a *adminAPI) timeline(w http.ResponseWriter, r *http.Request) {
+	id, ok := transID(w, r)
+	if !ok {
+		return
+	}
+	if a.traces == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tracing is off"))
+		return
+	}
+	events := a.traces.Timeline(id)
+	if events == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("message %d has no timeline", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+func (a *adminAPI) errors(w http.ResponseWriter, r *http.Request) {
+	if a.server == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no server"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.server.RecentErrors())
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminRequest(h *MsgHandler, method, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newHTTPHandler(NewRegistry(), h, nil, nil).ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+// TestAdminList tests listing the messages in flight.
+func TestAdminList(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(true, 1, 20, make([]byte, 5)))
+	h.AddFragment(createValidFrag(false, 2, 10, make([]byte, 10)))
+
+	rec := adminRequest(h, "GET", "/admin/messages")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var msgs []msgResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	m := msgs[0]
+	if m.TransID != 1 || m.BytesReceived != 15 || m.ExpectedTotal != 25 || !m.TotalKnown ||
+		m.Fragments != 2 || len(m.Holes) != 1 || m.Holes[0] != 10 {
+		t.Errorf("unexpected message %+v", m)
+	}
+	if m := msgs[1]; m.TotalKnown || len(m.Holes) != 2 || m.Holes[0] != 0 || m.Holes[1] != 20 {
+		t.Errorf("unexpected message %+v", m)
+	}
+	h.Flush(FlushDiscard)
+}
+
+// TestAdminGet tests fetching a single message and the errors for missing
+// and invalid IDs.
+func TestAdminGet(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.AddFragment(createValidFrag(false, 7, 0, make([]byte, 10)))
+	defer h.Flush(FlushDiscard)
+
+	rec := adminRequest(h, "GET", "/admin/messages/7")
+	var m msgResponse
+	json.Unmarshal(rec.Body.Bytes(), &m)
+	if rec.Code != http.StatusOK || m.TransID != 7 || m.Deadline.Sub(m.Started).Round(time.Second) != time.Minute {
+		t.Errorf("unexpected response %d %+v", rec.Code, m)
+	}
+	if rec = adminRequest(h, "GET", "/admin/messages/8"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+	if rec = adminRequest(h, "GET", "/admin/messages/x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+// TestAdminExpire tests that a message can be expired right away.
+func TestAdminExpire(t *testing.T) {
+	var holes []uint32
+	h := NewMsgHandler(60000, func(transID, off uint32) {
+		holes = append(holes, off)
+	}, nil)
+	h.AddFragment(createValidFrag(false, 3, 10, make([]byte, 10)))
+
+	if rec := adminRequest(h, "POST", "/admin/messages/3/expire"); rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+	if len(holes) != 2 {
+		t.Errorf("expected the holes to be reported, got %v", holes)
+	}
+	if _, ok := h.Message(3); ok {
+		t.Error("the message should have been removed")
+	}
+	if h.Expired() != 1 {
+		t.Errorf("expected 1 expired message, got %d", h.Expired())
+	}
+	if rec := adminRequest(h, "POST", "/admin/messages/3/expire"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+// TestAdminExtend tests that extending a message's deadline keeps it past
+// its original one.
+func TestAdminExtend(t *testing.T) {
+	expired := make(chan uint32, 2)
+	h := NewMsgHandler(20, func(transID, off uint32) {
+		expired <- transID
+	}, nil)
+	h.AddFragment(createValidFrag(false, 4, 0, make([]byte, 10)))
+	before, _ := h.Message(4)
+
+	if rec := adminRequest(h, "POST", "/admin/messages/4/extend"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a duration, got %d", rec.Code)
+	}
+	rec := adminRequest(h, "POST", "/admin/messages/4/extend?by=200ms")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	after, _ := h.Message(4)
+	if after.Deadline.Sub(before.Deadline) != 200*time.Millisecond {
+		t.Errorf("expected the deadline to move by 200ms, got %v", after.Deadline.Sub(before.Deadline))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := h.Message(4); !ok {
+		t.Error("the message should still be in flight after its original deadline")
+	}
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Error("expected the message to expire at its new deadline")
+	}
+}
+
+// TestAdminTimeline tests getting a message's lifecycle events.
+func TestAdminTimeline(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	r := NewTraceRecorder(0, nil, nil)
+	h.SetTracer(r.Trace)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+
+	rec := httptest.NewRecorder()
+	newHTTPHandler(NewRegistry(), h, nil, r).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/messages/1/timeline", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var events []struct {
+		Type       string `json:"type"`
+		Contiguous uint32 `json:"contiguous"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Type != "first_fragment" || events[2].Contiguous != 10 {
+		t.Errorf("unexpected events %+v", events)
+	}
+	if rec := adminRequest(h, "GET", "/admin/messages/1/timeline"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 with tracing off, got %d", rec.Code)
+	}
+}
+
+// TestStartHTTP tests that the HTTP server won't wait forever on slow or
+// idle clients.
+func TestStartHTTP(t *testing.T) {
+	hs, err := startHTTP("127.0.0.1:0", http.NotFoundHandler(), slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+	if hs.ReadHeaderTimeout == 0 || hs.ReadTimeout == 0 || hs.WriteTimeout == 0 || hs.IdleTimeout == 0 {
+		t.Error("expected every timeout to be set")
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SizeDist picks the sizes of the messages a benchmark sends.
+type SizeDist struct {
+	// Kind is "fixed", "uniform" or "exp"
+	Kind string
+	// Min and Max bound the sizes, Mean is the exponential distribution's
+	Min, Max, Mean int
+}
+
+// ParseSizeDist reads a size distribution: "fixed:64k" for one size,
+// "uniform:1k-1m" for sizes spread evenly between two, or "exp:256k" for
+// sizes exponentially distributed around a mean, capped at 16 times it.
+// Sizes take k, m and g suffixes for powers of 1024.
+func ParseSizeDist(s string) (SizeDist, error) {
+	kind, arg, ok := strings.Cut(s, ":")
+	if !ok {
+		return SizeDist{}, fmt.Errorf("size distribution %q isn't kind:sizes", s)
+	}
+	d := SizeDist{Kind: kind}
+	var err error
+	switch kind {
+	case "fixed":
+		d.Min, err = parseSize(arg)
+		d.Max = d.Min
+	case "uniform":
+		lo, hi, found := strings.Cut(arg, "-")
+		if !found {
+			return d, fmt.Errorf("uniform sizes %q aren't min-max", arg)
+		}
+		if d.Min, err = parseSize(lo); err == nil {
+			d.Max, err = parseSize(hi)
+		}
+		if err == nil && d.Max < d.Min {
+			err = fmt.Errorf("max %s is less than min %s", hi, lo)
+		}
+	case "exp":
+		d.Mean, err = parseSize(arg)
+		if uint64(d.Mean) > math.MaxUint32/16 {
+			return d, ErrMessageTooLong
+		}
+		d.Max = 16 * d.Mean
+	default:
+		return d, fmt.Errorf("unknown size distribution %q, want fixed, uniform or exp", kind)
+	}
+	// compared as uint64 as the limit doesn't fit in a 32-bit int
+	if err == nil && uint64(d.Max) > math.MaxUint32 {
+		err = ErrMessageTooLong
+	}
+	return d, err
+}
+
+// parseSize reads a byte count with an optional k, m or g suffix.
+func parseSize(s string) (int, error) {
+	mult := 1
+	switch strings.ToLower(s[len(s)-min(len(s), 1):]) {
+	case "k":
+		mult = 1 << 10
+	case "m":
+		mult = 1 << 20
+	case "g":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q isn't a size", s)
+	}
+	if n > math.MaxInt/mult {
+		return 0, fmt.Errorf("%q is too large a size", s)
+	}
+	return n * mult, nil
+}
+
+// sample picks a message size.
+func (d SizeDist) sample(rng *rand.Rand) int {
+	switch d.Kind {
+	case "uniform":
+		return d.Min + int(rng.Int63n(int64(d.Max-d.Min)+1))
+	case "exp":
+		return min(int(rng.ExpFloat64()*float64(d.Mean)), d.Max)
+	}
+	return d.Min
+}
+
+// BenchConfig describes a benchmark run.
+type BenchConfig struct {
+	// Messages is how many messages to send.
+	Messages int
+	// Concurrency is how many senders send messages at once.
+	Concurrency int
+	// Rate is the most messages started a second, 0 for as fast as the
+	// senders go.
+	Rate        float64
+	Sizes       SizeDist
+	PayloadSize int
+	// Readers and Workers configure the assembler under test, ReadBuffer
+	// is its socket's receive buffer size in bytes.
+	Readers, Workers, ReadBuffer int
+	// Timeout is how long a message can wait for its missing fragments.
+	Timeout time.Duration
+	// Seed makes the message sizes repeatable.
+	Seed int64
+}
+
+// Percentiles summarize latencies in seconds.
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// percentiles returns the percentiles of the latencies, sorting them.
+func percentiles(latencies []time.Duration) Percentiles {
+	if len(latencies) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(latencies, func(a, b int) bool { return latencies[a] < latencies[b] })
+	at := func(q float64) float64 {
+		return latencies[int(math.Ceil(q*float64(len(latencies))))-1].Seconds()
+	}
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: latencies[len(latencies)-1].Seconds()}
+}
+
+// BenchResult is what a benchmark run measured. Rates are per second of the
+// run, from the first fragment sent until the last message completed or
+// expired.
+type BenchResult struct {
+	Seconds   float64 `json:"seconds"`
+	Messages  int     `json:"messages"`
+	Completed uint64  `json:"completed"`
+	Expired   uint64  `json:"expired"`
+	// Lost are messages the assembler never started, none of their
+	// fragments got through
+	Lost      uint64 `json:"lost"`
+	Fragments uint64 `json:"fragments"`
+	Bytes     uint64 `json:"bytes"`
+	// Received are the fragments read off the assembler's socket, the rest
+	// were lost when its receive buffer overflowed
+	Received uint64 `json:"received"`
+	// Drops are datagrams the assembler's queues had no room for
+	Drops           uint64  `json:"drops"`
+	FragmentsPerSec float64 `json:"fragments_per_sec"`
+	MessagesPerSec  float64 `json:"messages_per_sec"`
+	BytesPerSec     float64 `json:"bytes_per_sec"`
+	// Latency is from a message's first fragment being sent to its
+	// reassembly
+	Latency Percentiles `json:"latency_seconds"`
+	// CPUSeconds is the process's CPU time over the run, the senders' as
+	// well as the assembler's. HeapBytes and SysBytes are the Go heap in
+	// use and the memory obtained from the system at the end, GCs the
+	// garbage collections during the run.
+	CPUSeconds float64 `json:"cpu_seconds"`
+	HeapBytes  uint64  `json:"heap_bytes"`
+	SysBytes   uint64  `json:"sys_bytes"`
+	GCs        uint32  `json:"gcs"`
+}
+
+// cpuSeconds returns the CPU time the process has used, not counting idle
+// time. The runtime only updates its estimate at a garbage collection so it
+// forces one.
+func cpuSeconds() float64 {
+	runtime.GC()
+	s := []metrics.Sample{
+		{Name: "/cpu/classes/total:cpu-seconds"},
+		{Name: "/cpu/classes/idle:cpu-seconds"},
+	}
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindFloat64 || s[1].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return s[0].Value.Float64() - s[1].Value.Float64()
+}
+
+// RunBench starts an assembler on a loopback UDP port, sends it messages as
+// cfg describes and measures how it keeps up.
+func RunBench(cfg BenchConfig) (BenchResult, error) {
+	var res BenchResult
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	var lock sync.Mutex
+	started := make(map[uint32]time.Time)
+	var latencies []time.Duration
+	finished := make(chan struct{}, cfg.Messages)
+	h := NewMsgHandler(int(cfg.Timeout/time.Millisecond), func(transID, off uint32) {}, func(transID uint32, sha string) {
+		lock.Lock()
+		latencies = append(latencies, time.Since(started[transID]))
+		delete(started, transID)
+		lock.Unlock()
+		finished <- struct{}{}
+	})
+	h.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s := NewServerFromConfig(ServerConfig{
+		Addresses:  []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1)}},
+		NumReaders: cfg.Readers,
+		NumWorkers: cfg.Workers,
+		ReadWait:   100 * time.Millisecond,
+	}, &NetImp{ReadBuffer: cfg.ReadBuffer}, h)
+	if err := s.Start(context.Background()); err != nil {
+		return res, err
+	}
+	defer s.Stop()
+	go s.HandleErrors(func(err error) {})
+	addr := s.ListenerStats()[0].Address
+
+	seq := SequentialIDs(1)
+	f := NewFragmenter(cfg.PayloadSize, func() uint32 {
+		id := seq()
+		lock.Lock()
+		started[id] = time.Now()
+		lock.Unlock()
+		return id
+	})
+	jobs := make(chan int)
+	errs := make(chan error, cfg.Concurrency)
+	data := make([]byte, cfg.Sizes.Max)
+	rand.New(rand.NewSource(cfg.Seed)).Read(data)
+	var sent sync.WaitGroup
+	var frags, bytesSent uint64
+	for i := 0; i < cfg.Concurrency; i++ {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return res, err
+		}
+		defer conn.Close()
+		sent.Add(1)
+		go func() {
+			defer sent.Done()
+			for size := range jobs {
+				r, err := Send(conn, bytes.NewReader(data[:size]), f, 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				lock.Lock()
+				frags += uint64(r.Fragments)
+				bytesSent += uint64(r.Bytes)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	cpuStart := cpuSeconds()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	gcStart := ms.NumGC
+	start := time.Now()
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	p := newPacer(cfg.Rate)
+	for i := 0; i < cfg.Messages; i++ {
+		p.wait()
+		select {
+		case jobs <- cfg.Sizes.sample(rng):
+		case err := <-errs:
+			close(jobs)
+			sent.Wait()
+			return res, err
+		}
+	}
+	close(jobs)
+	sent.Wait()
+	select {
+	case err := <-errs:
+		return res, err
+	default:
+	}
+
+	// a message completes, expires once its missing fragments have waited
+	// out the timeout, or is lost when none of its fragments arrived
+	deadline := time.After(cfg.Timeout + time.Second)
+	end := time.Now()
+wait:
+	for res.Completed+res.Expired < uint64(cfg.Messages) {
+		select {
+		case <-finished:
+			res.Completed++
+			end = time.Now()
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			break wait
+		}
+		if expired := h.Expired(); expired > res.Expired {
+			res.Expired = expired
+			end = time.Now()
+		}
+	}
+	res.Lost = uint64(cfg.Messages) - res.Completed - res.Expired
+
+	res.Seconds = end.Sub(start).Seconds()
+	res.Messages = cfg.Messages
+	res.Drops = s.Drops()
+	for _, l := range s.ListenerStats() {
+		res.Received += l.Datagrams
+	}
+	res.Fragments, res.Bytes = frags, bytesSent
+	res.FragmentsPerSec = float64(frags) / res.Seconds
+	res.MessagesPerSec = float64(res.Completed) / res.Seconds
+	res.BytesPerSec = float64(bytesSent) / res.Seconds
+	lock.Lock()
+	res.Latency = percentiles(latencies)
+	lock.Unlock()
+	runtime.ReadMemStats(&ms)
+	res.HeapBytes, res.SysBytes, res.GCs = ms.HeapAlloc, ms.Sys, ms.NumGC-gcStart
+	res.CPUSeconds = cpuSeconds() - cpuStart
+	return res, nil
+}
+
+// runBench is the bench subcommand. It runs a benchmark and writes the
+// result as JSON, or text, and returns the exit status.
+func runBench(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("msg-assembler bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cfg := BenchConfig{}
+	fs.IntVar(&cfg.Messages, "messages", 1000, "messages to send")
+	fs.IntVar(&cfg.Concurrency, "concurrency", 8, "messages sent at once")
+	fs.Float64Var(&cfg.Rate, "rate", 0, "most messages started a second, 0 for no limit")
+	sizes := fs.String("size", "uniform:1k-256k", "message sizes: fixed:<size>, uniform:<min>-<max> or exp:<mean>")
+	fs.IntVar(&cfg.PayloadSize, "payload-size", DefaultPayloadSize, "most bytes of a message in each fragment")
+	fs.IntVar(&cfg.Readers, "readers", 4, "assembler reader goroutines")
+	fs.IntVar(&cfg.Workers, "workers", 4, "assembler worker goroutines")
+	fs.IntVar(&cfg.ReadBuffer, "read-buffer", 4<<20, "assembler socket receive buffer in bytes, 0 for the system default")
+	fs.DurationVar(&cfg.Timeout, "timeout", 5*time.Second, "how long a message can wait for missing fragments")
+	fs.Int64Var(&cfg.Seed, "seed", 1, "random seed for the message sizes")
+	format := fs.String("format", "json", "output format, json or text")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	logger := slog.New(slog.NewTextHandler(stderr, nil))
+	var err error
+	if cfg.Sizes, err = ParseSizeDist(*sizes); err != nil {
+		logger.Error("invalid arguments", "err", err)
+		return 2
+	}
+	switch {
+	case cfg.Messages < 1:
+		err = errors.New("messages must be at least 1")
+	case cfg.Timeout < time.Millisecond:
+		err = errors.New("timeout must be at least 1ms")
+	case *format != "json" && *format != "text":
+		err = fmt.Errorf("format %q must be json or text", *format)
+	}
+	if err != nil {
+		logger.Error("invalid arguments", "err", err)
+		return 2
+	}
+	res, err := RunBench(cfg)
+	if err != nil {
+		logger.Error("running benchmark", "err", err)
+		return 1
+	}
+	if *format == "text" {
+		fmt.Fprintf(stdout, "%d of %d messages completed, %d expired, %d lost, %d datagrams dropped in %.2fs\n",
+			res.Completed, res.Messages, res.Expired, res.Lost, res.Drops, res.Seconds)
+		fmt.Fprintf(stdout, "%d of %d fragments received\n", res.Received, res.Fragments)
+		fmt.Fprintf(stdout, "%.0f fragments/s, %.1f messages/s, %.1f MiB/s\n",
+			res.FragmentsPerSec, res.MessagesPerSec, res.BytesPerSec/(1<<20))
+		fmt.Fprintf(stdout, "latency p50 %v p90 %v p99 %v max %v\n", seconds(res.Latency.P50),
+			seconds(res.Latency.P90), seconds(res.Latency.P99), seconds(res.Latency.Max))
+		fmt.Fprintf(stdout, "cpu %.2fs, heap %d bytes, sys %d bytes, %d GCs\n",
+			res.CPUSeconds, res.HeapBytes, res.SysBytes, res.GCs)
+		return 0
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(res); err != nil {
+		logger.Error("writing result", "err", err)
+		return 1
+	}
+	return 0
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond)
+}
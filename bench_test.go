@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestParseSizeDist tests size distributions are read with their suffixes.
+func TestParseSizeDist(t *testing.T) {
+	for s, want := range map[string]SizeDist{
+		"fixed:64k":     {Kind: "fixed", Min: 64 << 10, Max: 64 << 10},
+		"uniform:1k-1m": {Kind: "uniform", Min: 1 << 10, Max: 1 << 20},
+		"exp:100":       {Kind: "exp", Mean: 100, Max: 1600},
+	} {
+		d, err := ParseSizeDist(s)
+		if err != nil || d != want {
+			t.Errorf("expected %+v for %q, got %+v, %v", want, s, d, err)
+		}
+	}
+	for _, s := range []string{"", "fixed", "fixed:", "fixed:-1", "uniform:5k", "uniform:2k-1k",
+		"normal:5k", "fixed:5g", "exp:1g", "fixed:99999999999999g"} {
+		if _, err := ParseSizeDist(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+	d := SizeDist{Kind: "uniform", Min: 10, Max: 20}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if n := d.sample(rng); n < 10 || n > 20 {
+			t.Fatalf("sampled %d outside 10-20", n)
+		}
+	}
+}
+
+// TestPercentiles tests the nearest rank percentiles of latencies.
+func TestPercentiles(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	p := percentiles(latencies)
+	if p.P50 != 0.05 || p.P90 != 0.09 || p.P99 != 0.099 || p.Max != 0.1 {
+		t.Errorf("unexpected percentiles %+v", p)
+	}
+	if p = percentiles(nil); p != (Percentiles{}) {
+		t.Errorf("expected no percentiles without latencies, got %+v", p)
+	}
+}
+
+// TestRunBench tests a small benchmark completes every message and writes
+// its result as JSON.
+func TestRunBench(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	status := runBench([]string{"-messages", "20", "-concurrency", "4", "-size", "uniform:1-20k",
+		"-readers", "2", "-workers", "2", "-timeout", "2s"}, &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("expected status 0, got %d: %s", status, stderr.String())
+	}
+	var res BenchResult
+	if err := json.Unmarshal(stdout.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Messages != 20 || res.Completed+res.Expired+res.Lost != 20 || res.Completed == 0 {
+		t.Errorf("expected 20 messages with some completed, got %+v", res)
+	}
+	if res.Latency.Max <= 0 || res.MessagesPerSec <= 0 || res.CPUSeconds <= 0 {
+		t.Errorf("expected latencies and rates, got %+v", res)
+	}
+	if res.Fragments < 20 {
+		t.Errorf("expected at least one fragment a message, got %d", res.Fragments)
+	}
+}
+
+// TestRunBenchArgs tests the bench subcommand rejects bad arguments.
+func TestRunBenchArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{"-messages", "0"},
+		{"-size", "huge"},
+		{"-timeout", "0s"},
+		{"-format", "xml"},
+	} {
+		if status := runBench(args, ioutil.Discard, ioutil.Discard); status != 2 {
+			t.Errorf("expected status 2 for %v, got %d", args, status)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// defaultBufferSize is the size of the pooled buffers datagrams are read
+// into. Each buffer holds several datagrams back to back.
+const defaultBufferSize = 16 * maxDatagramSize
+
+// buffer is a block of memory that a reader fills with datagrams one after
+// another. The fragments parsed from those datagrams point straight into the
+// buffer while a worker handles them, so the buffer counts its users and only
+// goes back to the pool once the reader and every fragment are done with it.
+// Fragments a message keeps waiting for the rest of it copy their data out,
+// see Fragment.detach, so a slow message doesn't pin a whole buffer.
+type buffer struct {
+	data []byte
+	used int
+	refs int32
+	pool *bufferPool
+}
+
+// free returns the slice of the buffer that hasn't been read into yet.
+func (b *buffer) free() []byte {
+	return b.data[b.used:]
+}
+
+// claim marks the next n free bytes as used by a datagram and takes a
+// reference for it. It returns the datagram's bytes.
+func (b *buffer) claim(n int) []byte {
+	d := b.data[b.used : b.used+n : b.used+n]
+	b.used += n
+	b.retain()
+	return d
+}
+
+// skip leaves the next n free bytes unused.
+func (b *buffer) skip(n int) {
+	b.used += n
+}
+
+func (b *buffer) retain() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+// release drops a reference. The last release puts the buffer back in its
+// pool.
+func (b *buffer) release() {
+	if b == nil {
+		return
+	}
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		b.pool.put(b)
+	}
+}
+
+// bufferPool is a sync.Pool of buffers of the same size.
+type bufferPool struct {
+	pool sync.Pool
+	size int
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		return &buffer{data: make([]byte, p.size), pool: p}
+	}
+	return p
+}
+
+// get returns an empty buffer holding a single reference for the caller.
+func (p *bufferPool) get() *buffer {
+	b := p.pool.Get().(*buffer)
+	b.used = 0
+	b.refs = 1
+	return b
+}
+
+func (p *bufferPool) put(b *buffer) {
+	p.pool.Put(b)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+// TestBufferClaim tests that claiming datagrams moves through the buffer
+// and takes a reference for each one.
+func TestBufferClaim(t *testing.T) {
+	p := newBufferPool(100)
+	b := p.get()
+	d := b.claim(40)
+	if len(d) != 40 || cap(d) != 40 {
+		t.Error("claimed datagram should be exactly 40 bytes")
+	}
+	if len(b.free()) != 60 {
+		t.Errorf("expected 60 free bytes, got %d", len(b.free()))
+	}
+	if b.refs != 2 {
+		t.Errorf("expected 2 references, got %d", b.refs)
+	}
+}
+
+// TestBufferRelease tests that a buffer is reset when it comes back out of
+// the pool after every reference was released.
+func TestBufferRelease(t *testing.T) {
+	p := newBufferPool(100)
+	b := p.get()
+	b.claim(10)
+	b.release()
+	if b.refs != 1 {
+		t.Error("the datagram should still hold a reference")
+	}
+	b.release()
+	if b.refs != 0 {
+		t.Error("all references should have been released")
+	}
+	b = p.get()
+	if b.used != 0 || b.refs != 1 {
+		t.Error("a buffer from the pool should be empty with one reference")
+	}
+}
+
+// TestFragmentRelease tests that releasing a fragment drops its reference
+// on the buffer and its data.
+func TestFragmentRelease(t *testing.T) {
+	p := newBufferPool(100)
+	b := p.get()
+	f := &Fragment{Data: b.claim(10), buf: b}
+	f.release()
+	if f.Data != nil || f.buf != nil {
+		t.Error("fragment should no longer point at the buffer")
+	}
+	if b.refs != 1 {
+		t.Errorf("expected 1 reference, got %d", b.refs)
+	}
+	// releasing twice must not drop another reference
+	f.release()
+	if b.refs != 1 {
+		t.Errorf("expected 1 reference, got %d", b.refs)
+	}
+}
+
+// TestStoredFragmentDetached tests that a fragment a message keeps waiting
+// copies its data out and releases the buffer, while a fragment completing
+// its message is used in place.
+func TestStoredFragmentDetached(t *testing.T) {
+	p := newBufferPool(100)
+	b := p.get()
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {})
+	first := &Fragment{FragmentHdr: FragmentHdr{DataLen: 10, TransID: 1}, Data: b.claim(10), buf: b}
+	copy(first.Data, "0123456789")
+	h.AddFragment(first)
+	if first.buf != nil || b.refs != 1 {
+		t.Errorf("expected the stored fragment to release the buffer, %d references left", b.refs)
+	}
+	b.data[0] = 'x'
+	if string(first.Data) != "0123456789" {
+		t.Errorf("expected the stored fragment's own copy of the data, got %q", first.Data)
+	}
+	last := &Fragment{FragmentHdr: FragmentHdr{IsEnd: true, DataLen: 10, Offset: 10, TransID: 1}, Data: b.claim(10), buf: b}
+	h.AddFragment(last)
+	if b.refs != 1 {
+		t.Errorf("expected the completed message to release the buffer, %d references left", b.refs)
+	}
+}
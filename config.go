@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MulticastListenConfig is the config file form of a MulticastConfig.
+type MulticastListenConfig struct {
+	Groups    []string `json:"groups"`
+	Port      int      `json:"port"`
+	Interface string   `json:"interface,omitempty"`
+	Sources   []string `json:"sources,omitempty"`
+}
+
+// LimitsConfig bounds how much the server will hold in memory.
+type LimitsConfig struct {
+	// QueueSize is the number of datagrams waiting for a worker.
+	QueueSize int `json:"queue_size"`
+	// MaxMessages is the number of messages that can be in flight at once.
+	// Zero means no limit.
+	MaxMessages int `json:"max_messages"`
+	// MaxMessageSize is the largest message in bytes. Zero means no limit.
+	MaxMessageSize int64 `json:"max_message_size"`
+	// SpillThreshold is how many bytes of a message are kept in memory
+	// before the rest is written to a temporary file. Zero keeps
+	// everything in memory.
+	SpillThreshold int64 `json:"spill_threshold,omitempty"`
+	// SpillDir is where the temporary files go, the system's temporary
+	// directory when empty.
+	SpillDir string `json:"spill_dir,omitempty"`
+	// MaxSpillFiles is how many messages can have a temporary file at
+	// once, the rest stay in memory. Zero means 64.
+	MaxSpillFiles int `json:"max_spill_files,omitempty"`
+}
+
+// LogConfig selects the log level and output format.
+type LogConfig struct {
+	// Level is debug, info, warn or error.
+	Level string `json:"level"`
+	// Format is text or json.
+	Format string `json:"format"`
+	// Sample logs one in every Sample debug records, which are the per
+	// fragment events. 0 or 1 logs them all.
+	Sample int `json:"sample,omitempty"`
+}
+
+// JournalConfig enables the write-ahead log of accepted fragments.
+type JournalConfig struct {
+	// Dir is the directory the journal's segments are kept in. The journal
+	// is off when it is empty.
+	Dir string `json:"dir,omitempty"`
+	// SegmentSize is how large a segment grows in bytes before the next one
+	// is started, 0 for 64MiB.
+	SegmentSize int64 `json:"segment_size,omitempty"`
+	// Sync flushes every record to disk before the fragment is added.
+	Sync bool `json:"sync,omitempty"`
+}
+
+// ErrorsConfig picks what happens to the server's errors.
+type ErrorsConfig struct {
+	// Policy is "drop" to log errors unless logging falls behind, when
+	// they are dropped and counted, "ring" to only keep them for the admin
+	// API, or "block" to make the readers wait until each one is logged.
+	Policy string `json:"policy"`
+	// Recent is how many errors the admin API shows, 0 for 100.
+	Recent int `json:"recent,omitempty"`
+}
+
+// TraceConfig enables recording each message's lifecycle events.
+type TraceConfig struct {
+	// File is where each finished message is appended as an OpenTelemetry
+	// JSON span, off when empty.
+	File string `json:"file,omitempty"`
+	// Keep is how many finished messages' timelines the admin API can
+	// show. Tracing is on when File is set or Keep is above 0, which
+	// defaults to 1000 if only File is set.
+	Keep int `json:"keep,omitempty"`
+}
+
+// Enabled reports whether messages are traced.
+func (c TraceConfig) Enabled() bool {
+	return c.File != "" || c.Keep > 0
+}
+
+// Config is everything needed to run the assembler. It is read from an
+// optional JSON file and then overridden by command line flags.
+type Config struct {
+	// Listen are the UDP addresses to listen on, like "127.0.0.1:6789" or
+	// "[::]:6789".
+	Listen []string `json:"listen"`
+	// Streams are stream addresses written as "tcp://host:port" or
+	// "unix:///path/to/socket".
+	Streams   []string                `json:"streams,omitempty"`
+	Multicast []MulticastListenConfig `json:"multicast,omitempty"`
+	Sockets   int                     `json:"sockets"`
+	Readers   int                     `json:"readers"`
+	Workers   int                     `json:"workers"`
+	// BatchSize is the number of datagrams read per system call, 0 or 1
+	// reads them one at a time.
+	BatchSize int `json:"batch_size"`
+	// Timeout is how long a message can wait for its missing fragments,
+	// written like "30s" or "500ms".
+	Timeout  string       `json:"timeout"`
+	ReadWait string       `json:"read_wait"`
+	Limits   LimitsConfig `json:"limits"`
+	// Sinks are where reassembled messages and holes are reported:
+	// "stdout", "stderr" or "file:/path/to/file".
+	Sinks []string  `json:"sinks"`
+	Log   LogConfig `json:"log"`
+	// ShutdownPolicy is what happens to incomplete messages on shutdown:
+	// "holes" reports their holes, "partial" reports the data received and
+	// "discard" drops them silently.
+	ShutdownPolicy string `json:"shutdown_policy"`
+	// Journal keeps the messages in flight across a crash.
+	Journal JournalConfig `json:"journal"`
+	// HTTPAddr is the TCP address the metrics and admin API are served
+	// on, off when empty.
+	HTTPAddr string `json:"http_addr,omitempty"`
+	// Trace records the messages' timelines.
+	Trace TraceConfig `json:"trace"`
+	// Errors picks what happens to the server's errors.
+	Errors ErrorsConfig `json:"errors"`
+}
+
+// DefaultConfig returns the settings the assembler runs with when nothing
+// is configured.
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:   []string{"127.0.0.1:6789"},
+		Sockets:  1,
+		Readers:  4,
+		Workers:  4,
+		Timeout:  "30s",
+		ReadWait: "5s",
+		Limits:   LimitsConfig{QueueSize: defaultQueueSize},
+		Sinks:    []string{"stdout"},
+		Log:      LogConfig{Level: "info", Format: "text"},
+
+		ShutdownPolicy: "holes",
+		Errors:         ErrorsConfig{Policy: "drop"},
+	}
+}
+
+// ConfigError is a validation error for a single config field.
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config field %s: %v", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func fieldErr(field string, format string, a ...interface{}) error {
+	return &ConfigError{Field: field, Err: fmt.Errorf(format, a...)}
+}
+
+// LoadConfigFile reads a JSON config file over the values already in cfg.
+// Unknown fields are an error so typos don't go unnoticed.
+func LoadConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// parseStreamAddr splits "tcp://host:port" or "unix:///path".
+func parseStreamAddr(s string) (StreamAddr, error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return StreamAddr{}, errors.New("expected network://address")
+	}
+	sa := StreamAddr{Network: s[:i], Address: s[i+3:]}
+	switch sa.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return StreamAddr{}, fmt.Errorf("unsupported network %q", sa.Network)
+	}
+	if sa.Address == "" {
+		return StreamAddr{}, errors.New("missing address")
+	}
+	return sa, nil
+}
+
+func parseIPs(field string, addrs []string) ([]net.IP, error) {
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		if ips[i] = net.ParseIP(a); ips[i] == nil {
+			return nil, fieldErr(fmt.Sprintf("%s[%d]", field, i), "%q is not an IP address", a)
+		}
+	}
+	return ips, nil
+}
+
+// parseDuration parses a duration of at least a millisecond for the named
+// field. The handler counts its timeout in milliseconds so anything shorter
+// would round down to expiring every message right away.
+func parseDuration(field, v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fieldErr(field, "%q is not a duration like \"30s\"", v)
+	}
+	if d < time.Millisecond {
+		return 0, fieldErr(field, "must be at least 1ms")
+	}
+	return d, nil
+}
+
+// flushPolicies maps the shutdown_policy names to the policies.
+var flushPolicies = map[string]FlushPolicy{
+	"holes":   FlushHoles,
+	"partial": FlushPartial,
+	"discard": FlushDiscard,
+}
+
+// errorPolicies maps the errors.policy names to the policies.
+var errorPolicies = map[string]ErrorPolicy{
+	"drop":  ErrorsDrop,
+	"ring":  ErrorsRing,
+	"block": ErrorsBlock,
+}
+
+// FlushPolicy returns the policy for incomplete messages on shutdown. The
+// config must already be validated.
+func (c *Config) FlushPolicy() FlushPolicy {
+	return flushPolicies[c.ShutdownPolicy]
+}
+
+// TimeoutDuration returns how long a message can wait for its missing
+// fragments. The config must already be validated.
+func (c *Config) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(c.Timeout)
+	return d
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// Validate checks every field and returns a ConfigError naming the first bad
+// one.
+func (c *Config) Validate() error {
+	_, err := c.ServerConfig()
+	return err
+}
+
+// ServerConfig validates the config and converts it to a ServerConfig.
+func (c *Config) ServerConfig() (ServerConfig, error) {
+	sc := ServerConfig{
+		NumSockets: c.Sockets,
+		NumReaders: c.Readers,
+		NumWorkers: c.Workers,
+		QueueSize:  c.Limits.QueueSize,
+
+		ErrorPolicy:  errorPolicies[c.Errors.Policy],
+		RecentErrors: c.Errors.Recent,
+	}
+	var err error
+	if sc.ReadWait, err = parseDuration("read_wait", c.ReadWait); err != nil {
+		return sc, err
+	}
+	if _, err = parseDuration("timeout", c.Timeout); err != nil {
+		return sc, err
+	}
+	for i, l := range c.Listen {
+		addr, err := net.ResolveUDPAddr("udp", l)
+		if err != nil {
+			return sc, fieldErr(fmt.Sprintf("listen[%d]", i), "%v", err)
+		}
+		sc.Addresses = append(sc.Addresses, addr)
+	}
+	for i, st := range c.Streams {
+		sa, err := parseStreamAddr(st)
+		if err != nil {
+			return sc, fieldErr(fmt.Sprintf("streams[%d]", i), "%v", err)
+		}
+		sc.Streams = append(sc.Streams, sa)
+	}
+	for i, mc := range c.Multicast {
+		field := fmt.Sprintf("multicast[%d]", i)
+		if len(mc.Groups) == 0 {
+			return sc, fieldErr(field+".groups", "at least one group is required")
+		}
+		groups, err := parseIPs(field+".groups", mc.Groups)
+		if err != nil {
+			return sc, err
+		}
+		for j, g := range groups {
+			if !g.IsMulticast() {
+				return sc, fieldErr(fmt.Sprintf("%s.groups[%d]", field, j), "%v is not a multicast address", g)
+			}
+		}
+		if mc.Port < 1 || mc.Port > 65535 {
+			return sc, fieldErr(field+".port", "must be between 1 and 65535")
+		}
+		sources, err := parseIPs(field+".sources", mc.Sources)
+		if err != nil {
+			return sc, err
+		}
+		sc.Multicast = append(sc.Multicast, MulticastConfig{
+			Groups:    groups,
+			Port:      mc.Port,
+			Interface: mc.Interface,
+			Sources:   sources,
+		})
+	}
+	if len(sc.Addresses)+len(sc.Streams)+len(sc.Multicast) == 0 {
+		return sc, fieldErr("listen", "at least one listen, streams or multicast address is required")
+	}
+	switch {
+	case c.Sockets < 1:
+		return sc, fieldErr("sockets", "must be at least 1")
+	case c.Readers < 1:
+		return sc, fieldErr("readers", "must be at least 1")
+	case c.Workers < 1:
+		return sc, fieldErr("workers", "must be at least 1")
+	case c.BatchSize < 0:
+		return sc, fieldErr("batch_size", "can't be negative")
+	case c.Limits.QueueSize < 1:
+		return sc, fieldErr("limits.queue_size", "must be at least 1")
+	case c.Limits.MaxMessages < 0:
+		return sc, fieldErr("limits.max_messages", "can't be negative")
+	case c.Limits.MaxMessageSize < 0:
+		return sc, fieldErr("limits.max_message_size", "can't be negative")
+	case c.Limits.SpillThreshold < 0:
+		return sc, fieldErr("limits.spill_threshold", "can't be negative")
+	case c.Limits.MaxSpillFiles < 0:
+		return sc, fieldErr("limits.max_spill_files", "can't be negative")
+	case c.Journal.SegmentSize < 0:
+		return sc, fieldErr("journal.segment_size", "can't be negative")
+	case c.Trace.Keep < 0:
+		return sc, fieldErr("trace.keep", "can't be negative")
+	case c.Errors.Recent < 0:
+		return sc, fieldErr("errors.recent", "can't be negative")
+	}
+	for i, sink := range c.Sinks {
+		if sink != "stdout" && sink != "stderr" &&
+			!(strings.HasPrefix(sink, "file:") && len(sink) > len("file:")) {
+			return sc, fieldErr(fmt.Sprintf("sinks[%d]", i), "%q must be stdout, stderr or file:<path>", sink)
+		}
+	}
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		return sc, fieldErr("log.level", "%q must be debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Sample < 0 {
+		return sc, fieldErr("log.sample", "can't be negative")
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		return sc, fieldErr("log.format", "%q must be text or json", c.Log.Format)
+	}
+	if _, ok := flushPolicies[c.ShutdownPolicy]; !ok {
+		return sc, fieldErr("shutdown_policy", "%q must be holes, partial or discard", c.ShutdownPolicy)
+	}
+	if _, ok := errorPolicies[c.Errors.Policy]; !ok {
+		return sc, fieldErr("errors.policy", "%q must be drop, ring or block", c.Errors.Policy)
+	}
+	return sc, nil
+}
+
+// Print writes the config as indented JSON in the config file format.
+func (c *Config) Print(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// stringList is a flag that can be repeated or given a comma separated list.
+// The first use replaces whatever the config file set.
+type stringList struct {
+	list *[]string
+	set  bool
+}
+
+func (s *stringList) String() string {
+	if s.list == nil {
+		return ""
+	}
+	return strings.Join(*s.list, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	if !s.set {
+		*s.list = nil
+		s.set = true
+	}
+	*s.list = append(*s.list, strings.Split(v, ",")...)
+	return nil
+}
+
+// newFlagSet binds the command line flags to cfg's fields.
+func newFlagSet(cfg *Config, configPath *string, printConfig *bool) *flag.FlagSet {
+	fs := flag.NewFlagSet("msg-assembler", flag.ContinueOnError)
+	fs.StringVar(configPath, "config", "", "JSON config file, flags override its values")
+	fs.BoolVar(printConfig, "print-config", false, "print the resulting config and exit")
+	fs.Var(&stringList{list: &cfg.Listen}, "listen", "UDP `address` to listen on, can be repeated")
+	fs.Var(&stringList{list: &cfg.Streams}, "stream", "stream address as tcp://host:port or unix:///path, can be repeated")
+	fs.IntVar(&cfg.Sockets, "sockets", cfg.Sockets, "SO_REUSEPORT sockets per UDP address")
+	fs.IntVar(&cfg.Readers, "readers", cfg.Readers, "reader goroutines per socket")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "worker goroutines")
+	fs.IntVar(&cfg.BatchSize, "batch-size", cfg.BatchSize, "datagrams read per system call")
+	fs.StringVar(&cfg.Timeout, "timeout", cfg.Timeout, "how long to wait for a message's missing fragments")
+	fs.StringVar(&cfg.ReadWait, "read-wait", cfg.ReadWait, "how long a reader blocks before checking for shutdown")
+	fs.IntVar(&cfg.Limits.QueueSize, "queue-size", cfg.Limits.QueueSize, "datagrams waiting for a worker")
+	fs.IntVar(&cfg.Limits.MaxMessages, "max-messages", cfg.Limits.MaxMessages, "messages in flight at once, 0 for no limit")
+	fs.Int64Var(&cfg.Limits.MaxMessageSize, "max-message-size", cfg.Limits.MaxMessageSize, "largest message in bytes, 0 for no limit")
+	fs.Int64Var(&cfg.Limits.SpillThreshold, "spill-threshold", cfg.Limits.SpillThreshold, "bytes of a message kept in memory before the rest goes to disk, 0 to keep it all in memory")
+	fs.StringVar(&cfg.Limits.SpillDir, "spill-dir", cfg.Limits.SpillDir, "`directory` for messages spilled to disk")
+	fs.IntVar(&cfg.Limits.MaxSpillFiles, "max-spill-files", cfg.Limits.MaxSpillFiles, "messages spilled to disk at once, 0 for 64")
+	fs.Var(&stringList{list: &cfg.Sinks}, "sink", "where results go: stdout, stderr or file:<path>, can be repeated")
+	fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "debug, info, warn or error")
+	fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "text or json")
+	fs.IntVar(&cfg.Log.Sample, "log-sample", cfg.Log.Sample, "log one in every `n` per fragment debug events")
+	fs.StringVar(&cfg.ShutdownPolicy, "shutdown-policy", cfg.ShutdownPolicy,
+		"what to do with incomplete messages on shutdown: holes, partial or discard")
+	fs.StringVar(&cfg.Errors.Policy, "error-policy", cfg.Errors.Policy,
+		"what to do with server errors: drop when logging falls behind, ring to only keep the recent ones, or block")
+	fs.IntVar(&cfg.Errors.Recent, "recent-errors", cfg.Errors.Recent, "errors kept for the admin API, 0 for 100")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", cfg.HTTPAddr, "`address` to serve /metrics and /admin/ on, off when empty")
+	fs.StringVar(&cfg.Journal.Dir, "journal-dir", cfg.Journal.Dir, "`directory` for the write-ahead log of fragments, off when empty")
+	fs.Int64Var(&cfg.Journal.SegmentSize, "journal-segment-size", cfg.Journal.SegmentSize, "journal segment size in bytes, 0 for 64MiB")
+	fs.BoolVar(&cfg.Journal.Sync, "journal-sync", cfg.Journal.Sync, "flush every journal record to disk")
+	fs.StringVar(&cfg.Trace.File, "trace-file", cfg.Trace.File, "`file` to append each message's trace to as OpenTelemetry JSON")
+	fs.IntVar(&cfg.Trace.Keep, "trace-keep", cfg.Trace.Keep, "finished message timelines kept for the admin API, 0 for 1000 when tracing")
+	return fs
+}
+
+// ParseArgs builds the config from the defaults, the config file named by
+// -config and then the rest of the flags. It returns whether -print-config
+// was given.
+func ParseArgs(args []string, stderr io.Writer) (*Config, bool, error) {
+	// the first pass only finds the config file so the flags can be applied
+	// on top of it in the second pass
+	var configPath string
+	var printConfig bool
+	first := newFlagSet(DefaultConfig(), &configPath, &printConfig)
+	first.SetOutput(io.Discard)
+	first.Parse(args)
+
+	cfg := DefaultConfig()
+	if configPath != "" {
+		if err := LoadConfigFile(configPath, cfg); err != nil {
+			return nil, false, err
+		}
+	}
+	fs := newFlagSet(cfg, &configPath, &printConfig)
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+	return cfg, printConfig, nil
+}
+
+// openSinks opens every sink and returns a writer that copies to all of
+// them and a function closing the files.
+func openSinks(sinks []string) (io.Writer, func(), error) {
+	var writers []io.Writer
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, sink := range sinks {
+		switch {
+		case sink == "stdout":
+			writers = append(writers, os.Stdout)
+		case sink == "stderr":
+			writers = append(writers, os.Stderr)
+		default:
+			f, err := os.OpenFile(strings.TrimPrefix(sink, "file:"),
+				os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			files = append(files, f)
+			writers = append(writers, f)
+		}
+	}
+	return io.MultiWriter(writers...), closeAll, nil
+}
+
+// newLogger builds the logger described by the log config. Its level is
+// read from level so it can be changed later.
+func newLogger(c LogConfig, w io.Writer, level *slog.LevelVar) *slog.Logger {
+	l, _ := parseLogLevel(c.Level)
+	level.Set(l)
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if c.Format == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	if c.Sample > 1 {
+		handler = &sampleHandler{Handler: handler, every: uint64(c.Sample), n: &atomic.Uint64{}}
+	}
+	return slog.New(handler)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "msg-assembler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestDefaultConfig tests that the defaults match what the server used to
+// hard code and that they are valid.
+func TestDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default config should be valid: %v", err)
+	}
+	sc, _ := cfg.ServerConfig()
+	if sc.Addresses[0].String() != "127.0.0.1:6789" {
+		t.Errorf("unexpected default address %v", sc.Addresses[0])
+	}
+	if sc.NumWorkers != 4 || sc.ReadWait != 5*time.Second || cfg.TimeoutDuration() != 30*time.Second {
+		t.Errorf("unexpected defaults %+v", sc)
+	}
+}
+
+// TestParseArgsFileAndFlags tests that flags override the config file which
+// overrides the defaults.
+func TestParseArgsFileAndFlags(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"listen": ["[::]:7000"],
+		"streams": ["tcp://127.0.0.1:7001"],
+		"workers": 2,
+		"timeout": "10s",
+		"limits": {"queue_size": 16}
+	}`)
+	cfg, printConfig, err := ParseArgs([]string{"-config", path, "-workers", "8",
+		"-listen", "127.0.0.1:1", "-listen", "127.0.0.1:2", "--print-config"}, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !printConfig {
+		t.Error("expected print config to be set")
+	}
+	if cfg.Workers != 8 {
+		t.Errorf("flag should have overridden workers, got %d", cfg.Workers)
+	}
+	if cfg.Timeout != "10s" || cfg.Limits.QueueSize != 16 {
+		t.Error("config file values should have been kept")
+	}
+	if strings.Join(cfg.Listen, ",") != "127.0.0.1:1,127.0.0.1:2" {
+		t.Errorf("listen flags should have replaced the file's, got %v", cfg.Listen)
+	}
+	if cfg.Readers != 4 {
+		t.Error("defaults should be kept when nothing sets them")
+	}
+}
+
+// TestValidateNamesField tests that validation errors name the bad field.
+func TestValidateNamesField(t *testing.T) {
+	tests := []struct {
+		field  string
+		modify func(c *Config)
+	}{
+		{"listen[1]", func(c *Config) { c.Listen = append(c.Listen, "nope:port") }},
+		{"listen", func(c *Config) { c.Listen = nil }},
+		{"streams[0]", func(c *Config) { c.Streams = []string{"udp://1.2.3.4:5"} }},
+		{"multicast[0].groups[0]", func(c *Config) {
+			c.Multicast = []MulticastListenConfig{{Groups: []string{"10.0.0.1"}, Port: 1}}
+		}},
+		{"multicast[0].port", func(c *Config) {
+			c.Multicast = []MulticastListenConfig{{Groups: []string{"239.0.0.1"}}}
+		}},
+		{"multicast[0].sources[0]", func(c *Config) {
+			c.Multicast = []MulticastListenConfig{{Groups: []string{"239.0.0.1"}, Port: 1, Sources: []string{"x"}}}
+		}},
+		{"workers", func(c *Config) { c.Workers = 0 }},
+		{"timeout", func(c *Config) { c.Timeout = "soon" }},
+		{"timeout", func(c *Config) { c.Timeout = "500us" }},
+		{"read_wait", func(c *Config) { c.ReadWait = "0s" }},
+		{"limits.queue_size", func(c *Config) { c.Limits.QueueSize = 0 }},
+		{"limits.max_messages", func(c *Config) { c.Limits.MaxMessages = -1 }},
+		{"limits.max_spill_files", func(c *Config) { c.Limits.MaxSpillFiles = -1 }},
+		{"sinks[0]", func(c *Config) { c.Sinks = []string{"file:"} }},
+		{"log.level", func(c *Config) { c.Log.Level = "loud" }},
+		{"log.format", func(c *Config) { c.Log.Format = "xml" }},
+		{"errors.policy", func(c *Config) { c.Errors.Policy = "ignore" }},
+	}
+	for _, test := range tests {
+		cfg := DefaultConfig()
+		test.modify(cfg)
+		err := cfg.Validate()
+		var cfgErr *ConfigError
+		if !errors.As(err, &cfgErr) {
+			t.Errorf("expected a ConfigError for %s, got %v", test.field, err)
+			continue
+		}
+		if cfgErr.Field != test.field {
+			t.Errorf("expected field %s, got %s", test.field, cfgErr.Field)
+		}
+	}
+}
+
+// TestLoadConfigFileUnknownField tests that a misspelled field is an error.
+func TestLoadConfigFileUnknownField(t *testing.T) {
+	path := writeConfigFile(t, `{"workerz": 3}`)
+	err := LoadConfigFile(path, DefaultConfig())
+	if err == nil || !strings.Contains(err.Error(), "workerz") {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+}
+
+// TestPrintConfig tests that the printed config can be loaded back.
+func TestPrintConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Workers = 7
+	cfg.Sinks = []string{"stderr", "file:/tmp/out"}
+	b := &bytes.Buffer{}
+	if err := cfg.Print(b); err != nil {
+		t.Fatal(err)
+	}
+	loaded := DefaultConfig()
+	if err := LoadConfigFile(writeConfigFile(t, b.String()), loaded); err != nil {
+		t.Fatalf("printed config didn't load: %v", err)
+	}
+	if loaded.Workers != 7 || len(loaded.Sinks) != 2 {
+		t.Errorf("printed config didn't round trip %+v", loaded)
+	}
+}
+
+// TestOpenSinks tests that results are written to every sink.
+func TestOpenSinks(t *testing.T) {
+	path := writeConfigFile(t, "")
+	w, closeSinks, err := openSinks([]string{"file:" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	PrintHolesTo(w)(3, 10)
+	closeSinks()
+	b, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(b), `msg="message hole" trans_id=3 offset=10`) {
+		t.Errorf("unexpected sink contents %q", b)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The classes of errors the server reports. Check for them with errors.Is,
+// and use errors.As with *FragmentError or *SocketError for the details.
+var (
+	// ErrShortHeader is a datagram or stream fragment too short to hold a
+	// fragment header.
+	ErrShortHeader = errors.New("short fragment header")
+	// ErrShortPayload is a fragment with less data than its header says.
+	ErrShortPayload = errors.New("short fragment payload")
+	// ErrChecksum is a record that failed its checksum. Fragments on the
+	// wire don't carry one, it comes from reading the journal.
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrTooLarge is a fragment that would make its message larger than
+	// the handler's maximum message size.
+	ErrTooLarge = errors.New("fragment past the maximum message size")
+	// ErrSocket is a socket failing to read or accept.
+	ErrSocket = errors.New("socket error")
+)
+
+// FragmentError is a datagram or stream fragment that was rejected.
+type FragmentError struct {
+	// Err is the class, ErrShortHeader, ErrShortPayload or ErrTooLarge.
+	Err error
+	// Source is the sender, nil if it isn't known.
+	Source net.Addr
+	// Len is how many bytes arrived, or for ErrTooLarge where the fragment
+	// ends in its message. Want is how many were needed, or the maximum
+	// message size.
+	Len, Want int
+}
+
+func (e *FragmentError) Error() string {
+	src := "unknown source"
+	if e.Source != nil {
+		src = e.Source.String()
+	}
+	if e.Err == ErrTooLarge {
+		return fmt.Sprintf("%v from %s: ends at byte %d, the limit is %d", e.Err, src, e.Len, e.Want)
+	}
+	return fmt.Sprintf("%v from %s: got %d bytes, need %d", e.Err, src, e.Len, e.Want)
+}
+
+func (e *FragmentError) Unwrap() error {
+	return e.Err
+}
+
+// Is lets short fragments still match io.ErrUnexpectedEOF, which is what
+// they were reported as before.
+func (e *FragmentError) Is(target error) bool {
+	return target == io.ErrUnexpectedEOF && (e.Err == ErrShortHeader || e.Err == ErrShortPayload)
+}
+
+// SocketError is a read or accept on a listener failing.
+type SocketError struct {
+	// Op is "read" or "accept".
+	Op string
+	// Network and Addr are the listener's.
+	Network string
+	Addr    string
+	// Source is the connection's remote address for stream reads, nil
+	// otherwise.
+	Source net.Addr
+	Err    error
+}
+
+func (e *SocketError) Error() string {
+	if e.Source != nil {
+		return fmt.Sprintf("%s %s %s from %v: %v", e.Op, e.Network, e.Addr, e.Source, e.Err)
+	}
+	return fmt.Sprintf("%s %s %s: %v", e.Op, e.Network, e.Addr, e.Err)
+}
+
+func (e *SocketError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every SocketError match ErrSocket.
+func (e *SocketError) Is(target error) bool {
+	return target == ErrSocket
+}
+
+// errorClasses are the error classes in the order they are counted. An
+// error that isn't any of them is counted as "other".
+var errorClasses = [...]struct {
+	name string
+	err  error
+}{
+	{"short_header", ErrShortHeader},
+	{"short_payload", ErrShortPayload},
+	{"checksum", ErrChecksum},
+	{"too_large", ErrTooLarge},
+	{"socket", ErrSocket},
+}
+
+// errorClass returns the index in errorClasses of err's class, or
+// len(errorClasses) for other errors.
+func errorClass(err error) int {
+	for i, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return i
+		}
+	}
+	return len(errorClasses)
+}
+
+// ErrorClass names the class err is counted under: short_header,
+// short_payload, checksum, too_large, socket or other.
+func ErrorClass(err error) string {
+	if i := errorClass(err); i < len(errorClasses) {
+		return errorClasses[i].name
+	}
+	return "other"
+}
+
+// errorCounts counts errors by class, the last count is for other errors.
+type errorCounts [len(errorClasses) + 1]atomic.Uint64
+
+func (c *errorCounts) add(err error) {
+	c[errorClass(err)].Add(1)
+}
+
+// byClass returns the counts keyed by class name.
+func (c *errorCounts) byClass() map[string]uint64 {
+	counts := make(map[string]uint64, len(c))
+	for i := range c {
+		name := "other"
+		if i < len(errorClasses) {
+			name = errorClasses[i].name
+		}
+		counts[name] = c[i].Load()
+	}
+	return counts
+}
+
+// defaultRecentErrors is how many errors the server keeps for RecentErrors
+// when no other number is given.
+const defaultRecentErrors = 100
+
+// ErrorPolicy decides what the server does with an error when it is
+// reported. Every error is counted and kept among the recent errors whatever
+// the policy.
+type ErrorPolicy int
+
+const (
+	// ErrorsDrop hands errors to HandleErrors while there is room in its
+	// queue and drops and counts them when there isn't, so the readers never
+	// wait.
+	ErrorsDrop ErrorPolicy = iota
+	// ErrorsRing only keeps errors among the recent errors, HandleErrors
+	// gets none.
+	ErrorsRing
+	// ErrorsBlock waits for HandleErrors to take every error. The readers
+	// and workers stop if nothing calls HandleErrors.
+	ErrorsBlock
+)
+
+// ErrorRecord is an error the server reported.
+type ErrorRecord struct {
+	Time  time.Time `json:"time"`
+	Class string    `json:"class"`
+	Err   error     `json:"-"`
+	// Message is Err's message
+	Message string `json:"error"`
+}
+
+// errorRing keeps the most recent errors.
+type errorRing struct {
+	lock sync.Mutex
+	errs []ErrorRecord
+	// next is where the next error goes once errs is full
+	next int
+}
+
+func newErrorRing(size int) *errorRing {
+	if size < 1 {
+		size = defaultRecentErrors
+	}
+	return &errorRing{errs: make([]ErrorRecord, 0, size)}
+}
+
+func (r *errorRing) add(err error) {
+	rec := ErrorRecord{Time: time.Now(), Class: ErrorClass(err), Err: err, Message: err.Error()}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.errs) < cap(r.errs) {
+		r.errs = append(r.errs, rec)
+		return
+	}
+	r.errs[r.next] = rec
+	r.next = (r.next + 1) % len(r.errs)
+}
+
+// records returns the errors kept, oldest first.
+func (r *errorRing) records() []ErrorRecord {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	recs := make([]ErrorRecord, 0, len(r.errs))
+	recs = append(recs, r.errs[r.next:]...)
+	return append(recs, r.errs[:r.next]...)
+}
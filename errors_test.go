@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestFragmentError tests a rejected fragment's error matches its class and
+// carries the source and byte counts.
+func TestFragmentError(t *testing.T) {
+	src := createUDPAddr()
+	var err error = &FragmentError{Err: ErrShortPayload, Source: src, Len: 20, Want: 112}
+	err = fmt.Errorf("worker: %w", err)
+	if !errors.Is(err, ErrShortPayload) || errors.Is(err, ErrShortHeader) {
+		t.Error("expected the error to only match its class")
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("expected a short fragment to match io.ErrUnexpectedEOF")
+	}
+	var fe *FragmentError
+	if !errors.As(err, &fe) || fe.Source != src || fe.Len != 20 || fe.Want != 112 {
+		t.Errorf("unexpected fragment error %+v", fe)
+	}
+	expected := "worker: short fragment payload from " + src.String() + ": got 20 bytes, need 112"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+	if errors.Is(&FragmentError{Err: ErrTooLarge}, io.ErrUnexpectedEOF) {
+		t.Error("expected a fragment that is too large not to be an unexpected EOF")
+	}
+}
+
+// TestSocketError tests socket errors match ErrSocket and the underlying
+// error.
+func TestSocketError(t *testing.T) {
+	cause := errors.New("connection refused")
+	err := &SocketError{Op: "read", Network: "udp", Addr: "127.0.0.1:6789", Err: cause}
+	if !errors.Is(err, ErrSocket) || !errors.Is(err, cause) {
+		t.Error("expected the error to match ErrSocket and its cause")
+	}
+	if err.Error() != "read udp 127.0.0.1:6789: connection refused" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
+
+// TestErrorClass tests errors are named by class.
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{&FragmentError{Err: ErrShortHeader}, "short_header"},
+		{&FragmentError{Err: ErrShortPayload}, "short_payload"},
+		{fmt.Errorf("journal: %w", ErrChecksum), "checksum"},
+		{&FragmentError{Err: ErrTooLarge}, "too_large"},
+		{&SocketError{Err: errors.New("reset")}, "socket"},
+		{errors.New("something else"), "other"},
+	}
+	for _, test := range tests {
+		if class := ErrorClass(test.err); class != test.class {
+			t.Errorf("expected %v to be %s, got %s", test.err, test.class, class)
+		}
+	}
+}
+
+// TestServerErrors tests the server reports a short datagram with its
+// source and counts it by class.
+func TestServerErrors(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 4000}
+	h := NewMsgHandler(5000, nil, nil)
+	s := NewServer(1, &FakeNet{conn: &FakeConn{readBytes: make([]byte, 5), src: src}}, h,
+		createUDPAddr(), time.Millisecond)
+	errs := make(chan error, 1)
+	s.Start(context.Background())
+	go s.HandleErrors(func(e error) {
+		select {
+		case errs <- e:
+		default:
+		}
+	})
+	err := <-errs
+	s.Stop()
+	var fe *FragmentError
+	if !errors.As(err, &fe) || fe.Err != ErrShortHeader || fe.Source != src || fe.Len != 5 {
+		t.Errorf("unexpected error %v", err)
+	}
+	if counts := s.ErrorCounts(); counts["short_header"] == 0 || counts["socket"] != 0 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+}
+
+// TestServerTooLarge tests the server reports fragments over the maximum
+// message size.
+func TestServerTooLarge(t *testing.T) {
+	data, _ := ioutil.ReadAll(createFrag(false, 1, 90, make([]byte, 20), false))
+	h := NewMsgHandler(5000, nil, nil)
+	h.SetLimits(0, 100)
+	s := NewServer(1, &FakeNet{conn: createFakeConn(data)}, h, createUDPAddr(), time.Millisecond)
+	errs := make(chan error, 1)
+	s.Start(context.Background())
+	go s.HandleErrors(func(e error) {
+		select {
+		case errs <- e:
+		default:
+		}
+	})
+	err := <-errs
+	s.Stop()
+	var fe *FragmentError
+	if !errors.Is(err, ErrTooLarge) || !errors.As(err, &fe) || fe.Len != 110 || fe.Want != 100 {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// TestErrorPolicyDrop tests errors are dropped and counted when nothing
+// handles them instead of blocking the server.
+func TestErrorPolicyDrop(t *testing.T) {
+	s := NewServerFromConfig(ServerConfig{RecentErrors: 3}, &FakeNet{}, nil)
+	for i := 0; i < 105; i++ {
+		s.reportError(fmt.Errorf("error %d", i))
+	}
+	if s.DroppedErrors() != 5 {
+		t.Errorf("expected 5 dropped errors, got %d", s.DroppedErrors())
+	}
+	recent := s.RecentErrors()
+	if len(recent) != 3 || recent[0].Message != "error 102" || recent[2].Message != "error 104" {
+		t.Errorf("unexpected recent errors %+v", recent)
+	}
+	if recent[0].Class != "other" {
+		t.Errorf("expected the other class, got %s", recent[0].Class)
+	}
+}
+
+// TestErrorPolicyRing tests errors are only kept as recent errors.
+func TestErrorPolicyRing(t *testing.T) {
+	s := NewServerFromConfig(ServerConfig{ErrorPolicy: ErrorsRing}, &FakeNet{}, nil)
+	s.reportError(&FragmentError{Err: ErrShortHeader})
+	if len(s.errChan) != 0 || s.DroppedErrors() != 0 {
+		t.Error("expected the error not to be handed to HandleErrors")
+	}
+	if recent := s.RecentErrors(); len(recent) != 1 || recent[0].Class != "short_header" {
+		t.Errorf("unexpected recent errors %+v", recent)
+	}
+	s.SetErrorPolicy(ErrorsBlock)
+	s.reportError(errors.New("blocked"))
+	if len(s.errChan) != 1 {
+		t.Error("expected the error to be handed to HandleErrors")
+	}
+}
+
+// TestAdminErrors tests listing the recent errors.
+func TestAdminErrors(t *testing.T) {
+	s := NewServerFromConfig(ServerConfig{}, &FakeNet{}, nil)
+	s.reportError(&SocketError{Op: "read", Network: "udp", Addr: "127.0.0.1:6789", Err: errors.New("reset")})
+	rec := httptest.NewRecorder()
+	newHTTPHandler(NewRegistry(), nil, s, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/admin/errors", nil))
+	var recent []ErrorRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &recent); err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 1 || recent[0].Class != "socket" || recent[0].Message != "read udp 127.0.0.1:6789: reset" {
+		t.Errorf("unexpected errors %+v", recent)
+	}
+}
+
+// TestJournalChecksumCounted tests that a corrupted journal record is
+// counted with the server's errors under the checksum class.
+func TestJournalChecksumCounted(t *testing.T) {
+	dir := journalDir(t)
+	j := openTestJournal(t, dir, 0)
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetJournal(j)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	j.Close()
+	path := segmentFiles(t, dir)[0]
+	data, _ := ioutil.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(path, data, 0644)
+
+	s := NewServerFromConfig(ServerConfig{}, &FakeNet{}, nil)
+	j, err := OpenJournal(dir, 0, false, reportJournalErrors(slog.New(slog.NewTextHandler(ioutil.Discard, nil)), s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if n := s.ErrorCounts()["checksum"]; n != 1 {
+		t.Errorf("expected 1 checksum error, got %d", n)
+	}
+	if recent := s.RecentErrors(); len(recent) != 1 || !errors.Is(recent[0].Err, ErrChecksum) {
+		t.Errorf("unexpected recent errors %+v", recent)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"io"
 )
 
+// FragHdrLen is the number of bytes in an encoded fragment header.
+const FragHdrLen = 12
+
 // FragmentHdr defines the header portion of a fragmented packet
 type FragmentHdr struct {
 	IsEnd   bool
@@ -13,31 +16,36 @@ type FragmentHdr struct {
 	Offset  uint32
 }
 
-// CreateFragHeader reads from the reader and creates a fragment header.
-func CreateFragHeader(reader io.Reader) (*FragmentHdr, error) {
-	hdr := &FragmentHdr{}
-	var flags uint16
-	var err error
-	if err = binary.Read(reader, binary.BigEndian, &flags); err != nil {
-		return nil, err
-	}
+// decodeFragHeader fills in the header from the first FragHdrLen bytes of b.
+// The caller must make sure b is long enough.
+func decodeFragHeader(hdr *FragmentHdr, b []byte) {
+	hdr.IsEnd = binary.BigEndian.Uint16(b[0:]) > 0
+	hdr.DataLen = binary.BigEndian.Uint16(b[2:])
+	hdr.Offset = binary.BigEndian.Uint32(b[4:])
+	hdr.TransID = binary.BigEndian.Uint32(b[8:])
+}
 
-	if flags > 0 {
-		hdr.IsEnd = true
-	} else {
-		hdr.IsEnd = false
+// encodeFragHeader writes the header into the first FragHdrLen bytes of b.
+// The caller must make sure b is long enough.
+func encodeFragHeader(b []byte, hdr *FragmentHdr) {
+	var flags uint16
+	if hdr.IsEnd {
+		flags = 1
 	}
+	binary.BigEndian.PutUint16(b[0:], flags)
+	binary.BigEndian.PutUint16(b[2:], hdr.DataLen)
+	binary.BigEndian.PutUint32(b[4:], hdr.Offset)
+	binary.BigEndian.PutUint32(b[8:], hdr.TransID)
+}
 
-	if err = binary.Read(reader, binary.BigEndian, &hdr.DataLen); err != nil {
-		return nil, err
-	}
-	if err = binary.Read(reader, binary.BigEndian, &hdr.Offset); err != nil {
-		return nil, err
-	}
-	if err = binary.Read(reader, binary.BigEndian, &hdr.TransID); err != nil {
+// CreateFragHeader reads from the reader and creates a fragment header.
+func CreateFragHeader(reader io.Reader) (*FragmentHdr, error) {
+	var b [FragHdrLen]byte
+	if _, err := io.ReadFull(reader, b[:]); err != nil {
 		return nil, err
 	}
-
+	hdr := &FragmentHdr{}
+	decodeFragHeader(hdr, b[:])
 	return hdr, nil
 }
 
@@ -46,6 +54,38 @@ func CreateFragHeader(reader io.Reader) (*FragmentHdr, error) {
 type Fragment struct {
 	FragmentHdr
 	Data []byte
+	// buf is the pooled buffer Data points into. It is nil when Data was
+	// allocated for this fragment alone.
+	buf *buffer
+	// spilled is set once the message has written Data to its spill file
+	// and dropped it from memory. spillOff is where the data starts in the
+	// file.
+	spilled  bool
+	spillOff int64
+}
+
+// release gives the fragment's reference on its pooled buffer back. Data
+// must not be used afterwards.
+func (f *Fragment) release() {
+	if f.buf != nil {
+		f.buf.release()
+		f.buf = nil
+		f.Data = nil
+	}
+}
+
+// detach copies the fragment's data out of its pooled buffer and gives the
+// buffer back, so a fragment kept waiting for the rest of its message only
+// holds its own data rather than a whole buffer of other datagrams.
+func (f *Fragment) detach() {
+	if f.buf == nil {
+		return
+	}
+	data := make([]byte, len(f.Data))
+	copy(data, f.Data)
+	f.buf.release()
+	f.buf = nil
+	f.Data = data
 }
 
 // CreateFragment reads from the reader and creates a full Fragment object.
@@ -59,9 +99,31 @@ func CreateFragment(reader io.Reader) (*Fragment, error) {
 	}
 	frag.FragmentHdr = *hdr
 	data := make([]byte, frag.DataLen)
-	if err = binary.Read(reader, binary.BigEndian, data); err != nil {
+	if _, err = io.ReadFull(reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
 	frag.Data = data
 	return frag, nil
 }
+
+// ParseFragment decodes a fragment from a datagram without copying it. The
+// returned fragment's Data points into b so b must not be modified while the
+// fragment is in use. It returns a *FragmentError, ErrShortHeader or
+// ErrShortPayload, if b is too short for the header or the data length in the
+// header.
+func ParseFragment(b []byte) (*Fragment, error) {
+	if len(b) < FragHdrLen {
+		return nil, &FragmentError{Err: ErrShortHeader, Len: len(b), Want: FragHdrLen}
+	}
+	frag := &Fragment{}
+	decodeFragHeader(&frag.FragmentHdr, b)
+	end := FragHdrLen + int(frag.DataLen)
+	if len(b) < end {
+		return nil, &FragmentError{Err: ErrShortPayload, Len: len(b), Want: end}
+	}
+	frag.Data = b[FragHdrLen:end:end]
+	return frag, nil
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"io/ioutil"
+	"math"
 	"testing"
 )
 
@@ -143,3 +146,146 @@ func TestCreateFragment(t *testing.T) {
 		t.Error("expected an error when creating the header")
 	}
 }
+
+// TestParseFragment tests that ParseFragment decodes the header and points
+// the data at the datagram's bytes.
+func TestParseFragment(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5}
+	b, _ := ioutil.ReadAll(createFrag(true, 7, 20, data, false))
+	frag, err := ParseFragment(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !frag.IsEnd || frag.DataLen != 5 || frag.TransID != 7 || frag.Offset != 20 {
+		t.Errorf("header wasn't decoded correctly %+v", frag.FragmentHdr)
+	}
+	if !bytes.Equal(frag.Data, data) {
+		t.Error("Fragment data wasn't correct")
+	}
+	b[FragHdrLen] = 9
+	if frag.Data[0] != 9 {
+		t.Error("Fragment data should point into the datagram")
+	}
+}
+
+// TestParseFragmentShort tests that ParseFragment returns an error when the
+// datagram is too short for the header or the data.
+func TestParseFragmentShort(t *testing.T) {
+	if _, err := ParseFragment(make([]byte, FragHdrLen-1)); !errors.Is(err, ErrShortHeader) {
+		t.Error("expected an error for a short header")
+	}
+	b, _ := ioutil.ReadAll(createFrag(false, 1, 0, make([]byte, 10), false))
+	if _, err := ParseFragment(b[:len(b)-1]); !errors.Is(err, ErrShortPayload) {
+		t.Error("expected an error for short data")
+	}
+}
+
+func benchDatagram() []byte {
+	b, _ := ioutil.ReadAll(createFrag(false, 1, 0, make([]byte, 1400), false))
+	return b
+}
+
+// BenchmarkCreateFragment measures parsing a datagram through an io.Reader.
+func BenchmarkCreateFragment(b *testing.B) {
+	d := benchDatagram()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := CreateFragment(bytes.NewReader(d)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParseFragment measures parsing a datagram in place.
+func BenchmarkParseFragment(b *testing.B) {
+	d := benchDatagram()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseFragment(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPooledParse measures the server's path of claiming a datagram
+// from a pooled buffer, parsing it and releasing it.
+func BenchmarkPooledParse(b *testing.B) {
+	d := benchDatagram()
+	pool := newBufferPool(defaultBufferSize)
+	buf := pool.get()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if len(buf.free()) < maxDatagramSize {
+			buf.release()
+			buf = pool.get()
+		}
+		n := copy(buf.free(), d)
+		f, err := ParseFragment(buf.claim(n))
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.buf = buf
+		f.release()
+	}
+	buf.release()
+}
+
+// FuzzParseFragment checks that arbitrary datagrams never panic the parsers,
+// that ParseFragment and CreateFragment agree and that a parsed fragment
+// encodes back to the bytes it was read from.
+func FuzzParseFragment(f *testing.F) {
+	for _, frag := range []*Fragment{
+		{FragmentHdr: FragmentHdr{DataLen: 3, Offset: 10, TransID: 7}, Data: []byte{1, 2, 3}},
+		{FragmentHdr: FragmentHdr{IsEnd: true, TransID: 1}},
+		{FragmentHdr: FragmentHdr{IsEnd: true, DataLen: 1, Offset: math.MaxUint32, TransID: math.MaxUint32}, Data: []byte{9}},
+	} {
+		b, _ := frag.MarshalBinary()
+		f.Add(b)
+		f.Add(b[:len(b)-1])
+		f.Add(append(b, 0xff))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hdr, hdrErr := CreateFragHeader(bytes.NewReader(b))
+		created, createErr := CreateFragment(bytes.NewReader(b))
+		parsed, err := ParseFragment(b)
+		if len(b) < FragHdrLen {
+			if hdrErr == nil || createErr == nil || !errors.Is(err, ErrShortHeader) {
+				t.Fatalf("expected short header errors, got %v, %v, %v", hdrErr, createErr, err)
+			}
+			return
+		}
+		if hdrErr != nil {
+			t.Fatalf("unexpected header error %v", hdrErr)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrShortPayload) || createErr == nil {
+				t.Fatalf("expected short payload errors, got %v, %v", createErr, err)
+			}
+			if len(b) >= FragHdrLen+int(hdr.DataLen) {
+				t.Fatalf("payload of %d bytes rejected for data length %d", len(b)-FragHdrLen, hdr.DataLen)
+			}
+			return
+		}
+		if createErr != nil {
+			t.Fatalf("CreateFragment failed where ParseFragment didn't: %v", createErr)
+		}
+		if parsed.FragmentHdr != *hdr || created.FragmentHdr != *hdr {
+			t.Fatalf("headers differ: %+v, %+v, %+v", *hdr, parsed.FragmentHdr, created.FragmentHdr)
+		}
+		if len(parsed.Data) != int(hdr.DataLen) || !bytes.Equal(parsed.Data, created.Data) {
+			t.Fatalf("data differs: %x, %x", parsed.Data, created.Data)
+		}
+		out, _ := parsed.MarshalBinary()
+		want := append([]byte(nil), b[:FragHdrLen+int(hdr.DataLen)]...)
+		// any non-zero flags mark the end and encode as 1
+		want[0], want[1] = 0, 0
+		if hdr.IsEnd {
+			want[1] = 1
+		}
+		if !bytes.Equal(out, want) {
+			t.Fatalf("fragment encodes to %x, read from %x", out, want)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	// maxUDPPayload is the largest IPv4 UDP payload, 65535 less the 20 byte
+	// IP and 8 byte UDP headers.
+	maxUDPPayload = 65507
+	// MaxPayloadSize is the most data a fragment can carry and still fit
+	// its datagram, header included, in one IPv4 UDP packet.
+	MaxPayloadSize = maxUDPPayload - FragHdrLen
+	// DefaultPayloadSize keeps a fragment's datagram inside a 1500 byte
+	// Ethernet frame over IPv4 or IPv6.
+	DefaultPayloadSize = 1400
+)
+
+// ErrMessageTooLong is returned by Fragmenter.Split when a message doesn't
+// fit in the 32 bit offsets of the fragment header.
+var ErrMessageTooLong = errors.New("message longer than 4GiB")
+
+// Fragmenter splits messages into fragments for sending to the assembler.
+type Fragmenter struct {
+	payloadSize int
+	nextID      func() uint32
+}
+
+// NewFragmenter creates a Fragmenter putting up to payloadSize bytes of the
+// message in each fragment, 0 for DefaultPayloadSize. nextID is called for
+// the transaction ID of each message, nil numbers them one after another
+// from a random start.
+func NewFragmenter(payloadSize int, nextID func() uint32) *Fragmenter {
+	if payloadSize < 1 || payloadSize > MaxPayloadSize {
+		payloadSize = DefaultPayloadSize
+	}
+	if nextID == nil {
+		var b [4]byte
+		rand.Read(b[:])
+		nextID = SequentialIDs(binary.BigEndian.Uint32(b[:]))
+	}
+	return &Fragmenter{payloadSize: payloadSize, nextID: nextID}
+}
+
+// SequentialIDs returns a transaction ID allocator handing out start, start+1
+// and so on. It is safe to use from several goroutines.
+func SequentialIDs(start uint32) func() uint32 {
+	var next atomic.Uint32
+	next.Store(start)
+	return func() uint32 {
+		return next.Add(1) - 1
+	}
+}
+
+// Split reads a message from r until io.EOF and calls cb with each of its
+// fragments in order, the last one marked as the end. An empty message is a
+// single empty end fragment. The fragment's Data is only valid during the
+// call. It returns the message's transaction ID and stops at the first error
+// from r or cb.
+func (f *Fragmenter) Split(r io.Reader, cb func(frag *Fragment) error) (uint32, error) {
+	transID := f.nextID()
+	// one fragment is read ahead to know which is the last
+	cur := make([]byte, f.payloadSize)
+	next := make([]byte, f.payloadSize)
+	n, err := io.ReadFull(r, cur)
+	var offset uint64
+	for {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return transID, err
+		}
+		isEnd := err != nil
+		var m int
+		if !isEnd {
+			m, err = io.ReadFull(r, next)
+			isEnd = err == io.EOF
+		}
+		if offset+uint64(n) > math.MaxUint32 {
+			return transID, ErrMessageTooLong
+		}
+		frag := &Fragment{
+			FragmentHdr: FragmentHdr{IsEnd: isEnd, DataLen: uint16(n), TransID: transID, Offset: uint32(offset)},
+			Data:        cur[:n],
+		}
+		if cbErr := cb(frag); cbErr != nil {
+			return transID, cbErr
+		}
+		if isEnd {
+			return transID, nil
+		}
+		offset += uint64(n)
+		cur, next, n = next, cur, m
+	}
+}
+
+// appendFragment appends the fragment as it goes on the wire, the header
+// followed by the data.
+func appendFragment(b []byte, frag *Fragment) []byte {
+	var hdr [FragHdrLen]byte
+	encodeFragHeader(hdr[:], &frag.FragmentHdr)
+	return append(append(b, hdr[:]...), frag.Data...)
+}
+
+// MarshalBinary encodes the fragment as it goes on the wire, the format
+// CreateFragment and ParseFragment read.
+func (f *Fragment) MarshalBinary() ([]byte, error) {
+	return appendFragment(make([]byte, 0, FragHdrLen+len(f.Data)), f), nil
+}
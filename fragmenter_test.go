@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// TestFragmenterSplit tests a message is split into fragments of the payload
+// size with the last one marked as the end.
+func TestFragmenterSplit(t *testing.T) {
+	msg := make([]byte, 25)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	var frags []*Fragment
+	f := NewFragmenter(10, SequentialIDs(7))
+	transID, err := f.Split(bytes.NewReader(msg), func(frag *Fragment) error {
+		copied := *frag
+		copied.Data = append([]byte(nil), frag.Data...)
+		frags = append(frags, &copied)
+		return nil
+	})
+	if err != nil || transID != 7 {
+		t.Fatalf("unexpected result %d %v", transID, err)
+	}
+	if len(frags) != 3 {
+		t.Fatalf("expected 3 fragments, got %d", len(frags))
+	}
+	for i, frag := range frags {
+		if frag.TransID != 7 || frag.Offset != uint32(i*10) || frag.IsEnd != (i == 2) {
+			t.Errorf("unexpected header %+v", frag.FragmentHdr)
+		}
+		if !bytes.Equal(frag.Data, msg[i*10:i*10+int(frag.DataLen)]) {
+			t.Errorf("unexpected data in fragment %d", i)
+		}
+	}
+	if frags[2].DataLen != 5 {
+		t.Errorf("expected the last fragment to have 5 bytes, got %d", frags[2].DataLen)
+	}
+	if id, _ := f.Split(bytes.NewReader(msg), func(*Fragment) error { return nil }); id != 8 {
+		t.Errorf("expected the next message to be 8, got %d", id)
+	}
+}
+
+// TestFragmenterExact tests a message that is a multiple of the payload size
+// doesn't get an empty end fragment.
+func TestFragmenterExact(t *testing.T) {
+	var frags []FragmentHdr
+	NewFragmenter(10, nil).Split(bytes.NewReader(make([]byte, 20)), func(frag *Fragment) error {
+		frags = append(frags, frag.FragmentHdr)
+		return nil
+	})
+	if len(frags) != 2 || !frags[1].IsEnd || frags[1].DataLen != 10 {
+		t.Errorf("unexpected fragments %+v", frags)
+	}
+}
+
+// TestFragmenterEmpty tests an empty message is a single empty end fragment
+// the handler reassembles.
+func TestFragmenterEmpty(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	done := false
+	h.rebuiltMsgCB = func(uint32, string) { done = true }
+	NewFragmenter(10, nil).Split(bytes.NewReader(nil), func(frag *Fragment) error {
+		if !frag.IsEnd || frag.DataLen != 0 {
+			t.Errorf("unexpected fragment %+v", frag.FragmentHdr)
+		}
+		b, _ := frag.MarshalBinary()
+		parsed, _ := ParseFragment(b)
+		h.AddFragment(parsed)
+		return nil
+	})
+	if !done {
+		t.Error("expected the empty message to be reassembled")
+	}
+}
+
+// TestFragmenterReassemble tests the fragments, once encoded, are
+// reassembled into the same message in any order.
+func TestFragmenterReassemble(t *testing.T) {
+	msg := make([]byte, 5000)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	sum := sha256.Sum256(msg)
+	var datagrams [][]byte
+	NewFragmenter(1000, nil).Split(bytes.NewReader(msg), func(frag *Fragment) error {
+		b, err := frag.MarshalBinary()
+		datagrams = append(datagrams, b)
+		return err
+	})
+	var got string
+	h := NewMsgHandler(60000, nil, func(transID uint32, sha string) { got = sha })
+	h.SetOutput(&bytes.Buffer{})
+	for i := len(datagrams) - 1; i >= 0; i-- {
+		frag, err := CreateFragment(bytes.NewReader(datagrams[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.AddFragment(frag)
+	}
+	if got != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the hash of the message, got %q", got)
+	}
+}
+
+// TestFragmenterCallbackError tests Split stops at the callback's error.
+func TestFragmenterCallbackError(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	_, err := NewFragmenter(10, nil).Split(bytes.NewReader(make([]byte, 100)), func(*Fragment) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("expected to stop after one fragment, got %d calls and %v", calls, err)
+	}
+}
@@ -1 +1,3 @@
 module github.com/jonathan-buttner/msg-assembler
+
+go 1.27.1
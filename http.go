@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHTTPHandler routes the HTTP endpoints: the metrics for Prometheus at
+// /metrics and the admin API for h's messages and s's errors under /admin/.
+// traces can be nil if tracing is off.
+func newHTTPHandler(reg *Registry, h *MsgHandler, s *Server, traces *TraceRecorder) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg)
+	(&adminAPI{handler: h, server: s, traces: traces}).register(mux)
+	return mux
+}
+
+// Timeouts for the HTTP server so slow or idle clients can't hold
+// connections open forever. The requests are all small and the responses
+// are written from memory.
+const (
+	httpReadHeaderTimeout = 5 * time.Second
+	httpReadTimeout       = 10 * time.Second
+	httpWriteTimeout      = 30 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// startHTTP serves handler on addr in the background. Errors serving after
+// the listener is open are logged.
+func startHTTP(addr string, handler http.Handler, logger *slog.Logger) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	hs := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	go func() {
+		if err := hs.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("serving HTTP", "err", err)
+		}
+	}()
+	logger.Info("serving HTTP", "address", l.Addr().String())
+	return hs, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Impairment describes how an unreliable network treats datagrams. The
+// probabilities are between 0 and 1 and apply to each datagram on its own.
+type Impairment struct {
+	// Loss drops the datagram.
+	Loss float64 `json:"loss"`
+	// Duplicate delivers the datagram twice.
+	Duplicate float64 `json:"duplicate"`
+	// Reorder holds the datagram back and delivers it after the next one.
+	Reorder float64 `json:"reorder"`
+	// Corrupt flips one bit of the datagram.
+	Corrupt float64 `json:"corrupt"`
+	// Delay is added to every datagram, give or take up to Jitter.
+	Delay  time.Duration `json:"delay"`
+	Jitter time.Duration `json:"jitter"`
+}
+
+// impairmentProfiles are the named impairments ParseImpairment accepts.
+var impairmentProfiles = map[string]Impairment{
+	"none":    {},
+	"lossy":   {Loss: 0.05},
+	"reorder": {Reorder: 0.2},
+	"wan": {Loss: 0.01, Duplicate: 0.01, Reorder: 0.05,
+		Delay: 30 * time.Millisecond, Jitter: 10 * time.Millisecond},
+	"hostile": {Loss: 0.1, Duplicate: 0.05, Reorder: 0.2, Corrupt: 0.01,
+		Delay: 50 * time.Millisecond, Jitter: 25 * time.Millisecond},
+}
+
+// ParseImpairment reads an impairment written as a profile name, a comma
+// separated list of settings, or a profile followed by settings overriding
+// it, like "wan,loss=0.1". The settings are loss, dup, reorder and corrupt
+// probabilities and delay and jitter durations. The profiles are none, lossy,
+// reorder, wan and hostile.
+func ParseImpairment(s string) (Impairment, error) {
+	var imp Impairment
+	for i, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			p, found := impairmentProfiles[part]
+			if !found || i > 0 {
+				return imp, fmt.Errorf("unknown impairment profile %q, want one of %s first", part, profileNames())
+			}
+			imp = p
+			continue
+		}
+		var err error
+		switch key {
+		case "loss":
+			imp.Loss, err = parseProbability(value)
+		case "dup":
+			imp.Duplicate, err = parseProbability(value)
+		case "reorder":
+			imp.Reorder, err = parseProbability(value)
+		case "corrupt":
+			imp.Corrupt, err = parseProbability(value)
+		case "delay":
+			imp.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			imp.Jitter, err = time.ParseDuration(value)
+		default:
+			return imp, fmt.Errorf("unknown impairment setting %q", key)
+		}
+		if err != nil {
+			return imp, fmt.Errorf("impairment setting %s: %v", key, err)
+		}
+	}
+	if imp.Delay < 0 || imp.Jitter < 0 {
+		return imp, fmt.Errorf("delay and jitter can't be negative")
+	}
+	return imp, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("%q isn't a probability between 0 and 1", s)
+	}
+	return p, nil
+}
+
+func profileNames() string {
+	names := make([]string, 0, len(impairmentProfiles))
+	for name := range impairmentProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// packet is a datagram and who sent it.
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// ImpairmentStats counts what an impairment did to the datagrams.
+type ImpairmentStats struct {
+	Datagrams  uint64 `json:"datagrams"`
+	Lost       uint64 `json:"lost"`
+	Duplicated uint64 `json:"duplicated"`
+	Reordered  uint64 `json:"reordered"`
+	Corrupted  uint64 `json:"corrupted"`
+}
+
+// impairer applies an impairment. The same seed and datagrams always give
+// the same result.
+type impairer struct {
+	imp  Impairment
+	lock sync.Mutex
+	rng  *rand.Rand
+	// held are the copies of a datagram being reordered
+	held  []packet
+	stats struct {
+		datagrams, lost, duplicated, reordered, corrupted atomic.Uint64
+	}
+}
+
+func newImpairer(imp Impairment, seed int64) *impairer {
+	return &impairer{imp: imp, rng: rand.New(rand.NewSource(seed))}
+}
+
+// impair decides what happens to a datagram and returns what should be
+// delivered now, in order. p.data is not modified, corrupted datagrams are
+// copies.
+func (im *impairer) impair(p packet) []packet {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+	im.stats.datagrams.Add(1)
+	if im.rng.Float64() < im.imp.Loss {
+		im.stats.lost.Add(1)
+		return nil
+	}
+	if im.rng.Float64() < im.imp.Corrupt && len(p.data) > 0 {
+		data := append([]byte(nil), p.data...)
+		data[im.rng.Intn(len(data))] ^= 1 << uint(im.rng.Intn(8))
+		p.data = data
+		im.stats.corrupted.Add(1)
+	}
+	out := []packet{p}
+	if im.rng.Float64() < im.imp.Duplicate {
+		out = append(out, p)
+		im.stats.duplicated.Add(1)
+	}
+	if im.held == nil && im.rng.Float64() < im.imp.Reorder {
+		im.held = out
+		im.stats.reordered.Add(1)
+		return nil
+	}
+	out = append(out, im.held...)
+	im.held = nil
+	return out
+}
+
+// release returns the datagrams held back for reordering when no datagram
+// came after them.
+func (im *impairer) release() []packet {
+	im.lock.Lock()
+	defer im.lock.Unlock()
+	held := im.held
+	im.held = nil
+	return held
+}
+
+// delay returns how long to hold a datagram back.
+func (im *impairer) delay() time.Duration {
+	if im.imp.Delay == 0 && im.imp.Jitter == 0 {
+		return 0
+	}
+	im.lock.Lock()
+	defer im.lock.Unlock()
+	d := im.imp.Delay
+	if im.imp.Jitter > 0 {
+		d += time.Duration(im.rng.Int63n(int64(2*im.imp.Jitter)+1)) - im.imp.Jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (im *impairer) snapshot() ImpairmentStats {
+	return ImpairmentStats{
+		Datagrams:  im.stats.datagrams.Load(),
+		Lost:       im.stats.lost.Load(),
+		Duplicated: im.stats.duplicated.Load(),
+		Reordered:  im.stats.reordered.Load(),
+		Corrupted:  im.stats.corrupted.Load(),
+	}
+}
+
+// ImpairedConn is a Conn that loses, duplicates, reorders, corrupts and
+// delays the datagrams read from another Conn, for testing the server
+// in-process. A datagram held back for reordering is returned once the next
+// one arrives or a read of the underlying Conn fails, like on a deadline.
+// The delay is applied to each read so it slows the reader down but doesn't
+// reorder datagrams.
+type ImpairedConn struct {
+	Conn
+	im    *impairer
+	lock  sync.Mutex
+	ready []packet
+}
+
+// NewImpairedConn wraps c with the impairment. seed makes the impairment
+// repeatable.
+func NewImpairedConn(c Conn, imp Impairment, seed int64) *ImpairedConn {
+	return &ImpairedConn{Conn: c, im: newImpairer(imp, seed)}
+}
+
+// Stats returns what the impairment did so far.
+func (c *ImpairedConn) Stats() ImpairmentStats {
+	return c.im.snapshot()
+}
+
+// next returns the next datagram ready to be read.
+func (c *ImpairedConn) next() (packet, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.ready) == 0 {
+		return packet{}, false
+	}
+	p := c.ready[0]
+	c.ready = c.ready[1:]
+	return p, true
+}
+
+func (c *ImpairedConn) push(ps []packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ready = append(c.ready, ps...)
+}
+
+// ReadFrom reads the next datagram to get through the impairment.
+func (c *ImpairedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b))
+	for {
+		if p, ok := c.next(); ok {
+			if d := c.im.delay(); d > 0 {
+				time.Sleep(d)
+			}
+			return copy(b, p.data), p.addr, nil
+		}
+		n, addr, err := c.Conn.ReadFrom(buf)
+		if err != nil {
+			if held := c.im.release(); held != nil {
+				c.push(held)
+				continue
+			}
+			return n, addr, err
+		}
+		c.push(c.im.impair(packet{data: append([]byte(nil), buf[:n]...), addr: addr}))
+	}
+}
+
+// Read reads the next datagram like ReadFrom.
+func (c *ImpairedConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// ImpairedNet is a NetWrapper whose UDP sockets are impaired. Each socket
+// gets its own seed, counting up from Seed.
+type ImpairedNet struct {
+	NetWrapper
+	Impairment Impairment
+	Seed       int64
+	conns      atomic.Int64
+}
+
+func (n *ImpairedNet) wrap(c Conn, err error) (Conn, error) {
+	if err != nil {
+		return nil, err
+	}
+	return NewImpairedConn(c, n.Impairment, n.Seed+n.conns.Add(1)-1), nil
+}
+
+// ListenUDP opens an impaired socket.
+func (n *ImpairedNet) ListenUDP(network string, address *net.UDPAddr) (Conn, error) {
+	return n.wrap(n.NetWrapper.ListenUDP(network, address))
+}
+
+// ListenUDPReusePort opens an impaired socket with SO_REUSEPORT.
+func (n *ImpairedNet) ListenUDPReusePort(network string, address *net.UDPAddr) (Conn, error) {
+	return n.wrap(n.NetWrapper.ListenUDPReusePort(network, address))
+}
+
+// ListenMulticastUDP opens an impaired multicast socket.
+func (n *ImpairedNet) ListenMulticastUDP(network string, ifi *net.Interface, groups []net.IP, port int) (Conn, error) {
+	return n.wrap(n.NetWrapper.ListenMulticastUDP(network, ifi, groups, port))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestParseImpairment tests reading profiles and settings.
+func TestParseImpairment(t *testing.T) {
+	imp, err := ParseImpairment("wan,loss=0.2,delay=5ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wan := impairmentProfiles["wan"]
+	if imp.Loss != 0.2 || imp.Delay != 5*time.Millisecond || imp.Reorder != wan.Reorder || imp.Jitter != wan.Jitter {
+		t.Errorf("unexpected impairment %+v", imp)
+	}
+	for _, s := range []string{"loss=2", "dup=x", "wobble=1", "mars", "loss=0.1,wan", "delay=-1s"} {
+		if _, err := ParseImpairment(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func impairAll(im *impairer, n int) [][]byte {
+	var out [][]byte
+	for i := 0; i < n; i++ {
+		for _, p := range im.impair(packet{data: []byte{byte(i), 0, 0, 0}}) {
+			out = append(out, p.data)
+		}
+	}
+	for _, p := range im.release() {
+		out = append(out, p.data)
+	}
+	return out
+}
+
+// TestImpairerSeed tests the same seed impairs datagrams the same way.
+func TestImpairerSeed(t *testing.T) {
+	imp := impairmentProfiles["hostile"]
+	a := impairAll(newImpairer(imp, 3), 200)
+	b := impairAll(newImpairer(imp, 3), 200)
+	if !reflect.DeepEqual(a, b) {
+		t.Error("expected the same seed to give the same datagrams")
+	}
+	if reflect.DeepEqual(a, impairAll(newImpairer(imp, 4), 200)) {
+		t.Error("expected another seed to give other datagrams")
+	}
+}
+
+// TestImpairerEach tests each impairment on its own.
+func TestImpairerEach(t *testing.T) {
+	if out := impairAll(newImpairer(Impairment{Loss: 1}, 1), 5); len(out) != 0 {
+		t.Errorf("expected every datagram lost, got %d", len(out))
+	}
+	if out := impairAll(newImpairer(Impairment{Duplicate: 1}, 1), 2); len(out) != 4 || out[0][0] != 0 || out[1][0] != 0 {
+		t.Errorf("expected every datagram twice, got %v", out)
+	}
+	out := impairAll(newImpairer(Impairment{Reorder: 1}, 1), 4)
+	if expected := []byte{1, 0, 3, 2}; len(out) != 4 || !bytes.Equal([]byte{out[0][0], out[1][0], out[2][0], out[3][0]}, expected) {
+		t.Errorf("expected pairs to swap, got %v", out)
+	}
+	im := newImpairer(Impairment{Corrupt: 1}, 1)
+	orig := []byte{0, 0, 0, 0}
+	p := im.impair(packet{data: orig})
+	flipped := 0
+	for _, b := range p[0].data {
+		for ; b != 0; b &= b - 1 {
+			flipped++
+		}
+	}
+	if flipped != 1 || !bytes.Equal(orig, []byte{0, 0, 0, 0}) {
+		t.Errorf("expected one bit flipped in a copy, got %v", p[0].data)
+	}
+	if st := im.snapshot(); st.Datagrams != 1 || st.Corrupted != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+// queueConn returns datagrams from a list, then a timeout error.
+type queueConn struct {
+	FakeConn
+	datagrams [][]byte
+}
+
+func (c *queueConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(c.datagrams) == 0 {
+		return 0, nil, &FakeError{}
+	}
+	n := copy(p, c.datagrams[0])
+	c.datagrams = c.datagrams[1:]
+	return n, createUDPAddr(), nil
+}
+
+// queueNet hands out a queueConn.
+type queueNet struct {
+	FakeNet
+	conn *queueConn
+}
+
+func (n *queueNet) ListenUDP(network string, address *net.UDPAddr) (Conn, error) {
+	return n.conn, nil
+}
+
+// TestImpairedConn tests a held back datagram is returned after the next
+// one, or when the read fails.
+func TestImpairedConn(t *testing.T) {
+	c := NewImpairedConn(&queueConn{datagrams: [][]byte{{1}, {2}, {3}}}, Impairment{Reorder: 1}, 1)
+	b := make([]byte, 10)
+	var got []byte
+	for {
+		n, _, err := c.ReadFrom(b)
+		if err != nil {
+			var fe *FakeError
+			if !errors.As(err, &fe) {
+				t.Errorf("expected the underlying error, got %v", err)
+			}
+			break
+		}
+		got = append(got, b[:n]...)
+	}
+	if !bytes.Equal(got, []byte{2, 1, 3}) {
+		t.Errorf("expected 2 1 3, got %v", got)
+	}
+}
+
+// TestImpairedServer tests the server reassembles a message from a
+// reordered and duplicated stream of fragments.
+func TestImpairedServer(t *testing.T) {
+	var datagrams [][]byte
+	msg := make([]byte, 5000)
+	NewFragmenter(500, SequentialIDs(9)).Split(bytes.NewReader(msg), func(frag *Fragment) error {
+		b, _ := frag.MarshalBinary()
+		datagrams = append(datagrams, b)
+		return nil
+	})
+	done := make(chan string, 1)
+	h := NewMsgHandler(60000, nil, func(transID uint32, sha string) { done <- sha })
+	h.SetOutput(&bytes.Buffer{})
+	n := &ImpairedNet{
+		NetWrapper: &queueNet{conn: &queueConn{datagrams: datagrams}},
+		Impairment: Impairment{Reorder: 0.5, Duplicate: 0.3},
+		Seed:       1,
+	}
+	s := NewServer(1, n, h, createUDPAddr(), time.Millisecond)
+	s.Start(context.Background())
+	defer s.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message wasn't reassembled")
+	}
+}
+
+// TestProxy tests datagrams are forwarded through the proxy.
+func TestProxy(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	p, err := NewProxy("127.0.0.1:0", target.LocalAddr().String(),
+		Impairment{Duplicate: 1, Delay: time.Millisecond}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- p.Serve()
+	}()
+	sender, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("hello"))
+
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 100)
+	for i := 0; i < 2; i++ {
+		n, err := target.Read(b)
+		if err != nil || string(b[:n]) != "hello" {
+			t.Fatalf("expected hello, got %q %v", b[:n], err)
+		}
+	}
+	p.Close()
+	if err := <-served; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if st := p.Stats(); st.Datagrams != 1 || st.Duplicated != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+// TestProxyClose tests that Close waits for the delayed datagrams, however
+// many times it is called.
+func TestProxyClose(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	p, err := NewProxy("127.0.0.1:0", target.LocalAddr().String(),
+		Impairment{Delay: 100 * time.Millisecond}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- p.Serve()
+	}()
+	sender, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("hello"))
+	for deadline := time.Now().Add(2 * time.Second); p.Stats().Datagrams == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the datagram wasn't received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	go p.Close()
+	<-served
+	p.Close()
+	target.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	b := make([]byte, 100)
+	if n, err := target.Read(b); err != nil || string(b[:n]) != "hello" {
+		t.Errorf("expected the delayed datagram to be sent before Close returned, got %q %v", b[:n], err)
+	}
+}
+
+// TestProxySendErrors tests that datagrams the target refuses are counted.
+func TestProxySendErrors(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens on the target so the writes after the first are
+	// refused
+	target.Close()
+	p, err := NewProxy("127.0.0.1:0", target.LocalAddr().String(), Impairment{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve()
+	defer p.Close()
+	sender, err := net.Dial("udp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for deadline := time.Now().Add(2 * time.Second); p.SendErrors() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the refused datagrams to be counted")
+		}
+		sender.Write([]byte("hello"))
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSegmentSize is how large a journal segment grows before a new
+	// one is started.
+	defaultSegmentSize = 64 << 20
+	// journalRecHdrLen is the record kind, the payload length and the
+	// payload's CRC-32.
+	journalRecHdrLen = 9
+	// recFragment records an accepted fragment. Its payload is the arrival
+	// time in Unix nanoseconds followed by the fragment as it came off the
+	// wire.
+	recFragment = 1
+	// recDone records that a message was reassembled, expired or flushed.
+	// Its payload is the transaction ID.
+	recDone = 2
+	// journalQueueLen is how many records can wait for the writer before
+	// the handler waits for it.
+	journalQueueLen = 1024
+)
+
+// journalRec is a record waiting to be written, header included. seq numbers
+// the records in the order they were queued.
+type journalRec struct {
+	seq     uint64
+	kind    byte
+	transID uint32
+	b       []byte
+}
+
+// journalMsg is an in-flight message found while reading the journal.
+type journalMsg struct {
+	started time.Time
+	frags   []*Fragment
+}
+
+// Journal is an append-only write-ahead log of the fragments a MsgHandler
+// accepted so the messages in flight survive a crash. It is split into
+// numbered segment files in a directory. The oldest segments are deleted once
+// every message with fragments in them is done. Only the oldest are deleted
+// so the record that a message is done is never lost while its fragments
+// are still in the journal.
+//
+// Records are queued in order and written by a goroutine of its own, so the
+// handler doesn't wait on the disk with its messages locked. The records
+// waiting when the goroutine wakes are written, and synced, together.
+//
+// Each record is a one byte kind, a big endian uint32 payload length and the
+// payload's CRC-32 followed by the payload. A record that was only partly
+// written when the process died fails its length or CRC check, reading stops
+// there and the segment's remaining bytes are ignored.
+type Journal struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+	errCB       func(err error)
+	// file, size, seqs, segs and live belong to the writer goroutine once
+	// the journal is open
+	file *os.File
+	size int64
+	// seqs are the segments on disk, oldest first. The last one is being
+	// written.
+	seqs []uint64
+	// segs are the segments holding each in-flight message's fragments and
+	// live counts the in-flight messages with fragments in each segment
+	segs map[uint32]map[uint64]bool
+	live map[uint64]int
+	// qlock is held to number a record and queue it, so recs holds them
+	// in seq order. queued is the last seq handed out. The writer closes
+	// stopped once recs is closed and written.
+	qlock   sync.Mutex
+	queued  uint64
+	recs    chan journalRec
+	stopped chan struct{}
+	closed  bool
+	// lock guards pending, order and written, the seq of the last record
+	// written. written signals a change to written.
+	lock sync.Mutex
+	wake *sync.Cond
+	// pending are the in-flight messages read from the journal, in the
+	// order they started, until they are replayed
+	pending map[uint32]*journalMsg
+	order   []uint32
+	written uint64
+}
+
+// OpenJournal opens the journal in dir, creating the directory if needed,
+// and reads the in-flight messages from its existing segments. New records go
+// to a new segment. segmentSize is how large a segment grows before the next
+// one is started, 0 for the default. syncWrites makes the writer flush the records
+// to disk after writing them. errCB is called with any error writing the
+// journal, and with ErrChecksum for a corrupted record, it can be nil.
+func OpenJournal(dir string, segmentSize int64, syncWrites bool, errCB func(err error)) (*Journal, error) {
+	if segmentSize < 1 {
+		segmentSize = defaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		dir:         dir,
+		segmentSize: segmentSize,
+		sync:        syncWrites,
+		errCB:       errCB,
+		segs:        make(map[uint32]map[uint64]bool),
+		live:        make(map[uint64]int),
+		pending:     make(map[uint32]*journalMsg),
+		recs:        make(chan journalRec, journalQueueLen),
+		stopped:     make(chan struct{}),
+	}
+	j.wake = sync.NewCond(&j.lock)
+	seqs, err := j.segments()
+	if err != nil {
+		return nil, err
+	}
+	next := uint64(1)
+	for _, seq := range seqs {
+		if err = j.readSegment(seq); err != nil {
+			return nil, err
+		}
+		next = seq + 1
+	}
+	j.seqs = seqs
+	if err = j.openSegment(next); err != nil {
+		return nil, err
+	}
+	j.compact()
+	go j.writeRecords()
+	return j, nil
+}
+
+func (j *Journal) segmentPath(seq uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%016d.wal", seq))
+}
+
+// segments returns the sequence numbers of the segments in the directory in
+// the order they were written.
+func (j *Journal) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		var seq uint64
+		if !strings.HasSuffix(e.Name(), ".wal") {
+			continue
+		}
+		if _, err := fmt.Sscanf(e.Name(), "%016d.wal", &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(a, b int) bool { return seqs[a] < seqs[b] })
+	return seqs, nil
+}
+
+// readSegment reads the records of a segment into the pending messages.
+func (j *Journal) readSegment(seq uint64) error {
+	f, err := os.Open(j.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var off int64
+	for len(b) >= journalRecHdrLen {
+		kind := b[0]
+		n := binary.BigEndian.Uint32(b[1:])
+		if uint64(len(b)-journalRecHdrLen) < uint64(n) {
+			// torn write
+			return nil
+		}
+		payload := b[journalRecHdrLen : journalRecHdrLen+int(n)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(b[5:]) {
+			if j.errCB != nil {
+				j.errCB(fmt.Errorf("journal segment %d: record at byte %d: %w", seq, off, ErrChecksum))
+			}
+			return nil
+		}
+		b = b[journalRecHdrLen+int(n):]
+		off += journalRecHdrLen + int64(n)
+		switch {
+		case kind == recFragment && len(payload) >= 8:
+			frag, err := ParseFragment(payload[8:])
+			if err != nil {
+				return nil
+			}
+			// the payload is part of the whole segment, which mustn't be
+			// kept for as long as the message is in flight
+			data := make([]byte, len(frag.Data))
+			copy(data, frag.Data)
+			frag.Data = data
+			msg, ok := j.pending[frag.TransID]
+			if !ok {
+				started := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+				msg = &journalMsg{started: started}
+				j.pending[frag.TransID] = msg
+				j.order = append(j.order, frag.TransID)
+			}
+			msg.frags = append(msg.frags, frag)
+			j.track(frag.TransID, seq)
+		case kind == recDone && len(payload) == 4:
+			transID := binary.BigEndian.Uint32(payload)
+			delete(j.pending, transID)
+			j.untrack(transID)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// track notes that the message has fragments in the segment.
+func (j *Journal) track(transID uint32, seq uint64) {
+	segs, ok := j.segs[transID]
+	if !ok {
+		segs = make(map[uint64]bool)
+		j.segs[transID] = segs
+	}
+	if !segs[seq] {
+		segs[seq] = true
+		j.live[seq]++
+	}
+}
+
+// untrack forgets a message that is done.
+func (j *Journal) untrack(transID uint32) {
+	for seq := range j.segs[transID] {
+		if j.live[seq]--; j.live[seq] == 0 {
+			delete(j.live, seq)
+		}
+	}
+	delete(j.segs, transID)
+}
+
+// compact deletes the oldest segments until one holds a message in flight
+// or only the segment being written is left.
+func (j *Journal) compact() {
+	for len(j.seqs) > 1 && j.live[j.seqs[0]] == 0 {
+		os.Remove(j.segmentPath(j.seqs[0]))
+		j.seqs = j.seqs[1:]
+	}
+}
+
+// current is the segment being written.
+func (j *Journal) current() uint64 {
+	return j.seqs[len(j.seqs)-1]
+}
+
+// openSegment starts writing to a new segment.
+func (j *Journal) openSegment(seq uint64) error {
+	f, err := os.OpenFile(j.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	j.file, j.size = f, 0
+	j.seqs = append(j.seqs, seq)
+	return nil
+}
+
+// rotate closes the current segment and starts the next one.
+func (j *Journal) rotate() error {
+	if j.sync {
+		if err := j.file.Sync(); err != nil {
+			return err
+		}
+	}
+	j.file.Close()
+	if err := j.openSegment(j.current() + 1); err != nil {
+		return err
+	}
+	j.compact()
+	return nil
+}
+
+// write appends a record, filling in its header.
+func (j *Journal) write(rec []byte) error {
+	if j.size >= j.segmentSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	payload := rec[journalRecHdrLen:]
+	binary.BigEndian.PutUint32(rec[1:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[5:], crc32.ChecksumIEEE(payload))
+	n, err := j.file.Write(rec)
+	j.size += int64(n)
+	return err
+}
+
+// writeRecords writes the queued records until the queue is closed.
+func (j *Journal) writeRecords() {
+	defer close(j.stopped)
+	batch := make([]journalRec, 0, 64)
+	for rec := range j.recs {
+		batch = append(batch[:0], rec)
+	more:
+		for len(batch) < cap(batch) {
+			select {
+			case rec, ok := <-j.recs:
+				if !ok {
+					break more
+				}
+				batch = append(batch, rec)
+			default:
+				break more
+			}
+		}
+		j.writeBatch(batch)
+	}
+}
+
+// writeBatch writes records in order and syncs them once. A message done is
+// only forgotten after its record is synced, so its segments aren't deleted
+// while the record could still be lost.
+func (j *Journal) writeBatch(batch []journalRec) {
+	for _, rec := range batch {
+		err := j.write(rec.b)
+		if err == nil && rec.kind == recFragment {
+			j.track(rec.transID, j.current())
+		}
+		j.report(err)
+	}
+	if j.sync {
+		j.report(j.file.Sync())
+	}
+	done := false
+	for _, rec := range batch {
+		if rec.kind == recDone {
+			j.untrack(rec.transID)
+			done = true
+		}
+	}
+	if done {
+		j.compact()
+	}
+	j.lock.Lock()
+	j.written = batch[len(batch)-1].seq
+	j.wake.Broadcast()
+	j.lock.Unlock()
+}
+
+// report hands a write error to the error callback.
+func (j *Journal) report(err error) {
+	if err != nil && j.errCB != nil {
+		j.errCB(fmt.Errorf("journal: %v", err))
+	}
+}
+
+// queue hands a record, with room for its header, to the writer.
+func (j *Journal) queue(kind byte, transID uint32, rec []byte) {
+	j.qlock.Lock()
+	defer j.qlock.Unlock()
+	if j.closed {
+		j.report(errors.New("journal closed"))
+		return
+	}
+	rec[0] = kind
+	j.queued++
+	j.recs <- journalRec{seq: j.queued, kind: kind, transID: transID, b: rec}
+}
+
+// flush waits for the records queued so far to be written.
+func (j *Journal) flush() {
+	j.qlock.Lock()
+	seq := j.queued
+	j.qlock.Unlock()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	for j.written < seq {
+		j.wake.Wait()
+	}
+}
+
+// fragment records an accepted fragment that arrived at now. The data is
+// copied into the record so the fragment's buffer can be reused.
+func (j *Journal) fragment(frag *Fragment, now time.Time) {
+	rec := make([]byte, journalRecHdrLen+8+FragHdrLen, journalRecHdrLen+8+FragHdrLen+len(frag.Data))
+	binary.BigEndian.PutUint64(rec[journalRecHdrLen:], uint64(now.UnixNano()))
+	encodeFragHeader(rec[journalRecHdrLen+8:], &frag.FragmentHdr)
+	j.queue(recFragment, frag.TransID, append(rec, frag.Data...))
+}
+
+// done records that a message is no longer in flight so the segments that
+// were only kept for it can be deleted.
+func (j *Journal) done(transID uint32) {
+	rec := make([]byte, journalRecHdrLen+4)
+	binary.BigEndian.PutUint32(rec[journalRecHdrLen:], transID)
+	j.queue(recDone, transID, rec)
+}
+
+// Replay adds the in-flight messages read when the journal was opened to h.
+// Each message keeps the deadline it had before, measured from when its first
+// fragment arrived, so messages whose time ran out while the process was down
+// expire right away. A message none of whose fragments are accepted, because
+// h's limits reject them, is marked done so its segments can be deleted. It
+// returns the number of messages and fragments replayed. h must already be
+// using the journal.
+func (j *Journal) Replay(h *MsgHandler) (msgs, frags int) {
+	j.lock.Lock()
+	pending, order := j.pending, j.order
+	j.pending, j.order = make(map[uint32]*journalMsg), nil
+	j.lock.Unlock()
+	for _, transID := range order {
+		msg, ok := pending[transID]
+		if !ok {
+			// done before the journal was closed, or already replayed
+			continue
+		}
+		delete(pending, transID)
+		msgs++
+		accepted := false
+		for _, frag := range msg.frags {
+			if h.replayFragment(frag, msg.started) == Success {
+				accepted = true
+			}
+			frags++
+		}
+		if !accepted {
+			j.done(transID)
+		}
+	}
+	return msgs, frags
+}
+
+// Close writes the records still queued and closes the current segment.
+// Records can't be written afterwards.
+func (j *Journal) Close() error {
+	j.qlock.Lock()
+	if j.closed {
+		j.qlock.Unlock()
+		return nil
+	}
+	j.closed = true
+	close(j.recs)
+	j.qlock.Unlock()
+	<-j.stopped
+	return j.file.Close()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func journalDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "msg-assembler-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func openTestJournal(t *testing.T, dir string, segmentSize int64) *Journal {
+	j, err := OpenJournal(dir, segmentSize, false, func(err error) {
+		t.Errorf("unexpected journal error: %v", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// TestJournalReplay tests that the messages in flight when the journal was
+// closed are rebuilt on replay and that finished messages aren't.
+func TestJournalReplay(t *testing.T) {
+	dir := journalDir(t)
+	j := openTestJournal(t, dir, 0)
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(ioutil.Discard)
+	h.SetJournal(j)
+	h.AddFragment(createValidFrag(false, 3, 0, make([]byte, 10)))
+	h.Flush(FlushDiscard)
+	h.AddFragment(createValidFrag(false, 1, 0, []byte("0123456789")))
+	h.AddFragment(createValidFrag(false, 1, 0, []byte("0123456789")))
+	h.AddFragment(createValidFrag(true, 2, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 4, 0, make([]byte, 5)))
+	j.Close()
+
+	var sha string
+	h = NewMsgHandler(60000, nil, func(transID uint32, sha256 string) {
+		sha = sha256
+	})
+	h.SetOutput(ioutil.Discard)
+	j = openTestJournal(t, dir, 0)
+	defer j.Close()
+	h.SetJournal(j)
+	// the fragments read back don't keep the rest of the segment
+	for _, frag := range j.pending[1].frags {
+		if cap(frag.Data) != len(frag.Data) {
+			t.Errorf("expected the fragment's own data, got %d bytes of room", cap(frag.Data))
+		}
+	}
+	msgs, frags := j.Replay(h)
+	if msgs != 2 || frags != 2 {
+		t.Errorf("expected 2 messages and 2 fragments, got %d and %d", msgs, frags)
+	}
+	if inFlightMsg(h, 1) == nil {
+		t.Fatal("expected message 1 to be replayed")
+	}
+	if inFlightMsg(h, 4) == nil {
+		t.Error("expected message 4 to be replayed")
+	}
+	h.AddFragment(createValidFrag(true, 1, 10, []byte("abcdef")))
+	sum := sha256.Sum256([]byte("0123456789abcdef"))
+	if sha != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected sha256 %s", sha)
+	}
+}
+
+// TestJournalTruncated tests that a journal cut short by a crash replays
+// every record written in full before the cut.
+func TestJournalTruncated(t *testing.T) {
+	dir := journalDir(t)
+	j := openTestJournal(t, dir, 0)
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetJournal(j)
+	var ends []int64
+	for i := uint32(0); i < 4; i++ {
+		h.AddFragment(createValidFrag(false, 1, i*10, make([]byte, 10)))
+		j.flush()
+		ends = append(ends, j.size)
+	}
+	j.Close()
+	path := segmentFiles(t, dir)[0]
+	full, _ := ioutil.ReadFile(path)
+
+	for cut := int64(0); cut <= int64(len(full)); cut++ {
+		ioutil.WriteFile(path, full[:cut], 0644)
+		// a new journal writes to a new segment so only keep the one
+		// being tested
+		for _, f := range segmentFiles(t, dir) {
+			if f != path {
+				os.Remove(f)
+			}
+		}
+		expected := 0
+		for _, end := range ends {
+			if end <= cut {
+				expected++
+			}
+		}
+		j = openTestJournal(t, dir, 0)
+		h = NewMsgHandler(60000, nil, nil)
+		if _, frags := j.Replay(h); frags != expected {
+			t.Errorf("expected %d fragments with %d bytes, got %d", expected, cut, frags)
+		}
+		j.Close()
+		h.Flush(FlushDiscard)
+	}
+}
+
+// TestJournalExpiry tests that a replayed message keeps its deadline and
+// expires right away if its time ran out while the journal was closed.
+func TestJournalExpiry(t *testing.T) {
+	dir := journalDir(t)
+	j := openTestJournal(t, dir, 0)
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetJournal(j)
+	h.AddFragment(createValidFrag(false, 5, 10, make([]byte, 10)))
+	j.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	holes := make(chan uint32, 1)
+	h = NewMsgHandler(10, func(transID, off uint32) {
+		holes <- transID
+	}, nil)
+	j = openTestJournal(t, dir, 0)
+	defer j.Close()
+	h.SetJournal(j)
+	j.Replay(h)
+	select {
+	case transID := <-holes:
+		if transID != 5 {
+			t.Errorf("expected message 5 to expire, got %d", transID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the replayed message to expire")
+	}
+}
+
+// TestJournalCompaction tests that segments are deleted once their messages
+// are done, but not while an older message is still in flight.
+func TestJournalCompaction(t *testing.T) {
+	dir := journalDir(t)
+	// every record starts a new segment
+	j := openTestJournal(t, dir, 1)
+	defer j.Close()
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(ioutil.Discard)
+	h.SetJournal(j)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	for i := uint32(2); i < 5; i++ {
+		h.AddFragment(createValidFrag(true, i, 0, make([]byte, 10)))
+	}
+	// message 1 keeps its segment and every later one
+	j.flush()
+	if files := segmentFiles(t, dir); len(files) != 7 {
+		t.Errorf("expected 7 segments, got %d", len(files))
+	}
+	h.AddFragment(createValidFrag(true, 1, 10, make([]byte, 10)))
+	j.flush()
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected only the current segment, got %v", files)
+	}
+}
+
+// TestJournalReplayLimits tests that a message rejected by the limits on
+// replay doesn't keep its segments forever.
+func TestJournalReplayLimits(t *testing.T) {
+	dir := journalDir(t)
+	j := openTestJournal(t, dir, 1)
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetJournal(j)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 2, 0, make([]byte, 10)))
+	j.Close()
+
+	h = NewMsgHandler(60000, nil, nil)
+	h.SetOutput(ioutil.Discard)
+	h.SetLimits(1, 0)
+	j = openTestJournal(t, dir, 1)
+	defer j.Close()
+	h.SetJournal(j)
+	j.Replay(h)
+	if inFlightMsg(h, 2) != nil {
+		t.Fatal("expected message 2 to be rejected by the limits")
+	}
+	h.AddFragment(createValidFrag(true, 1, 10, make([]byte, 10)))
+	j.flush()
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected only the current segment, got %v", files)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// listenerStats counts the traffic received on one listen address. All the
+// sockets bound to the same address share one listenerStats.
+type listenerStats struct {
+	network string
+	addr    net.Addr
+	// datagrams counts UDP datagrams, or fragments read off streams
+	datagrams atomic.Uint64
+	bytes     atomic.Uint64
+	drops     atomic.Uint64
+	errors    atomic.Uint64
+	// filtered counts datagrams from senders that aren't allowed
+	filtered atomic.Uint64
+	// conns counts the stream connections accepted
+	conns atomic.Uint64
+}
+
+func newListenerStats(network string, addr net.Addr) *listenerStats {
+	return &listenerStats{network: network, addr: addr}
+}
+
+// received counts a datagram or stream fragment of n bytes.
+func (l *listenerStats) received(n int) {
+	l.datagrams.Add(1)
+	l.bytes.Add(uint64(n))
+}
+
+// ListenerStats is a snapshot of the counters for one listen address.
+type ListenerStats struct {
+	Network     string
+	Address     string
+	Datagrams   uint64
+	Bytes       uint64
+	Drops       uint64
+	Errors      uint64
+	Filtered    uint64
+	Connections uint64
+}
+
+func (l *listenerStats) snapshot() ListenerStats {
+	return ListenerStats{
+		Network:     l.network,
+		Address:     l.addr.String(),
+		Datagrams:   l.datagrams.Load(),
+		Bytes:       l.bytes.Load(),
+		Drops:       l.drops.Load(),
+		Errors:      l.errors.Load(),
+		Filtered:    l.filtered.Load(),
+		Connections: l.conns.Load(),
+	}
+}
+
+// udpSocket is one of the UDP sockets the server reads from. If sources
+// isn't empty only datagrams sent from those addresses are accepted.
+type udpSocket struct {
+	conn    Conn
+	stats   *listenerStats
+	sources []net.IP
+}
+
+// streamListener accepts stream connections for one of the stream
+// addresses.
+type streamListener struct {
+	l     net.Listener
+	stats *listenerStats
+}
+
+// instrumentListeners registers a counter family for each of the
+// listeners' counters, labelled with the listener's network and address.
+func (s *Server) instrumentListeners(r *Registry) {
+	for _, c := range []struct {
+		name, help string
+		value      func(l *listenerStats) uint64
+	}{
+		{"msg_assembler_datagrams_received_total", "Datagrams and stream frames received.",
+			func(l *listenerStats) uint64 { return l.datagrams.Load() }},
+		{"msg_assembler_received_bytes_total", "Bytes of the datagrams and stream frames received.",
+			func(l *listenerStats) uint64 { return l.bytes.Load() }},
+		{"msg_assembler_listener_drops_total", "Datagrams dropped because a worker's queue was full.",
+			func(l *listenerStats) uint64 { return l.drops.Load() }},
+		{"msg_assembler_listener_errors_total", "Read and parse errors.",
+			func(l *listenerStats) uint64 { return l.errors.Load() }},
+		{"msg_assembler_filtered_total", "Multicast datagrams from sources that aren't allowed.",
+			func(l *listenerStats) uint64 { return l.filtered.Load() }},
+		{"msg_assembler_connections_total", "Stream connections accepted.",
+			func(l *listenerStats) uint64 { return l.conns.Load() }},
+	} {
+		c := c
+		r.register(c.name, c.help, "counter", func() []sample {
+			samples := make([]sample, len(s.stats))
+			for i, l := range s.stats {
+				samples[i] = sample{
+					labels: labelPairs("network", l.network, "address", l.addr.String()),
+					value:  float64(c.value(l)),
+				}
+			}
+			return samples
+		})
+	}
+}
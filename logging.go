@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// sampleHandler passes on one in every `every` debug records and all the
+// records at higher levels. The debug level carries the per-fragment events
+// which would otherwise swamp the log on a busy server.
+type sampleHandler struct {
+	slog.Handler
+	every uint64
+	n     *atomic.Uint64
+}
+
+func (h *sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level <= slog.LevelDebug && h.n.Add(1)%h.every != 1 {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampleHandler{Handler: h.Handler.WithAttrs(attrs), every: h.every, n: h.n}
+}
+
+func (h *sampleHandler) WithGroup(name string) slog.Handler {
+	return &sampleHandler{Handler: h.Handler.WithGroup(name), every: h.every, n: h.n}
+}
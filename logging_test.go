@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that can be written by the workers while the
+// test reads it.
+type syncBuffer struct {
+	lock sync.Mutex
+	b    bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.b.String()
+}
+
+// TestSetLogger tests that messages are reported as JSON records with the
+// expected fields.
+func TestSetLogger(t *testing.T) {
+	b := &bytes.Buffer{}
+	h := NewMsgHandler(5000, nil, nil)
+	h.SetLogger(slog.New(slog.NewJSONHandler(b, nil)))
+	h.AddFragment(createValidFrag(true, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 2, 10, make([]byte, 10)))
+	h.Expire(2)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", b.String())
+	}
+	var rec map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &rec)
+	if rec["msg"] != "message reassembled" || rec["trans_id"] != 1.0 || rec["length"] != 10.0 ||
+		len(rec["sha256"].(string)) != 64 {
+		t.Errorf("unexpected reassembled record %v", rec)
+	}
+	rec = nil
+	json.Unmarshal([]byte(lines[1]), &rec)
+	if rec["msg"] != "message incomplete" || rec["level"] != "WARN" || rec["trans_id"] != 2.0 ||
+		rec["reason"] != "expired by admin" {
+		t.Errorf("unexpected incomplete record %v", rec)
+	}
+}
+
+// TestSampleDebug tests that only one in every n debug records is logged
+// while other levels are all logged.
+func TestSampleDebug(t *testing.T) {
+	b := &bytes.Buffer{}
+	logger := newLogger(LogConfig{Level: "debug", Format: "text", Sample: 10}, b, &slog.LevelVar{})
+	for i := 0; i < 100; i++ {
+		logger.Debug("fragment received")
+		if i%50 == 0 {
+			logger.Info("other")
+		}
+	}
+	if n := strings.Count(b.String(), "fragment received"); n != 10 {
+		t.Errorf("expected 10 sampled records, got %d", n)
+	}
+	if n := strings.Count(b.String(), "other"); n != 2 {
+		t.Errorf("expected every info record, got %d", n)
+	}
+}
+
+// TestServerFragmentLog tests that the workers log each fragment with its
+// source.
+func TestServerFragmentLog(t *testing.T) {
+	b := &syncBuffer{}
+	data, _ := ioutil.ReadAll(createFrag(true, 3, 0, make([]byte, 10), false))
+	h := NewMsgHandler(5000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	s := NewServer(1, &FakeNet{conn: createFakeConn(data)}, h, createUDPAddr(), time.Millisecond)
+	s.SetLogger(newLogger(LogConfig{Level: "debug", Format: "text"}, b, &slog.LevelVar{}))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go s.HandleErrors(func(e error) {})
+	for !strings.Contains(b.String(), "fragment received") {
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+	expected := `msg="fragment received" trans_id=3 source=0.0.0.0:0 offset=0 length=10 outcome=accepted`
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("expected %q in %q", expected, b.String())
+	}
+}
@@ -1,22 +1,227 @@
 package main
 
 import (
-	"fmt"
-	"net"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+const (
+	// exitLost is the exit status when incomplete messages were flushed or
+	// datagrams were dropped.
+	exitLost = 3
+	// exitForced is the exit status when a second signal cut the drain
+	// short.
+	exitForced = 130
+)
+
 func main() {
-	fmt.Println("Starting Server")
-	n := &NetImp{}
-	// 30*1000 the number of seconds to wait before checking if a message
-	// hasn't received all of its fragments
-	h := NewMsgHandler(30*1000, PrintHoles, nil)
-	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6789}
-	s := NewServer(4, n, h, addr, 5*time.Second)
-	s.Start()
-	// This will loop forever waiting for errors
-	s.HandleErrors(func(e error) {
-		fmt.Printf("Error: %v\n", e)
-	})
+	os.Exit(run(os.Args[1:]))
+}
+
+// run starts the server described by the command line, or runs the
+// subcommand it names, and returns the exit status.
+func run(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "send":
+			return runSend(args[1:], os.Stdout, os.Stderr)
+		case "proxy":
+			return runProxy(args[1:], os.Stdout, os.Stderr)
+		case "bench":
+			return runBench(args[1:], os.Stdout, os.Stderr)
+		}
+	}
+	cfg, printConfig, err := ParseArgs(args, os.Stderr)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		// the logger isn't configured yet
+		slog.New(slog.NewTextHandler(os.Stderr, nil)).Error("invalid arguments", "err", err)
+		return 2
+	}
+	if printConfig {
+		cfg.Print(os.Stdout)
+		return 0
+	}
+	level := &slog.LevelVar{}
+	logger := newLogger(cfg.Log, os.Stderr, level)
+	out, closeSinks, err := openSinks(cfg.Sinks)
+	if err != nil {
+		logger.Error("opening sinks", "err", err)
+		return 1
+	}
+	sinks := newSinkWriter(out, closeSinks)
+	defer sinks.Close()
+
+	// Validate in ParseArgs already made sure this succeeds
+	sc, _ := cfg.ServerConfig()
+	timeout := int(cfg.TimeoutDuration() / time.Millisecond)
+	h := NewMsgHandler(timeout, nil, nil)
+	// results are always reported whatever the log level
+	h.SetLogger(newLogger(LogConfig{Level: "info", Format: cfg.Log.Format}, sinks, &slog.LevelVar{}))
+	h.SetLimits(cfg.Limits.MaxMessages, cfg.Limits.MaxMessageSize)
+	h.SetSpill(cfg.Limits.SpillDir, cfg.Limits.SpillThreshold, cfg.Limits.MaxSpillFiles, logSpillErrors(logger))
+	var traces *TraceRecorder
+	if cfg.Trace.Enabled() {
+		var export io.Writer
+		if cfg.Trace.File != "" {
+			f, err := os.OpenFile(cfg.Trace.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				logger.Error("opening trace file", "err", err)
+				return 1
+			}
+			defer f.Close()
+			export = f
+		}
+		traces = NewTraceRecorder(cfg.Trace.Keep, export, func(err error) {
+			logger.Error("writing trace", "err", err)
+		})
+		// runs before the trace file is closed
+		defer traces.Close()
+		h.SetTracer(traces.Trace)
+	}
+	s := NewServerFromConfig(sc, &NetImp{BatchSize: cfg.BatchSize}, h)
+	s.SetLogger(logger)
+	if cfg.Journal.Dir != "" {
+		j, err := OpenJournal(cfg.Journal.Dir, cfg.Journal.SegmentSize, cfg.Journal.Sync,
+			reportJournalErrors(logger, s))
+		if err != nil {
+			logger.Error("opening journal", "err", err)
+			return 1
+		}
+		defer j.Close()
+		h.SetJournal(j)
+		msgs, frags := j.Replay(h)
+		logger.Info("replayed journal", "dir", cfg.Journal.Dir, "messages", msgs, "fragments", frags)
+	}
+	reg := NewRegistry()
+	h.Instrument(reg)
+	s.Instrument(reg)
+	logger.Info("Starting Server", "listen", cfg.Listen, "streams", cfg.Streams,
+		"workers", cfg.Workers, "timeout", cfg.Timeout)
+	if err = s.Start(context.Background()); err != nil {
+		logger.Error("starting server", "err", err)
+		return 1
+	}
+
+	if cfg.HTTPAddr != "" {
+		hs, err := startHTTP(cfg.HTTPAddr, newHTTPHandler(reg, h, s, traces), logger)
+		if err != nil {
+			logger.Error("serving HTTP", "err", err)
+			s.Stop()
+			return 1
+		}
+		defer hs.Close()
+	}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	a := &assembler{
+		args:    args,
+		cfg:     cfg,
+		server:  s,
+		handler: h,
+		sinks:   sinks,
+		level:   level,
+		logger:  logger,
+	}
+	return a.serve(sigs)
+}
+
+// logSpillErrors returns a callback logging the errors writing messages to
+// disk.
+func logSpillErrors(logger *slog.Logger) func(err error) {
+	return func(err error) {
+		logger.Error("writing message to disk", "err", err)
+	}
+}
+
+// reportJournalErrors returns a callback logging the errors reading and
+// writing the journal and counting them with the server's errors, so a
+// corrupted record shows up under the checksum class.
+func reportJournalErrors(logger *slog.Logger, s *Server) func(err error) {
+	return func(err error) {
+		logger.Error("journal error", "class", ErrorClass(err), "err", err)
+		s.CountError(err)
+	}
+}
+
+// serve reports the server's errors until a SIGINT or SIGTERM arrives or the
+// server fails, reloading the config on SIGHUP. It then shuts the server down,
+// letting the workers finish the queued fragments, flushes the incomplete
+// messages according to the shutdown policy and returns an exit status saying
+// whether anything was lost. A second signal gives up on draining and exits
+// right away.
+func (a *assembler) serve(sigs <-chan os.Signal) int {
+	s, logger := a.server, a.logger
+	errsDone := make(chan bool)
+	go func() {
+		s.HandleErrors(func(e error) {
+			logger.Error("server error", "class", ErrorClass(e), "err", e)
+		})
+		close(errsDone)
+	}()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Wait()
+	}()
+
+	status := -1
+	for status < 0 {
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				logger.Info("reloading config")
+				if err := a.reload(); err != nil {
+					logger.Error("config reload rejected", "err", err)
+				}
+				continue
+			}
+			status = 0
+			logger.Info("shutting down", "signal", sig.String(), "queued", s.QueueDepth())
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				for {
+					select {
+					case sig = <-sigs:
+						if sig == syscall.SIGHUP {
+							continue
+						}
+						logger.Warn("forced exit before the queued fragments were processed",
+							"signal", sig.String())
+						cancel()
+					case <-ctx.Done():
+					}
+					return
+				}
+			}()
+			err := s.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				return exitForced
+			}
+		case err := <-runErr:
+			logger.Error("server failed", "err", err)
+			status = 1
+		}
+	}
+	<-errsDone
+
+	sum := a.handler.Flush(a.cfg.FlushPolicy())
+	drops := s.Drops()
+	logger.Info("stopped", "incomplete_messages", sum.Messages,
+		"incomplete_fragments", sum.Fragments, "incomplete_bytes", sum.Bytes,
+		"dropped_datagrams", drops)
+	if status == 0 && (sum.Messages > 0 || drops > 0) {
+		status = exitLost
+	}
+	return status
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+}
+
+// TestServeDrain tests that a signal stops the server, the incomplete
+// messages are flushed and the exit status says something was lost.
+func TestServeDrain(t *testing.T) {
+	data, _ := ioutil.ReadAll(createFrag(false, 1, 0, make([]byte, 10), false))
+	h := NewMsgHandler(60000, nil, nil)
+	s := NewServer(2, &FakeNet{conn: createFakeConn(data)}, h, createUDPAddr(), time.Millisecond)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// wait for the fragment to be added before shutting down
+	for {
+		if h.inFlight.Load() > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sigs := make(chan os.Signal, 1)
+	sigs <- syscall.SIGTERM
+	a := &assembler{cfg: &Config{ShutdownPolicy: "discard"}, server: s, handler: h, logger: discardLogger()}
+	if status := a.serve(sigs); status != exitLost {
+		t.Errorf("expected exit status %d, got %d", exitLost, status)
+	}
+	if h.inFlight.Load() != 0 {
+		t.Error("incomplete messages should have been flushed")
+	}
+}
+
+// TestServeClean tests that shutting down with nothing in flight exits with
+// status 0.
+func TestServeClean(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	s := NewServerFromConfig(ServerConfig{}, &FakeNet{}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(chan os.Signal, 1)
+	sigs <- syscall.SIGINT
+	a := &assembler{cfg: DefaultConfig(), server: s, handler: h, logger: discardLogger()}
+	if status := a.serve(sigs); status != 0 {
+		t.Errorf("expected exit status 0, got %d", status)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MemClock is a fake clock for MemNet's read deadlines. It only moves when
+// Advance is called so tests decide exactly when reads time out.
+type MemClock struct {
+	lock sync.Mutex
+	now  time.Time
+	// advanced is closed and replaced every time the clock moves
+	advanced chan struct{}
+}
+
+// NewMemClock creates a clock reading start.
+func NewMemClock(start time.Time) *MemClock {
+	return &MemClock{now: start, advanced: make(chan struct{})}
+}
+
+// Now returns the clock's time.
+func (c *MemClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward, timing out the reads whose deadline it
+// reaches.
+func (c *MemClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	close(c.advanced)
+	c.advanced = make(chan struct{})
+}
+
+// next returns the clock's time and a channel closed when it next moves.
+func (c *MemClock) next() (time.Time, <-chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now, c.advanced
+}
+
+// ErrNoListener is returned by MemNet.Send when no socket is bound to the
+// destination.
+var ErrNoListener = errors.New("no socket bound to the address")
+
+// MemNet is an in-memory NetWrapper for testing the server without real
+// sockets. Datagrams are scripted with Send, or pushed straight onto a
+// socket with MemConn.Push, and read in the order they were queued. Read
+// deadlines follow Clock, or the real time when it is nil.
+type MemNet struct {
+	Clock *MemClock
+	lock  sync.Mutex
+	// bound are the sockets by the address they were bound to, a multicast
+	// socket is bound to every group it joined
+	bound map[string][]*MemConn
+	// reusePort records which addresses were bound with SO_REUSEPORT
+	reusePort map[string]bool
+	nextPort  int
+}
+
+// NewMemNet creates an in-memory network whose deadlines follow clock, nil
+// for the real time.
+func NewMemNet(clock *MemClock) *MemNet {
+	return &MemNet{Clock: clock, bound: make(map[string][]*MemConn),
+		reusePort: make(map[string]bool), nextPort: 30000}
+}
+
+// bind binds a new socket to each address, picking a port for those
+// without one.
+func (n *MemNet) bind(network string, addrs []*net.UDPAddr, reuse bool) (*MemConn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	c := &MemConn{net: n, network: network, wake: make(chan struct{}),
+		blockedChanged: make(chan struct{})}
+	for _, a := range addrs {
+		addr := *a
+		if addr.IP == nil {
+			addr.IP = net.IPv4zero
+		}
+		if addr.Port == 0 {
+			addr.Port = n.nextPort
+			n.nextPort++
+		}
+		key := addr.String()
+		if len(n.bound[key]) > 0 && !(reuse && n.reusePort[key]) {
+			n.unbind(c)
+			return nil, &net.OpError{Op: "listen", Net: network, Addr: &addr,
+				Err: errors.New("address already in use")}
+		}
+		n.bound[key] = append(n.bound[key], c)
+		n.reusePort[key] = reuse
+		c.addrs = append(c.addrs, &addr)
+	}
+	return c, nil
+}
+
+// unbind removes the socket from every address it is bound to. n.lock must
+// be held.
+func (n *MemNet) unbind(c *MemConn) {
+	for _, a := range c.addrs {
+		key := a.String()
+		conns := n.bound[key]
+		for i, other := range conns {
+			if other == c {
+				conns = append(conns[:i:i], conns[i+1:]...)
+				break
+			}
+		}
+		if len(conns) == 0 {
+			delete(n.bound, key)
+			delete(n.reusePort, key)
+		} else {
+			n.bound[key] = conns
+		}
+	}
+}
+
+// ListenUDP binds an in-memory socket to the address. A zero port is
+// replaced with a free one, see MemConn.LocalAddr.
+func (n *MemNet) ListenUDP(network string, address *net.UDPAddr) (Conn, error) {
+	return n.bind(network, []*net.UDPAddr{address}, false)
+}
+
+// ListenUDPReusePort binds an in-memory socket that can share the address
+// with the other sockets bound with ListenUDPReusePort. Each sender's
+// datagrams all go to the same one of them.
+func (n *MemNet) ListenUDPReusePort(network string, address *net.UDPAddr) (Conn, error) {
+	return n.bind(network, []*net.UDPAddr{address}, true)
+}
+
+// ListenMulticastUDP binds an in-memory socket to port on every group.
+// Datagrams sent to a group reach every socket that joined it.
+func (n *MemNet) ListenMulticastUDP(network string, ifi *net.Interface, groups []net.IP, port int) (Conn, error) {
+	if len(groups) == 0 {
+		return nil, errors.New("no multicast groups to join")
+	}
+	addrs := make([]*net.UDPAddr, len(groups))
+	for i, g := range groups {
+		addrs[i] = &net.UDPAddr{IP: g, Port: port}
+	}
+	return n.bind(network, addrs, true)
+}
+
+// Listen fails, MemNet only has datagram sockets.
+func (n *MemNet) Listen(network, address string) (net.Listener, error) {
+	return nil, fmt.Errorf("listen %s %s: streams aren't supported by MemNet", network, address)
+}
+
+// Send queues a datagram from src for the socket bound to dst, or to the
+// unspecified address on dst's port. Multicast datagrams are queued for every
+// socket in the group, other datagrams for one socket picked by src when
+// several share the address. data is copied.
+func (n *MemNet) Send(src net.Addr, dst *net.UDPAddr, data []byte) error {
+	n.lock.Lock()
+	conns := n.bound[dst.String()]
+	for _, ip := range []net.IP{net.IPv4zero, net.IPv6unspecified} {
+		if len(conns) == 0 {
+			conns = n.bound[(&net.UDPAddr{IP: ip, Port: dst.Port}).String()]
+		}
+	}
+	n.lock.Unlock()
+	if len(conns) == 0 {
+		return fmt.Errorf("send to %s: %w", dst, ErrNoListener)
+	}
+	if !dst.IP.IsMulticast() {
+		h := fnv.New32a()
+		h.Write([]byte(src.String()))
+		conns = conns[h.Sum32()%uint32(len(conns)):][:1]
+	}
+	for _, c := range conns {
+		c.Push(src, data)
+	}
+	return nil
+}
+
+// memPacket is a datagram, or a scripted error, queued on a MemConn.
+type memPacket struct {
+	data []byte
+	src  net.Addr
+	err  error
+}
+
+// MemConn is an in-memory socket from MemNet. Any number of goroutines can
+// read from it, each datagram goes to one of them.
+type MemConn struct {
+	net     *MemNet
+	network string
+	addrs   []*net.UDPAddr
+	lock    sync.Mutex
+	queue   []memPacket
+	// deadline is when reads time out, zero for never
+	deadline time.Time
+	closed   bool
+	// blocked is the number of reads waiting for a datagram,
+	// blockedChanged is closed and replaced when a read starts waiting
+	blocked        int
+	blockedChanged chan struct{}
+	// wake is closed and replaced when anything a waiting read depends on
+	// changes
+	wake     chan struct{}
+	timeouts uint64
+}
+
+// signal wakes the waiting reads. c.lock must be held.
+func (c *MemConn) signal() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+// Push queues a datagram from src for the next read, data is copied.
+func (c *MemConn) Push(src net.Addr, data []byte) {
+	c.push(memPacket{data: append([]byte(nil), data...), src: src})
+}
+
+// PushError makes a read return err once the datagrams queued before it
+// have been read.
+func (c *MemConn) PushError(err error) {
+	c.push(memPacket{err: err})
+}
+
+func (c *MemConn) push(p memPacket) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.queue = append(c.queue, p)
+	c.signal()
+}
+
+// Pending returns how many datagrams and errors are waiting to be read.
+func (c *MemConn) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.queue)
+}
+
+// Timeouts returns how many reads timed out.
+func (c *MemConn) Timeouts() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.timeouts
+}
+
+// WaitBlocked blocks until at least n reads are waiting for a datagram, so
+// a test knows the readers have drained the queue before moving the clock.
+func (c *MemConn) WaitBlocked(n int) {
+	c.lock.Lock()
+	for c.blocked < n {
+		changed := c.blockedChanged
+		c.lock.Unlock()
+		<-changed
+		c.lock.Lock()
+	}
+	c.lock.Unlock()
+}
+
+// timeout returns the deadline error, the same one a real socket returns.
+// c.lock must be held.
+func (c *MemConn) timeout() error {
+	c.timeouts++
+	return &net.OpError{Op: "read", Net: c.network, Addr: c.LocalAddr(), Err: os.ErrDeadlineExceeded}
+}
+
+// ReadFrom reads the next datagram, blocking until one is queued, the read
+// deadline passes or the socket is closed. Like a real socket a passed
+// deadline fails the read even when datagrams are waiting.
+func (c *MemConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		if c.closed {
+			return 0, nil, &net.OpError{Op: "read", Net: c.network, Addr: c.LocalAddr(), Err: net.ErrClosed}
+		}
+		var tick <-chan struct{}
+		if !c.deadline.IsZero() {
+			now := time.Now()
+			if c.net.Clock != nil {
+				now, tick = c.net.Clock.next()
+			}
+			if !now.Before(c.deadline) {
+				return 0, nil, c.timeout()
+			}
+		}
+		if len(c.queue) > 0 {
+			pkt := c.queue[0]
+			c.queue = c.queue[1:]
+			if pkt.err != nil {
+				return 0, nil, pkt.err
+			}
+			// like a real socket the rest of a datagram too long for p is
+			// discarded
+			return copy(p, pkt.data), pkt.src, nil
+		}
+		var timer *time.Timer
+		if !c.deadline.IsZero() && c.net.Clock == nil {
+			timer = time.NewTimer(time.Until(c.deadline))
+		}
+		wake := c.wake
+		c.blocked++
+		close(c.blockedChanged)
+		c.blockedChanged = make(chan struct{})
+		c.lock.Unlock()
+		if timer != nil {
+			select {
+			case <-wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+		} else {
+			select {
+			case <-wake:
+			case <-tick:
+			}
+		}
+		c.lock.Lock()
+		c.blocked--
+	}
+}
+
+// Read reads the next datagram like ReadFrom.
+func (c *MemConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+// SetReadDeadline sets when reads time out, including those already
+// waiting. A zero time means never.
+func (c *MemConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return &net.OpError{Op: "set", Net: c.network, Addr: c.LocalAddr(), Err: net.ErrClosed}
+	}
+	c.deadline = t
+	c.signal()
+	return nil
+}
+
+// Close unbinds the socket and fails the waiting and later reads with
+// net.ErrClosed. The datagrams still queued are discarded.
+func (c *MemConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return &net.OpError{Op: "close", Net: c.network, Addr: c.LocalAddr(), Err: net.ErrClosed}
+	}
+	c.closed = true
+	c.queue = nil
+	c.signal()
+	c.lock.Unlock()
+	c.net.lock.Lock()
+	c.net.unbind(c)
+	c.net.lock.Unlock()
+	return nil
+}
+
+// Closed reports whether the socket was closed.
+func (c *MemConn) Closed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// LocalAddr returns the address the socket was bound to, the first group
+// for a multicast socket.
+func (c *MemConn) LocalAddr() net.Addr {
+	return c.addrs[0]
+}
+
+type readResult struct {
+	data []byte
+	src  net.Addr
+	err  error
+}
+
+// readAsync reads one datagram from c in the background.
+func readAsync(c Conn) chan readResult {
+	res := make(chan readResult, 1)
+	go func() {
+		b := make([]byte, 100)
+		n, src, err := c.ReadFrom(b)
+		res <- readResult{b[:n], src, err}
+	}()
+	return res
+}
+
+func memAddr(s string) *net.UDPAddr {
+	a, _ := net.ResolveUDPAddr("udp", s)
+	return a
+}
+
+// TestMemNetDeadline tests that reads wait for datagrams until the fake
+// clock reaches their deadline.
+func TestMemNetDeadline(t *testing.T) {
+	clock := NewMemClock(time.Unix(1000, 0))
+	n := NewMemNet(clock)
+	conn, err := n.ListenUDP("udp", memAddr("127.0.0.1:5000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.(*MemConn)
+	c.SetReadDeadline(clock.Now().Add(time.Second))
+
+	res := readAsync(c)
+	c.WaitBlocked(1)
+	clock.Advance(999 * time.Millisecond)
+	src := memAddr("10.0.0.1:4000")
+	if err = n.Send(src, memAddr("127.0.0.1:5000"), []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-res; r.err != nil || string(r.data) != "one" || r.src.String() != src.String() {
+		t.Errorf("expected the datagram before the deadline, got %q from %v, %v", r.data, r.src, r.err)
+	}
+
+	res = readAsync(c)
+	c.WaitBlocked(1)
+	clock.Advance(time.Millisecond)
+	r := <-res
+	if e, ok := r.err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("expected a timeout, got %v", r.err)
+	}
+	// a passed deadline fails reads even with datagrams waiting
+	c.Push(src, []byte("two"))
+	if _, _, err = c.ReadFrom(make([]byte, 10)); err == nil {
+		t.Error("expected a timeout with the deadline passed")
+	}
+	if c.Timeouts() != 2 {
+		t.Errorf("expected 2 timeouts, got %d", c.Timeouts())
+	}
+	c.SetReadDeadline(time.Time{})
+	if r := <-readAsync(c); string(r.data) != "two" {
+		t.Errorf("expected the datagram without a deadline, got %q, %v", r.data, r.err)
+	}
+}
+
+// TestMemNetClose tests that closing a socket fails the waiting reads and
+// frees its address.
+func TestMemNetClose(t *testing.T) {
+	n := NewMemNet(nil)
+	addr := memAddr("127.0.0.1:5000")
+	conn, _ := n.ListenUDP("udp", addr)
+	if _, err := n.ListenUDP("udp", addr); err == nil {
+		t.Error("expected the address to be in use")
+	}
+	c := conn.(*MemConn)
+	c.PushError(errors.New("scripted"))
+	if _, err := c.Read(make([]byte, 10)); err == nil || err.Error() != "scripted" {
+		t.Errorf("expected the scripted error, got %v", err)
+	}
+	res := readAsync(c)
+	c.WaitBlocked(1)
+	c.Close()
+	if r := <-res; !errors.Is(r.err, net.ErrClosed) {
+		t.Errorf("expected the read to fail with the socket closed, got %v", r.err)
+	}
+	if err := c.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected closing twice to fail, got %v", err)
+	}
+	if err := n.Send(memAddr("10.0.0.1:1"), addr, nil); !errors.Is(err, ErrNoListener) {
+		t.Errorf("expected no listener, got %v", err)
+	}
+	if _, err := n.ListenUDP("udp", addr); err != nil {
+		t.Errorf("expected the address to be free, got %v", err)
+	}
+}
+
+// TestMemNetRouting tests unspecified addresses, SO_REUSEPORT sockets and
+// multicast groups.
+func TestMemNetRouting(t *testing.T) {
+	n := NewMemNet(nil)
+	wild, _ := n.ListenUDP("udp", &net.UDPAddr{})
+	n.Send(memAddr("10.0.0.1:1"), wild.LocalAddr().(*net.UDPAddr), []byte("a"))
+	n.Send(memAddr("10.0.0.1:1"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: wild.LocalAddr().(*net.UDPAddr).Port}, []byte("b"))
+	if p := wild.(*MemConn).Pending(); p != 2 {
+		t.Errorf("expected 2 datagrams on the unspecified address, got %d", p)
+	}
+
+	addr := memAddr("127.0.0.1:6000")
+	var reuse []*MemConn
+	for i := 0; i < 2; i++ {
+		c, err := n.ListenUDPReusePort("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reuse = append(reuse, c.(*MemConn))
+	}
+	if _, err := n.ListenUDP("udp", addr); err == nil {
+		t.Error("expected the address to be in use without SO_REUSEPORT")
+	}
+	for i := 0; i < 4; i++ {
+		n.Send(memAddr("10.0.0.1:1"), addr, []byte{byte(i)})
+	}
+	if a, b := reuse[0].Pending(), reuse[1].Pending(); a+b != 4 || a*b != 0 {
+		t.Errorf("expected one sender's datagrams on one socket, got %d and %d", a, b)
+	}
+
+	group := net.IPv4(239, 1, 1, 1)
+	var members []*MemConn
+	for i := 0; i < 2; i++ {
+		c, err := n.ListenMulticastUDP("udp", nil, []net.IP{group}, 7000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, c.(*MemConn))
+	}
+	n.Send(memAddr("10.0.0.1:1"), &net.UDPAddr{IP: group, Port: 7000}, []byte("m"))
+	for _, c := range members {
+		if c.Pending() != 1 {
+			t.Error("expected every group member to get the datagram")
+		}
+	}
+}
+
+// TestServerMemNet tests the server reassembles messages read by several
+// readers off an in-memory socket, and that Shutdown waits for the readers'
+// deadlines on the fake clock.
+func TestServerMemNet(t *testing.T) {
+	clock := NewMemClock(time.Unix(1000, 0))
+	n := NewMemNet(clock)
+	rebuilt := make(chan uint32, 10)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		rebuilt <- transID
+	})
+	s := NewServerFromConfig(ServerConfig{
+		Addresses:  []*net.UDPAddr{memAddr("127.0.0.1:6789")},
+		NumReaders: 4,
+		NumWorkers: 2,
+		ReadWait:   time.Second,
+	}, n, h)
+	s.now = clock.Now
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go s.HandleErrors(func(err error) {})
+	conn := s.sockets[0].conn.(*MemConn)
+	conn.WaitBlocked(4)
+
+	for id := uint32(0); id < 10; id++ {
+		for off := uint32(0); off < 30; off += 10 {
+			data, _ := ioutil.ReadAll(createFrag(off == 20, id, off, make([]byte, 10), false))
+			n.Send(memAddr("10.0.0.1:4000"), memAddr("127.0.0.1:6789"), data)
+		}
+	}
+	seen := make(map[uint32]bool)
+	for i := 0; i < 10; i++ {
+		seen[<-rebuilt] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("expected 10 messages rebuilt, got %v", seen)
+	}
+
+	// the readers only notice the shutdown once their reads time out
+	conn.WaitBlocked(4)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the shutdown to wait for the readers, got %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := s.Wait(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if conn.Timeouts() != 4 {
+		t.Errorf("expected each reader to time out once, got %d", conn.Timeouts())
+	}
+	if !conn.Closed() {
+		t.Error("expected the socket to be closed")
+	}
+}
+
+// TestServerMemNetClosed tests that the server fails when its socket is
+// closed out from under the readers.
+func TestServerMemNetClosed(t *testing.T) {
+	clock := NewMemClock(time.Unix(1000, 0))
+	s := NewServerFromConfig(ServerConfig{
+		Addresses:  []*net.UDPAddr{createUDPAddr()},
+		NumReaders: 2,
+		ReadWait:   time.Second,
+	}, NewMemNet(clock), NewMsgHandler(5000, nil, nil))
+	s.now = clock.Now
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	conn := s.sockets[0].conn.(*MemConn)
+	conn.WaitBlocked(2)
+	conn.Close()
+	if err := s.Wait(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected the closed socket error, got %v", err)
+	}
+}
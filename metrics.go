@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the default histogram buckets in seconds, from 100µs
+// to a minute.
+var latencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60}
+
+// Counter is a metric that only goes up. A nil Counter ignores updates so
+// code can be instrumented whether or not a Registry is in use.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	if c != nil {
+		c.v.Add(n)
+	}
+}
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.v.Load()
+}
+
+// CounterVec is a set of counters told apart by the value of one label.
+type CounterVec struct {
+	lock     sync.Mutex
+	counters map[string]*Counter
+}
+
+// With returns the counter for the label value, creating it the first time.
+// A nil CounterVec returns a nil Counter.
+func (v *CounterVec) With(value string) *Counter {
+	if v == nil {
+		return nil
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	c, ok := v.counters[value]
+	if !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+// Histogram counts observations in buckets. A nil Histogram ignores
+// observations.
+type Histogram struct {
+	// bounds are the buckets' upper bounds, counts the observations that
+	// fell in each bucket, not cumulative, with the last one for +Inf
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	// sum is the float64 bits of the sum of the observations
+	sum atomic.Uint64
+}
+
+// Observe adds one observation.
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time) {
+	if h != nil {
+		h.Observe(time.Since(start).Seconds())
+	}
+}
+
+// sample is one line of a metric family: the name suffix, the rendered
+// labels and the value.
+type sample struct {
+	suffix string
+	labels string
+	value  float64
+}
+
+// family is a named metric with the samples it currently has.
+type family struct {
+	name    string
+	help    string
+	kind    string
+	collect func() []sample
+}
+
+// Registry holds metrics and writes them in the Prometheus text format.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// register adds a metric family. Registering a name twice replaces the
+// earlier family.
+func (r *Registry) register(name, help, kind string, collect func() []sample) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families[name] = &family{name: name, help: help, kind: kind, collect: collect}
+}
+
+// NewCounter registers a counter.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, help, "counter", func() []sample {
+		return []sample{{value: float64(c.Value())}}
+	})
+	return c
+}
+
+// NewCounterVec registers a set of counters with one label.
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{counters: make(map[string]*Counter)}
+	r.register(name, help, "counter", func() []sample {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		samples := make([]sample, 0, len(v.counters))
+		for value, c := range v.counters {
+			samples = append(samples, sample{labels: labelPairs(label, value), value: float64(c.Value())})
+		}
+		return samples
+	})
+	return v
+}
+
+// NewCounterFunc registers a counter whose value is read from f.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(name, help, "counter", func() []sample {
+		return []sample{{value: f()}}
+	})
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, help, "gauge", func() []sample {
+		return []sample{{value: f()}}
+	})
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// which must be sorted.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{bounds: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+	r.register(name, help, "histogram", func() []sample {
+		samples := make([]sample, 0, len(buckets)+3)
+		var cumulative uint64
+		for i := range h.counts {
+			cumulative += h.counts[i].Load()
+			le := "+Inf"
+			if i < len(buckets) {
+				le = formatFloat(buckets[i])
+			}
+			samples = append(samples, sample{suffix: "_bucket", labels: labelPairs("le", le), value: float64(cumulative)})
+		}
+		return append(samples,
+			sample{suffix: "_sum", value: math.Float64frombits(h.sum.Load())},
+			sample{suffix: "_count", value: float64(h.count.Load())})
+	})
+	return h
+}
+
+// labelPairs renders label name and value pairs, escaping the values.
+func labelPairs(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format,
+// sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.lock.Unlock()
+	sort.Slice(families, func(a, b int) bool { return families[a].name < families[b].name })
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		samples := f.collect()
+		if f.kind != "histogram" {
+			sort.Slice(samples, func(a, b int) bool { return samples[a].labels < samples[b].labels })
+		}
+		for _, s := range samples {
+			fmt.Fprintf(cw, "%s%s%s %s\n", f.name, s.suffix, s.labels, formatFloat(s.value))
+		}
+	}
+	if err := cw.w.(*bufio.Writer).Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP writes the metrics for a Prometheus scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// countingWriter counts the bytes written and keeps the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRegistryWriteTo tests the Prometheus text format of every kind of
+// metric.
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter.")
+	c.Add(3)
+	v := r.NewCounterVec("test_outcomes_total", "A labelled counter.", "outcome")
+	v.With("b").Inc()
+	v.With("a\"x").Add(2)
+	r.NewGaugeFunc("test_gauge", "A gauge.", func() float64 { return 1.5 })
+	h := r.NewHistogram("test_seconds", "A histogram.", []float64{.1, 1})
+	h.Observe(.05)
+	h.Observe(.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_outcomes_total A labelled counter.
+# TYPE test_outcomes_total counter
+test_outcomes_total{outcome="a\"x"} 2
+test_outcomes_total{outcome="b"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 2.55
+test_seconds_count 3
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+// TestNilMetrics tests that metrics that were never registered ignore
+// updates.
+func TestNilMetrics(t *testing.T) {
+	var c *Counter
+	var v *CounterVec
+	var h *Histogram
+	c.Inc()
+	v.With("a").Inc()
+	h.Observe(1)
+	if c.Value() != 0 {
+		t.Error("a nil counter should stay at 0")
+	}
+}
+
+// TestHandlerMetrics tests that the handler counts fragment outcomes and
+// message completions.
+func TestHandlerMetrics(t *testing.T) {
+	r := NewRegistry()
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(ioutil.Discard)
+	h.Instrument(r)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(true, 1, 10, make([]byte, 5)))
+	h.AddFragment(createValidFrag(false, 2, 0, make([]byte, 1)))
+
+	if n := h.cfg().metrics.fragments.With("accepted").Value(); n != 3 {
+		t.Errorf("expected 3 accepted fragments, got %d", n)
+	}
+	if n := h.cfg().metrics.fragments.With("duplicate").Value(); n != 1 {
+		t.Errorf("expected 1 duplicate, got %d", n)
+	}
+	if h.cfg().metrics.bytes.Value() != 16 || h.cfg().metrics.started.Value() != 2 || h.cfg().metrics.completed.Value() != 1 {
+		t.Errorf("unexpected counts: %d bytes, %d started, %d completed",
+			h.cfg().metrics.bytes.Value(), h.cfg().metrics.started.Value(), h.cfg().metrics.completed.Value())
+	}
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	for _, line := range []string{
+		"msg_assembler_messages_in_flight 1\n",
+		"msg_assembler_message_completion_seconds_count 1\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q in the metrics", line)
+		}
+	}
+	h.Flush(FlushDiscard)
+	if h.cfg().metrics.flushed.Value() != 1 {
+		t.Error("expected the flushed message to be counted")
+	}
+}
+
+// TestMetricsEndpoint tests that the server's metrics are served over HTTP.
+func TestMetricsEndpoint(t *testing.T) {
+	r := NewRegistry()
+	s := NewServerFromConfig(ServerConfig{}, &FakeNet{}, nil)
+	s.Instrument(r)
+	s.stats = append(s.stats, newListenerStats("udp", createUDPAddr()))
+	s.stats[0].received(20)
+
+	rec := httptest.NewRecorder()
+	newHTTPHandler(r, nil, nil, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		`msg_assembler_received_bytes_total{network="udp",address="0.0.0.0:0"} 20`,
+		"msg_assembler_workers 1",
+		"msg_assembler_parse_errors_total 0",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected %q in:\n%s", line, body)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"math"
+	"os"
 
 	"github.com/jonathan-buttner/msg-assembler/tree"
 )
@@ -19,6 +21,13 @@ const (
 	// Success indicates that the AddFragment method successfully added
 	// the fragment.
 	Success
+	// TooLarge is returned by MsgHandler's AddFragment when the fragment
+	// ends past the largest allowed message size.
+	TooLarge
+	// TooManyMsgs is returned by MsgHandler's AddFragment when the fragment
+	// would start a new message while the most messages allowed are already
+	// in flight.
+	TooManyMsgs
 )
 
 // Msg is the data model for a message received from the client. It
@@ -30,7 +39,8 @@ type Msg struct {
 	// fragTree keeps the fragments in order by offset to aid determining
 	// if there is a whole when rebuilding occurs. I chose a binary tree
 	// so that I easily keep the fragments sorted by the offset. Keeping
-	// them sorted allows for easy determining if there are holes.
+	// them sorted allows for easy determining if there are holes. The tree
+	// balances itself so fragments arriving in order don't make it a list.
 	fragTree *tree.Tree
 	// recvTotal is the current sum of all the received fragments' data portion
 	// for a single transation ID. This is used to tell if the entire message
@@ -45,11 +55,26 @@ type Msg struct {
 	// Total can have a legitimate size of 0, otherwise I wouldn't be able to
 	// determine if the end fragment had been received yet.
 	receivedEnd bool
-	// fragMap is a map of Offset to a boolean. It allows O(1) access to
-	// determine if the received fragment is a duplicate. The boolean portion
-	// is unnecessary but I can't just use a static array because I don't know
-	// how many fragments I will receive ahead of time.
-	fragMap map[uint32]bool
+	// fragMap is a map of Offset to the fragment. It allows O(1) access to
+	// determine if the received fragment is a duplicate and to find the
+	// fragment that continues the contiguous data. I can't just use a static
+	// array because I don't know how many fragments I will receive ahead of
+	// time.
+	fragMap map[uint32]*Fragment
+	// contiguous is how many bytes from offset 0 have arrived without a hole.
+	contiguous uint32
+	// memBytes is how much of the received data is held in memory.
+	memBytes int64
+	// spillThreshold is how much data the message holds in memory before
+	// new fragments are appended to spillFile in spillDir, 0 to never
+	// spill. spillSize is how much has been written to the file. The file
+	// is claimed from spillFiles, spillRefused is set if none was free.
+	spillThreshold int64
+	spillDir       string
+	spillFile      *os.File
+	spillSize      int64
+	spillFiles     *spillFiles
+	spillRefused   bool
 }
 
 // msgCompare is passed to the binary tree to compare two fragments.
@@ -77,8 +102,10 @@ func NewMsg(frag *Fragment) *Msg {
 		recvTotal:   uint32(frag.DataLen),
 		total:       total,
 		receivedEnd: frag.IsEnd,
-		fragMap:     map[uint32]bool{frag.Offset: true},
+		fragMap:     map[uint32]*Fragment{frag.Offset: frag},
+		memBytes:    int64(frag.DataLen),
 	}
+	m.extendContiguous()
 	return m
 }
 
@@ -102,63 +129,136 @@ func (m *Msg) AddFragment(frag *Fragment) int {
 	}
 
 	m.recvTotal += uint32(frag.DataLen)
-	m.fragMap[frag.Offset] = true
+	m.memBytes += int64(frag.DataLen)
+	m.fragMap[frag.Offset] = frag
 	m.fragTree.Insert(frag)
+	m.extendContiguous()
 	return Success
 }
 
+// extendContiguous moves the end of the contiguous data past any fragments
+// that now continue it.
+func (m *Msg) extendContiguous() {
+	for {
+		f, ok := m.fragMap[m.contiguous]
+		if !ok || f.DataLen == 0 || uint64(m.contiguous)+uint64(f.DataLen) > math.MaxUint32 {
+			return
+		}
+		m.contiguous += uint32(f.DataLen)
+	}
+}
+
 // HasAllFrags checks to see if all the fragments have arrived for this message.
-// Returns true if all the fragments have arrived and false otherwise.
-// NOTE: This assumes that a client will not send malformed packets. A malformed packet
-// would be where two fragments overlap for example:
-// Fragment 1: offset = 0, data len = 100
-// Fragment 2: offset = 10, data len = 5
+// Returns true if all the fragments have arrived and false otherwise. The
+// fragments must join up from offset 0 to the end without overlapping, a
+// message with overlapping fragments never completes and expires instead.
 func (m *Msg) HasAllFrags() bool {
-	if !m.receivedEnd || m.recvTotal != m.total {
-		return false
-	}
-	return true
+	return m.receivedEnd && m.recvTotal == m.total && m.contiguous == m.total
 }
 
 // GetHoles uses the Fragment binary tree to determine if there are any
 // missing fragments for this message. If a hole is found it calls the
 // cb function with the transaction ID for message and
-// the offset of the hole and
+// the offset of the hole. A hole is reported where each run of missing data
+// starts, fragments overlapping each other count as covering their data and
+// empty fragments cover nothing. Once the end has arrived nothing past it is
+// missing.
 func (m *Msg) GetHoles(cb func(transID uint32, startHoleOff uint32)) {
-	offArr := m.fragTree.InOrderArr()
-	if offArr[0].(*Fragment).Offset != 0 {
-		if cb != nil {
-			cb(m.transID, 0)
-		}
+	if cb == nil {
+		return
 	}
-	for i := 0; i < len(offArr)-1; i++ {
-		curFrag := offArr[i].(*Fragment)
-		hole := curFrag.Offset + uint32(curFrag.DataLen)
-
-		if hole != offArr[i+1].(*Fragment).Offset {
-			if cb != nil {
-				cb(m.transID, hole)
-			}
+	// end is where the data covered so far ends, it can pass 4GiB when a
+	// fragment's offset and length overflow
+	var end uint64
+	for _, f := range m.fragTree.InOrderArr() {
+		frag := f.(*Fragment)
+		if m.receivedEnd && frag.Offset >= m.total {
+			break
 		}
-	}
-	endFrag := offArr[len(offArr)-1].(*Fragment)
-	if !endFrag.IsEnd {
-		if cb != nil {
-			cb(m.transID, endFrag.Offset+uint32(endFrag.DataLen))
+		if frag.DataLen == 0 {
+			continue
+		}
+		if uint64(frag.Offset) > end {
+			cb(m.transID, uint32(end))
 		}
+		end = max(end, uint64(frag.Offset)+uint64(frag.DataLen))
+	}
+	if end <= math.MaxUint32 && (!m.receivedEnd || end < uint64(m.total)) {
+		cb(m.transID, uint32(end))
+	}
+}
+
+// TransID returns the message's transaction ID.
+func (m *Msg) TransID() uint32 {
+	return m.transID
+}
+
+// BytesReceived returns the number of data bytes received so far.
+func (m *Msg) BytesReceived() uint32 {
+	return m.recvTotal
+}
+
+// ExpectedTotal returns the message's length and whether it is known yet.
+// It is only known once the end fragment has arrived.
+func (m *Msg) ExpectedTotal() (uint32, bool) {
+	return m.total, m.receivedEnd
+}
+
+// Contiguous returns how many bytes from the start of the message have
+// arrived without a hole.
+func (m *Msg) Contiguous() uint32 {
+	return m.contiguous
+}
+
+// FragmentCount returns the number of fragments received so far.
+func (m *Msg) FragmentCount() int {
+	return len(m.fragMap)
+}
+
+// Holes returns the offsets where the missing data starts, in order.
+func (m *Msg) Holes() []uint32 {
+	var holes []uint32
+	m.GetHoles(func(transID, off uint32) {
+		holes = append(holes, off)
+	})
+	return holes
+}
+
+// release gives back the pooled buffers held by the message's fragments
+// and removes its spill file. The message's data can't be used afterwards.
+func (m *Msg) release() {
+	for _, f := range m.fragTree.InOrderArr() {
+		f.(*Fragment).release()
+	}
+	if m.spillFile != nil {
+		m.spillFile.Close()
+		os.Remove(m.spillFile.Name())
+		m.spillFile = nil
+		m.spillFiles.put()
 	}
 }
 
 // GetSha256 calculates the sha256 hash of all the data for the fragments in the
-// message.
+// message. It fails if a fragment is missing or spilled data can't be read
+// back.
 func (m *Msg) GetSha256() (string, error) {
 	if !m.HasAllFrags() {
 		return "", errors.New("Message doesn't have all the fragments")
 	}
+	return m.hashFrags()
+}
+
+// GetPartialSha256 calculates the sha256 hash of the data received so far in
+// offset order, skipping over any holes. It fails if spilled data can't be
+// read back.
+func (m *Msg) GetPartialSha256() (string, error) {
+	return m.hashFrags()
+}
+
+func (m *Msg) hashFrags() (string, error) {
 	h := sha256.New()
-	fragArr := m.fragTree.InOrderArr()
-	for _, f := range fragArr {
-		h.Write(f.(*Fragment).Data)
+	if _, err := m.WriteTo(h); err != nil {
+		return "", err
 	}
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
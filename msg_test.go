@@ -3,6 +3,8 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"math"
+	"sort"
 	"testing"
 )
 
@@ -282,3 +284,136 @@ func TestMsgGetSha256NonZero(t *testing.T) {
 		t.Error("sha256 didn't match")
 	}
 }
+
+// fuzzFragments reads the fragments packed one after another in b, stopping
+// at the first that is cut short.
+func fuzzFragments(b []byte) []*Fragment {
+	var frags []*Fragment
+	for {
+		frag, err := ParseFragment(b)
+		if err != nil {
+			return frags
+		}
+		frags = append(frags, frag)
+		b = b[FragHdrLen+int(frag.DataLen):]
+	}
+}
+
+// checkMsg checks the message against the fragments it accepted: the holes
+// are where the covered data has gaps, a complete message has none and its
+// hash is the hash of the fragments copied into place.
+func checkMsg(t *testing.T, m *Msg, accepted []*Fragment) {
+	t.Helper()
+	holes := m.Holes()
+	for i, hole := range holes {
+		if i > 0 && hole <= holes[i-1] {
+			t.Fatalf("holes out of order %v", holes)
+		}
+		atEnd := hole == 0
+		for _, f := range accepted {
+			end := uint64(f.Offset) + uint64(f.DataLen)
+			if uint64(hole) >= uint64(f.Offset) && uint64(hole) < end {
+				t.Fatalf("hole %d inside fragment at %d of %d bytes", hole, f.Offset, f.DataLen)
+			}
+			atEnd = atEnd || uint64(hole) == end
+		}
+		if !atEnd {
+			t.Fatalf("hole %d isn't where a fragment ends", hole)
+		}
+	}
+
+	// the data covered from offset 0
+	sorted := append([]*Fragment(nil), accepted...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].Offset < sorted[b].Offset })
+	var covered uint64
+	for _, f := range sorted {
+		if f.DataLen > 0 && uint64(f.Offset) <= covered {
+			covered = max(covered, uint64(f.Offset)+uint64(f.DataLen))
+		}
+	}
+	total, ended := m.ExpectedTotal()
+	if whole := ended && covered >= uint64(total); whole != (len(holes) == 0) {
+		t.Fatalf("holes %v for data covered up to %d of %d, end received %v", holes, covered, total, ended)
+	}
+
+	if !m.HasAllFrags() {
+		if _, err := m.GetSha256(); err == nil {
+			t.Fatal("expected no hash for an incomplete message")
+		}
+		return
+	}
+	if len(holes) > 0 {
+		t.Fatalf("complete message has holes %v", holes)
+	}
+	ref := make([]byte, total)
+	written := 0
+	for _, f := range accepted {
+		if f.DataLen == 0 {
+			continue
+		}
+		if uint64(f.Offset)+uint64(f.DataLen) > uint64(total) {
+			t.Fatalf("complete message of %d bytes has a fragment at %d of %d bytes", total, f.Offset, f.DataLen)
+		}
+		written += copy(ref[f.Offset:], f.Data)
+	}
+	if written != int(total) {
+		t.Fatalf("complete message of %d bytes has %d bytes of fragments", total, written)
+	}
+	sum := sha256.Sum256(ref)
+	if sha, err := m.GetSha256(); err != nil || sha != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expected hash %x, got %s, %v", sum, sha, err)
+	}
+}
+
+// FuzzMsg feeds arbitrary fragments to a message, in any order, overlapping,
+// duplicated or for other messages, and checks its holes and hash stay
+// consistent with what it accepted after each one.
+func FuzzMsg(f *testing.F) {
+	pack := func(frags ...*Fragment) []byte {
+		var b []byte
+		for _, frag := range frags {
+			b = appendFragment(b, frag)
+		}
+		return b
+	}
+	frag := func(isEnd bool, offset uint32, data string) *Fragment {
+		return &Fragment{FragmentHdr: FragmentHdr{IsEnd: isEnd, DataLen: uint16(len(data)), Offset: offset, TransID: 1}, Data: []byte(data)}
+	}
+	f.Add(pack(frag(false, 0, "hello "), frag(true, 6, "world")))
+	f.Add(pack(frag(true, 6, "world"), frag(false, 0, "hello "), frag(false, 0, "hello ")))
+	f.Add(pack(frag(false, 3, "lo wo"), frag(false, 0, "hello "), frag(true, 6, "world")))
+	f.Add(pack(frag(true, 0, "")))
+	f.Add(pack(frag(true, 20, ""), frag(false, 10, "0123456789")))
+	f.Add(pack(frag(false, 0, "ab"), frag(true, 2, "cd"), frag(true, 4, "ef")))
+	f.Add(pack(frag(false, math.MaxUint32-1, "abc"), frag(true, 0, "x")))
+	other := frag(true, 0, "x")
+	other.TransID = 2
+	f.Add(pack(frag(false, 0, "a"), other))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		frags := fuzzFragments(b)
+		if len(frags) == 0 {
+			return
+		}
+		m := NewMsg(frags[0])
+		accepted := frags[:1]
+		checkMsg(t, m, accepted)
+		for _, frag := range frags[1:] {
+			switch m.AddFragment(frag) {
+			case Success:
+				accepted = append(accepted, frag)
+			case WrongTransID:
+				if frag.TransID == m.TransID() {
+					t.Fatalf("fragment for %d rejected by message %d", frag.TransID, m.TransID())
+				}
+			case Duplicate:
+				if _, ok := m.fragMap[frag.Offset]; !ok {
+					t.Fatalf("fragment at %d rejected as a duplicate", frag.Offset)
+				}
+			}
+			checkMsg(t, m, accepted)
+		}
+		if m.FragmentCount() != len(accepted) {
+			t.Fatalf("message holds %d fragments, accepted %d", m.FragmentCount(), len(accepted))
+		}
+	})
+}
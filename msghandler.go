@@ -2,7 +2,12 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,34 +15,148 @@ type cleanUpMsg struct {
 	cleanUpTimer *time.Timer
 	msgHandler   *MsgHandler
 	transID      uint32
+	// started is when the message's timer was started and deadline is when
+	// it fires
+	started  time.Time
+	deadline time.Time
 }
 
 func (c *cleanUpMsg) cleanUp() {
-	c.msgHandler.lock.Lock()
-	defer c.msgHandler.lock.Unlock()
-	// if the transaction ID is no longer in the map then
-	// the message was reassembled and removed while we were waiting for the lock
-	if m, ok := c.msgHandler.msgMap[c.transID]; ok {
+	sh := c.msgHandler.lockShard(c.transID)
+	defer sh.lock.Unlock()
+	// if the clean up is no longer in the map then the message was
+	// reassembled and removed, or its deadline moved, while we were waiting
+	// for the lock
+	if sh.cleanUpMap[c.transID] != c {
+		return
+	}
+	if m, ok := sh.msgMap[c.transID]; ok {
 		// only clean up if we don't have all the fragments
 		// if a fragment sunk in just in time let the reassembly happen
 		if !m.HasAllFrags() {
-			delete(c.msgHandler.msgMap, c.transID)
-			delete(c.msgHandler.cleanUpMap, c.transID)
-			// call the callback so the holes can be printed
-			m.GetHoles(c.msgHandler.cleanUpCB)
+			sh.expire(c.transID, m, "timeout")
 		}
 	}
 }
 
 // MsgHandler handles locking and cleanup for messages. It allows fragments to be
 // added to messages.
+//
+// The messages are split into shards by transaction ID, each with its own
+// lock. The server keeps one shard per worker, picked the same way as the
+// worker, so workers never wait on each other. The settings are swapped in
+// whole so adding a fragment only reads them.
 type MsgHandler struct {
-	cleanUpDelay int
 	cleanUpCB    func(transID, offset uint32)
-	cleanUpMap   map[uint32]*cleanUpMsg
-	msgMap       map[uint32]*Msg
-	lock         *sync.Mutex
 	rebuiltMsgCB func(transID uint32, sha256 string)
+	// shards holds the messages in flight, see lockShard
+	shards atomic.Pointer[[]*handlerShard]
+	// settings are changed by copying them under setLock
+	settings atomic.Pointer[handlerSettings]
+	setLock  sync.Mutex
+	// inFlight counts the messages across the shards
+	inFlight atomic.Int64
+	// spillFiles limits how many spill files are open at once
+	spillFiles *spillFiles
+	// expired counts the messages that timed out whether or not the
+	// handler is instrumented
+	expired atomic.Uint64
+}
+
+// handlerShard holds the messages whose transaction IDs map to it. A shard
+// that has been replaced by a change to the number of shards is retired, its
+// messages have moved to the new shards.
+type handlerShard struct {
+	h          *MsgHandler
+	lock       sync.Mutex
+	msgMap     map[uint32]*Msg
+	cleanUpMap map[uint32]*cleanUpMsg
+	retired    bool
+}
+
+func newShards(h *MsgHandler, n int) []*handlerShard {
+	shards := make([]*handlerShard, n)
+	for i := range shards {
+		shards[i] = &handlerShard{
+			h:          h,
+			msgMap:     make(map[uint32]*Msg),
+			cleanUpMap: make(map[uint32]*cleanUpMsg),
+		}
+	}
+	return shards
+}
+
+// handlerSettings are what the Set methods change. A copy is never modified
+// once it is stored.
+type handlerSettings struct {
+	cleanUpDelay int
+	// logger reports reassembled and incomplete messages
+	logger *slog.Logger
+	// maxMsgs is the most messages in flight at once, 0 for no limit
+	maxMsgs int
+	// maxMsgSize is the largest message in bytes, 0 for no limit
+	maxMsgSize int64
+	// journal records the accepted fragments when it is set
+	journal *Journal
+	// spillThreshold is how much of a message is kept in memory before the
+	// rest is written to a file in spillDir, 0 to keep everything in memory
+	spillThreshold int64
+	spillDir       string
+	spillErrCB     func(err error)
+	metrics        handlerMetrics
+	// tracer is called with each message's lifecycle events when it is set
+	tracer func(ev TraceEvent)
+}
+
+// handlerMetrics are the MsgHandler's instruments. They are nil, and ignore
+// updates, until Instrument is called.
+type handlerMetrics struct {
+	// fragments counts the fragments passed to AddFragment by outcome
+	fragments *CounterVec
+	bytes     *Counter
+	started   *Counter
+	completed *Counter
+	failed    *Counter
+	expired   *Counter
+	flushed   *Counter
+	// latency is the time from a message's first fragment to its last
+	latency *Histogram
+}
+
+// statusNames are the outcome labels for AddFragment's return values.
+var statusNames = map[int]string{
+	Duplicate:    "duplicate",
+	WrongTransID: "wrong_trans_id",
+	Success:      "accepted",
+	TooLarge:     "too_large",
+	TooManyMsgs:  "too_many_messages",
+}
+
+// Instrument registers the handler's metrics with r.
+func (h *MsgHandler) Instrument(r *Registry) {
+	metrics := handlerMetrics{
+		fragments: r.NewCounterVec("msg_assembler_fragments_total",
+			"Fragments added to messages by outcome.", "outcome"),
+		bytes: r.NewCounter("msg_assembler_fragment_bytes_total",
+			"Data bytes of the accepted fragments."),
+		started: r.NewCounter("msg_assembler_messages_started_total",
+			"Messages started by their first fragment."),
+		completed: r.NewCounter("msg_assembler_messages_completed_total",
+			"Messages reassembled from all of their fragments."),
+		failed: r.NewCounter("msg_assembler_messages_failed_total",
+			"Messages with all of their fragments whose data couldn't be read back."),
+		expired: r.NewCounter("msg_assembler_messages_expired_total",
+			"Messages removed because their fragments didn't arrive in time."),
+		flushed: r.NewCounter("msg_assembler_messages_flushed_total",
+			"Incomplete messages flushed on shutdown."),
+		latency: r.NewHistogram("msg_assembler_message_completion_seconds",
+			"Time from a message's first fragment until it was reassembled.", latencyBuckets),
+	}
+	r.NewGaugeFunc("msg_assembler_messages_in_flight", "Messages waiting for fragments.",
+		func() float64 {
+			return float64(h.inFlight.Load())
+		})
+	h.update(func(s *handlerSettings) { s.metrics = metrics })
 }
 
 // NewMsgHandler creates a MsgHandler. The MsgHandler handles thread safety for
@@ -49,71 +168,554 @@ func NewMsgHandler(cleanUpWait int,
 	rebuiltCB func(uint32, string)) *MsgHandler {
 	h := &MsgHandler{
 		cleanUpCB:    cleanUpCB,
-		cleanUpDelay: cleanUpWait,
-		cleanUpMap:   make(map[uint32]*cleanUpMsg),
-		msgMap:       make(map[uint32]*Msg),
-		lock:         &sync.Mutex{},
 		rebuiltMsgCB: rebuiltCB,
+		spillFiles:   newSpillFiles(0),
 	}
+	shards := newShards(h, 1)
+	h.shards.Store(&shards)
+	h.settings.Store(&handlerSettings{
+		cleanUpDelay: cleanUpWait,
+		logger:       slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	})
 	return h
 }
 
+// cfg returns the current settings.
+func (h *MsgHandler) cfg() *handlerSettings {
+	return h.settings.Load()
+}
+
+// update changes the settings. A fragment being added sees either the old
+// settings or the new ones, never a mix.
+func (h *MsgHandler) update(f func(s *handlerSettings)) {
+	h.setLock.Lock()
+	defer h.setLock.Unlock()
+	s := *h.settings.Load()
+	f(&s)
+	h.settings.Store(&s)
+}
+
+// lockShard locks and returns the shard holding the message with the
+// transaction ID.
+func (h *MsgHandler) lockShard(transID uint32) *handlerShard {
+	for {
+		shards := *h.shards.Load()
+		sh := shards[transID%uint32(len(shards))]
+		sh.lock.Lock()
+		if !sh.retired {
+			return sh
+		}
+		// the shards changed while we were waiting for the lock
+		sh.lock.Unlock()
+	}
+}
+
+// lockShards locks every shard, in order, and returns them.
+func (h *MsgHandler) lockShards() []*handlerShard {
+	for {
+		shards := *h.shards.Load()
+		for _, sh := range shards {
+			sh.lock.Lock()
+		}
+		// the shards are retired together
+		if !shards[0].retired {
+			return shards
+		}
+		unlockShards(shards)
+	}
+}
+
+func unlockShards(shards []*handlerShard) {
+	for _, sh := range shards {
+		sh.lock.Unlock()
+	}
+}
+
+// setShards splits the messages into n shards, keyed by transaction ID
+// modulo n like the server's workers. The messages in flight move to their
+// new shard.
+func (h *MsgHandler) setShards(n int) {
+	if n < 1 {
+		n = 1
+	}
+	h.setLock.Lock()
+	defer h.setLock.Unlock()
+	old := h.lockShards()
+	defer unlockShards(old)
+	if len(old) == n {
+		return
+	}
+	shards := newShards(h, n)
+	for _, sh := range old {
+		for transID, m := range sh.msgMap {
+			shards[transID%uint32(n)].msgMap[transID] = m
+		}
+		for transID, clMsg := range sh.cleanUpMap {
+			shards[transID%uint32(n)].cleanUpMap[transID] = clMsg
+		}
+		sh.retired = true
+	}
+	h.shards.Store(&shards)
+}
+
+// SetOutput reports reassembled and incomplete messages to w as text log
+// records. They go to standard out by default.
+func (h *MsgHandler) SetOutput(w io.Writer) {
+	h.SetLogger(slog.New(slog.NewTextHandler(w, nil)))
+}
+
+// SetLogger reports reassembled and incomplete messages to l. Reassembled
+// messages are logged at info level with their trans_id, length and sha256.
+// Messages that expire or are flushed incomplete are logged at warn level
+// with their holes and the reason.
+func (h *MsgHandler) SetLogger(l *slog.Logger) {
+	h.update(func(s *handlerSettings) { s.logger = l })
+}
+
+// SetJournal records every accepted fragment in j and marks messages done
+// in it once they are reassembled, expire or are flushed.
+func (h *MsgHandler) SetJournal(j *Journal) {
+	h.update(func(s *handlerSettings) { s.journal = j })
+}
+
+// SetTracer calls tracer with every message's lifecycle events: its first
+// fragment, each fragment accepted, duplicated or rejected, the contiguous
+// data growing, and its completion or expiry. tracer is called with the
+// message's shard locked so it must be quick and must not call back into the
+// handler. It may be called from several workers at once. nil turns tracing
+// off.
+func (h *MsgHandler) SetTracer(tracer func(ev TraceEvent)) {
+	h.update(func(s *handlerSettings) { s.tracer = tracer })
+}
+
+// trace passes an event to the tracer if there is one. sh.lock must be
+// held.
+func (sh *handlerShard) trace(typ TraceEventType, frag *Fragment, transID uint32, reason string) {
+	tracer := sh.h.cfg().tracer
+	if tracer == nil {
+		return
+	}
+	ev := TraceEvent{Type: typ, TransID: transID, Time: time.Now(), Reason: reason}
+	if frag != nil {
+		ev.Offset, ev.Length = frag.Offset, frag.DataLen
+	}
+	if m, ok := sh.msgMap[transID]; ok {
+		ev.Contiguous = m.Contiguous()
+	}
+	tracer(ev)
+}
+
+// SetSpill makes messages write their fragments to a temporary file in dir
+// once they hold threshold bytes in memory. An empty dir uses the default
+// temporary directory and a threshold of 0 keeps everything in memory. At
+// most maxFiles messages have a file at once, 0 for the default of 64, the
+// rest keep their data in memory. It applies to messages started after the
+// change. errCB is called when a fragment can't be written, the fragment is
+// kept in memory instead. It can be nil.
+func (h *MsgHandler) SetSpill(dir string, threshold int64, maxFiles int, errCB func(err error)) {
+	h.spillFiles.setMax(maxFiles)
+	h.update(func(s *handlerSettings) {
+		s.spillDir = dir
+		s.spillThreshold = threshold
+		s.spillErrCB = errCB
+	})
+}
+
+// SetCleanUpWait changes how long, in milliseconds, a message may wait for
+// its missing fragments. It applies to messages started after the change,
+// messages already in flight keep their deadline.
+func (h *MsgHandler) SetCleanUpWait(cleanUpWait int) {
+	h.update(func(s *handlerSettings) { s.cleanUpDelay = cleanUpWait })
+}
+
+// SetLimits bounds the number of messages in flight and the size of a
+// message. Zero turns a limit off. Messages already in flight are kept even if
+// they are over the new limits.
+func (h *MsgHandler) SetLimits(maxMsgs int, maxMsgSize int64) {
+	h.update(func(s *handlerSettings) {
+		s.maxMsgs = maxMsgs
+		s.maxMsgSize = maxMsgSize
+	})
+}
+
+// Expired returns how many messages were removed because their fragments
+// didn't arrive in time, including those expired through Expire.
+func (h *MsgHandler) Expired() uint64 {
+	return h.expired.Load()
+}
+
+// MaxMessageSize returns the largest message in bytes, 0 for no limit.
+func (h *MsgHandler) MaxMessageSize() int64 {
+	return h.cfg().maxMsgSize
+}
+
 // PrintHoles is a callback for when the cleanup thread removes the fragments
 // for a message. This function provides a default implementation for the callback
-// which prints the holes.
+// which logs each hole to the default logger.
 func PrintHoles(transID, off uint32) {
-	fmt.Printf("Message #%d Hole at: %d\n", transID, off)
+	slog.Warn("message hole", "trans_id", transID, "offset", off)
 }
 
-func (h *MsgHandler) addCleanUpMsg(transID uint32) *cleanUpMsg {
+// PrintHolesTo returns a clean up callback that logs each hole to w as a
+// text log record.
+func PrintHolesTo(w io.Writer) func(transID, off uint32) {
+	l := slog.New(slog.NewTextHandler(w, nil))
+	return func(transID, off uint32) {
+		l.Warn("message hole", "trans_id", transID, "offset", off)
+	}
+}
+
+// cleanUpDeadline is when a message starting at started expires.
+func (h *MsgHandler) cleanUpDeadline(started time.Time) time.Time {
+	return started.Add(time.Duration(h.cfg().cleanUpDelay) * time.Millisecond)
+}
+
+// addCleanUpMsg starts the clean up timer for a message that expires at
+// deadline. sh.lock must be held.
+func (sh *handlerShard) addCleanUpMsg(transID uint32, deadline time.Time) *cleanUpMsg {
 	clMsg := &cleanUpMsg{
 		cleanUpTimer: nil,
-		msgHandler:   h,
+		msgHandler:   sh.h,
 		transID:      transID,
+		started:      time.Now(),
+		deadline:     deadline,
 	}
-	dur := time.Duration(h.cleanUpDelay) * time.Millisecond
 	// start the clean up timer
-	clMsg.cleanUpTimer = time.AfterFunc(dur, clMsg.cleanUp)
-	h.cleanUpMap[transID] = clMsg
+	clMsg.cleanUpTimer = time.AfterFunc(time.Until(deadline), clMsg.cleanUp)
+	sh.cleanUpMap[transID] = clMsg
 	return clMsg
 }
 
-func (h *MsgHandler) reassembleMsg(msg *Msg) {
-	sh, _ := msg.GetSha256()
+// remove takes a message out of the shard and stops its clean up timer.
+// sh.lock must be held.
+func (sh *handlerShard) remove(transID uint32) {
+	if clMsg, ok := sh.cleanUpMap[transID]; ok {
+		clMsg.cleanUpTimer.Stop()
+	}
+	delete(sh.msgMap, transID)
+	delete(sh.cleanUpMap, transID)
+	sh.h.inFlight.Add(-1)
+}
+
+// expire removes an incomplete message and reports its holes, logging
+// reason as why. sh.lock must be held.
+func (sh *handlerShard) expire(transID uint32, m *Msg, reason string) {
+	h := sh.h
+	cfg := h.cfg()
+	sh.remove(transID)
+	h.traceEnd(TraceExpired, transID, m, reason)
+	h.logIncomplete(transID, m, reason)
+	// call the callback so the holes can be printed
+	m.GetHoles(h.cleanUpCB)
+	m.release()
+	cfg.metrics.expired.Inc()
+	h.expired.Add(1)
+	if cfg.journal != nil {
+		cfg.journal.done(transID)
+	}
+}
+
+// traceEnd passes the event ending a message, already removed from its
+// shard, to the tracer.
+func (h *MsgHandler) traceEnd(typ TraceEventType, transID uint32, m *Msg, reason string) {
+	if tracer := h.cfg().tracer; tracer != nil {
+		tracer(TraceEvent{Type: typ, TransID: transID, Time: time.Now(), Contiguous: m.Contiguous(), Reason: reason})
+	}
+}
+
+func (h *MsgHandler) reassembleMsg(msg *Msg) error {
+	logger := h.cfg().logger
+	sh, err := msg.GetSha256()
+	if err != nil {
+		logger.Error("message failed", "trans_id", msg.transID, "length", msg.total, "err", err)
+		return err
+	}
 	if h.rebuiltMsgCB != nil {
 		h.rebuiltMsgCB(msg.transID, sh)
 	}
-	fmt.Printf("Message #%d length: %d\n", msg.transID, msg.total)
-	fmt.Printf("sha256:%s\n", sh)
+	logger.Info("message reassembled", "trans_id", msg.transID, "length", msg.total, "sha256", sh)
+	return nil
+}
+
+// logIncomplete reports a message removed before all of its fragments
+// arrived.
+func (h *MsgHandler) logIncomplete(transID uint32, m *Msg, reason string) {
+	h.cfg().logger.Warn("message incomplete", "trans_id", transID, "length", m.recvTotal,
+		"holes", m.Holes(), "reason", reason)
+}
+
+// FlushPolicy decides what Flush does with the messages still missing
+// fragments.
+type FlushPolicy int
+
+const (
+	// FlushHoles reports each message's holes the same as when it times out.
+	FlushHoles FlushPolicy = iota
+	// FlushPartial reports how much of each message was received and the
+	// sha256 hash of that data.
+	FlushPartial
+	// FlushDiscard drops the messages without reporting them.
+	FlushDiscard
+)
+
+// FlushSummary counts what was lost when Flush removed the incomplete
+// messages.
+type FlushSummary struct {
+	Messages  int
+	Fragments int
+	Bytes     uint64
+}
+
+// Flush removes every message in flight and stops its clean up timer,
+// reporting each one according to policy. It is meant for shutdown once no
+// more fragments will be added.
+func (h *MsgHandler) Flush(policy FlushPolicy) FlushSummary {
+	shards := h.lockShards()
+	defer unlockShards(shards)
+	cfg := h.cfg()
+	var sum FlushSummary
+	for _, sh := range shards {
+		for transID, msg := range sh.msgMap {
+			sh.remove(transID)
+			h.traceEnd(TraceExpired, transID, msg, "shutdown")
+			sum.Messages++
+			sum.Fragments += len(msg.fragMap)
+			sum.Bytes += uint64(msg.recvTotal)
+			cfg.metrics.flushed.Inc()
+			if cfg.journal != nil {
+				cfg.journal.done(transID)
+			}
+			switch policy {
+			case FlushHoles:
+				h.logIncomplete(transID, msg, "shutdown")
+				msg.GetHoles(h.cleanUpCB)
+			case FlushPartial:
+				if sh, err := msg.GetPartialSha256(); err != nil {
+					cfg.logger.Error("message partial", "trans_id", transID, "length", msg.recvTotal,
+						"err", err, "reason", "shutdown")
+				} else {
+					cfg.logger.Warn("message partial", "trans_id", transID, "length", msg.recvTotal,
+						"sha256", sh, "reason", "shutdown")
+				}
+			}
+			msg.release()
+		}
+	}
+	return sum
 }
 
 // AddFragment handles thread safety and clean up of an incomplete message when
 // it hasn't arrived after the specified wait time. To add a fragment pass it
-// to this method.
-func (h *MsgHandler) AddFragment(frag *Fragment) {
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// to this method. It returns Success, Duplicate or WrongTransID like
+// Msg.AddFragment, or TooLarge or TooManyMsgs if the fragment was rejected
+// by the limits.
+func (h *MsgHandler) AddFragment(frag *Fragment) int {
+	sh := h.lockShard(frag.TransID)
+	defer sh.lock.Unlock()
+	status := sh.addFragment(frag, h.cleanUpDeadline(time.Now()), true)
+	h.cfg().metrics.fragments.With(statusNames[status]).Inc()
+	return status
+}
+
+// replayFragment adds a fragment read back from the journal. If it starts a
+// message the message expires the clean up wait after started.
+func (h *MsgHandler) replayFragment(frag *Fragment, started time.Time) int {
+	sh := h.lockShard(frag.TransID)
+	defer sh.lock.Unlock()
+	return sh.addFragment(frag, h.cleanUpDeadline(started), false)
+}
+
+// addFragment adds the fragment to its message, starting the message if it
+// is the first fragment. A new message expires at deadline. Accepted
+// fragments are recorded in the journal if there is one and record is set.
+// sh.lock must be held.
+func (sh *handlerShard) addFragment(frag *Fragment, deadline time.Time, record bool) int {
+	h := sh.h
+	cfg := h.cfg()
 	var msg *Msg
 	var clMsg *cleanUpMsg
+	status := Success
+	if cfg.maxMsgSize > 0 && int64(frag.Offset)+int64(frag.DataLen) > cfg.maxMsgSize {
+		sh.trace(TraceRejected, frag, frag.TransID, statusNames[TooLarge])
+		frag.release()
+		return TooLarge
+	}
 	// message trans ID exists in the map
-	if msgInMap, ok := h.msgMap[frag.TransID]; ok {
-		msgInMap.AddFragment(frag)
-		clMsg, ok = h.cleanUpMap[frag.TransID]
+	if msgInMap, ok := sh.msgMap[frag.TransID]; ok {
+		contiguous := msgInMap.Contiguous()
+		// the fragment wasn't stored so it's done with its buffer
+		switch status = msgInMap.AddFragment(frag); status {
+		case Success:
+			sh.trace(TraceAccepted, frag, frag.TransID, "")
+			if msgInMap.Contiguous() > contiguous {
+				sh.trace(TraceContiguous, frag, frag.TransID, "")
+			}
+		case Duplicate:
+			sh.trace(TraceDuplicate, frag, frag.TransID, "")
+			frag.release()
+		default:
+			sh.trace(TraceRejected, frag, frag.TransID, statusNames[status])
+			frag.release()
+		}
+		clMsg, ok = sh.cleanUpMap[frag.TransID]
 		// this is an anomaly! It should have already been the map
 		if !ok {
-			clMsg = h.addCleanUpMsg(frag.TransID)
+			clMsg = sh.addCleanUpMsg(frag.TransID, deadline)
 		}
 		msg = msgInMap
 	} else { // message trans id didn't exist so add it and set clean up timer
+		// the count is shared by the shards so take a place before checking
+		if n := h.inFlight.Add(1); cfg.maxMsgs > 0 && n > int64(cfg.maxMsgs) {
+			h.inFlight.Add(-1)
+			sh.trace(TraceRejected, frag, frag.TransID, statusNames[TooManyMsgs])
+			frag.release()
+			return TooManyMsgs
+		}
 		msg = NewMsg(frag)
-		h.msgMap[frag.TransID] = msg
-		clMsg = h.addCleanUpMsg(frag.TransID)
+		msg.spillThreshold, msg.spillDir, msg.spillFiles = cfg.spillThreshold, cfg.spillDir, h.spillFiles
+		cfg.metrics.started.Inc()
+		sh.msgMap[frag.TransID] = msg
+		clMsg = sh.addCleanUpMsg(frag.TransID, deadline)
+		sh.trace(TraceFirstFragment, frag, frag.TransID, "")
+		sh.trace(TraceAccepted, frag, frag.TransID, "")
+		if msg.Contiguous() > 0 {
+			sh.trace(TraceContiguous, frag, frag.TransID, "")
+		}
+	}
+	if status == Success {
+		cfg.metrics.bytes.Add(uint64(frag.DataLen))
+	}
+	if status == Success && record && cfg.journal != nil {
+		cfg.journal.fragment(frag, time.Now())
+	}
+	if status == Success && !msg.HasAllFrags() {
+		if err := msg.spill(frag); err != nil && cfg.spillErrCB != nil {
+			cfg.spillErrCB(fmt.Errorf("spilling message %d: %w", frag.TransID, err))
+		}
+		// the fragment waits for the rest of the message, only a fragment
+		// completing it is used in place
+		if !frag.spilled {
+			frag.detach()
+		}
 	}
 
 	if msg.HasAllFrags() {
-		delete(h.msgMap, frag.TransID)
-		delete(h.cleanUpMap, frag.TransID)
-		clMsg.cleanUpTimer.Stop()
-		h.reassembleMsg(msg)
+		sh.remove(frag.TransID)
+		if err := h.reassembleMsg(msg); err != nil {
+			cfg.metrics.failed.Inc()
+			h.traceEnd(TraceFailed, frag.TransID, msg, err.Error())
+		} else {
+			cfg.metrics.completed.Inc()
+			cfg.metrics.latency.ObserveSince(clMsg.started)
+			h.traceEnd(TraceCompleted, frag.TransID, msg, "")
+		}
+		msg.release()
+		if cfg.journal != nil {
+			cfg.journal.done(frag.TransID)
+		}
+	}
+	return status
+}
+
+// MsgInfo describes a message in flight.
+type MsgInfo struct {
+	TransID uint32 `json:"trans_id"`
+	// Started is when the first fragment arrived and Deadline is when the
+	// message expires
+	Started       time.Time `json:"started"`
+	Deadline      time.Time `json:"deadline"`
+	BytesReceived uint32    `json:"bytes_received"`
+	// ExpectedTotal is the message's length, only known once TotalKnown is
+	// set by the end fragment's arrival
+	ExpectedTotal uint32 `json:"expected_total"`
+	TotalKnown    bool   `json:"total_known"`
+	// Contiguous is how many bytes from the start have arrived without a
+	// hole
+	Contiguous uint32 `json:"contiguous"`
+	Fragments  int    `json:"fragments"`
+	// Holes are the offsets where missing data starts
+	Holes []uint32 `json:"holes"`
+}
+
+// Age returns how long the message has been in flight.
+func (i MsgInfo) Age() time.Duration {
+	return time.Since(i.Started)
+}
+
+// info describes a message. sh.lock must be held.
+func (sh *handlerShard) info(transID uint32, m *Msg) MsgInfo {
+	info := MsgInfo{
+		TransID:       transID,
+		BytesReceived: m.BytesReceived(),
+		Contiguous:    m.Contiguous(),
+		Fragments:     m.FragmentCount(),
+		Holes:         m.Holes(),
+	}
+	info.ExpectedTotal, info.TotalKnown = m.ExpectedTotal()
+	if clMsg, ok := sh.cleanUpMap[transID]; ok {
+		info.Started, info.Deadline = clMsg.started, clMsg.deadline
+	}
+	return info
+}
+
+// Messages describes every message in flight, oldest first.
+func (h *MsgHandler) Messages() []MsgInfo {
+	var infos []MsgInfo
+	for _, sh := range *h.shards.Load() {
+		sh.lock.Lock()
+		for transID, m := range sh.msgMap {
+			infos = append(infos, sh.info(transID, m))
+		}
+		sh.lock.Unlock()
+	}
+	sort.Slice(infos, func(a, b int) bool {
+		return infos[a].Started.Before(infos[b].Started)
+	})
+	return infos
+}
+
+// Message describes one message in flight. It returns false if there is no
+// such message.
+func (h *MsgHandler) Message(transID uint32) (MsgInfo, bool) {
+	sh := h.lockShard(transID)
+	defer sh.lock.Unlock()
+	m, ok := sh.msgMap[transID]
+	if !ok {
+		return MsgInfo{}, false
+	}
+	return sh.info(transID, m), true
+}
+
+// Expire removes a message in flight right away, reporting its holes as if
+// its time had run out. It returns false if there is no such message.
+func (h *MsgHandler) Expire(transID uint32) bool {
+	sh := h.lockShard(transID)
+	defer sh.lock.Unlock()
+	m, ok := sh.msgMap[transID]
+	if !ok {
+		return false
+	}
+	sh.expire(transID, m, "expired by admin")
+	return true
+}
+
+// ExtendDeadline gives a message in flight d more time to receive its
+// missing fragments. It returns the new deadline, or false if there is no
+// such message.
+func (h *MsgHandler) ExtendDeadline(transID uint32, d time.Duration) (time.Time, bool) {
+	sh := h.lockShard(transID)
+	defer sh.lock.Unlock()
+	if _, ok := sh.msgMap[transID]; !ok {
+		return time.Time{}, false
+	}
+	old, ok := sh.cleanUpMap[transID]
+	if !ok {
+		return time.Time{}, false
 	}
+	// a fresh clean up makes the old timer a no-op even if it is already
+	// waiting for the lock
+	old.cleanUpTimer.Stop()
+	clMsg := sh.addCleanUpMsg(transID, old.deadline.Add(d))
+	clMsg.started = old.started
+	return clMsg.deadline, true
 }
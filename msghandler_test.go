@@ -1,11 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// inFlightMsg returns the handler's message with the transaction ID, nil if
+// there is none.
+func inFlightMsg(h *MsgHandler, transID uint32) *Msg {
+	sh := h.lockShard(transID)
+	defer sh.lock.Unlock()
+	return sh.msgMap[transID]
+}
+
+// inFlightCleanUp returns the clean up of the handler's message with the
+// transaction ID.
+func inFlightCleanUp(h *MsgHandler, transID uint32) (*cleanUpMsg, bool) {
+	sh := h.lockShard(transID)
+	defer sh.lock.Unlock()
+	c, ok := sh.cleanUpMap[transID]
+	return c, ok
+}
+
 // TestAddMsgFragment tests that the clean up threads remove two messages
 func TestAddMsgFragment(t *testing.T) {
 	cleanedUp := 0
@@ -86,15 +109,190 @@ func TestCleanUpAnomaly(t *testing.T) {
 	h := NewMsgHandler(5000, clFun, nil)
 	f := createValidFrag(false, 1, 0, make([]byte, 100))
 	h.AddFragment(f)
-	h.lock.Lock()
-	c, _ := h.cleanUpMap[1]
+	sh := h.lockShard(1)
+	c, _ := sh.cleanUpMap[1]
 	c.cleanUpTimer.Stop()
-	delete(h.cleanUpMap, 1)
-	h.lock.Unlock()
+	delete(sh.cleanUpMap, 1)
+	sh.lock.Unlock()
 	f = createValidFrag(false, 1, 100, make([]byte, 10))
 	h.AddFragment(f)
 
-	if _, ok := h.cleanUpMap[1]; !ok {
+	if _, ok := inFlightCleanUp(h, 1); !ok {
 		t.Error("clean up msg entry should have been added")
 	}
 }
+
+// TestMaxMessageSize tests that fragments ending past the size limit are
+// rejected.
+func TestMaxMessageSize(t *testing.T) {
+	h := NewMsgHandler(5000, nil, nil)
+	h.SetLimits(0, 100)
+	if s := h.AddFragment(createValidFrag(false, 1, 90, make([]byte, 11))); s != TooLarge {
+		t.Errorf("expected TooLarge, got %d", s)
+	}
+	if s := h.AddFragment(createValidFrag(false, 1, 90, make([]byte, 10))); s != Success {
+		t.Errorf("expected Success, got %d", s)
+	}
+}
+
+// TestMaxMessages tests that new messages are rejected once the limit of
+// messages in flight is reached while existing ones can still grow.
+func TestMaxMessages(t *testing.T) {
+	h := NewMsgHandler(5000, nil, nil)
+	h.SetLimits(1, 0)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	if s := h.AddFragment(createValidFrag(false, 2, 0, make([]byte, 10))); s != TooManyMsgs {
+		t.Errorf("expected TooManyMsgs, got %d", s)
+	}
+	if s := h.AddFragment(createValidFrag(false, 1, 10, make([]byte, 10))); s != Success {
+		t.Errorf("expected Success, got %d", s)
+	}
+	if s := h.AddFragment(createValidFrag(false, 1, 10, make([]byte, 10))); s != Duplicate {
+		t.Errorf("expected Duplicate, got %d", s)
+	}
+}
+
+// TestMaxMessagesShards tests that the limit counts the messages of every
+// shard.
+func TestMaxMessagesShards(t *testing.T) {
+	h := NewMsgHandler(5000, nil, nil)
+	h.setShards(4)
+	h.SetLimits(2, 0)
+	defer h.Flush(FlushDiscard)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 2, 0, make([]byte, 10)))
+	if s := h.AddFragment(createValidFrag(false, 3, 0, make([]byte, 10))); s != TooManyMsgs {
+		t.Errorf("expected TooManyMsgs, got %d", s)
+	}
+}
+
+// TestSetOutput tests that reassembled messages are reported to the output.
+func TestSetOutput(t *testing.T) {
+	b := &bytes.Buffer{}
+	h := NewMsgHandler(5000, nil, nil)
+	h.SetOutput(b)
+	h.AddFragment(createValidFrag(true, 1, 0, make([]byte, 100)))
+	if !strings.Contains(b.String(), `msg="message reassembled" trans_id=1 length=100 sha256=`) {
+		t.Errorf("unexpected output %q", b.String())
+	}
+}
+
+// TestFlushHoles tests that Flush removes the incomplete messages, reports
+// their holes and stops their clean up timers.
+func TestFlushHoles(t *testing.T) {
+	holes := 0
+	h := NewMsgHandler(10, func(transID, off uint32) {
+		holes++
+	}, nil)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 1, 20, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 2, 0, make([]byte, 5)))
+	sum := h.Flush(FlushHoles)
+	if sum.Messages != 2 || sum.Fragments != 3 || sum.Bytes != 25 {
+		t.Errorf("unexpected summary %+v", sum)
+	}
+	if holes != 3 {
+		t.Errorf("expected 3 holes, got %d", holes)
+	}
+	if h.inFlight.Load() != 0 || inFlightMsg(h, 1) != nil {
+		t.Error("all messages should have been removed")
+	}
+	// the clean up timers would report the holes again if they fired
+	time.Sleep(20 * time.Millisecond)
+	if holes != 3 {
+		t.Errorf("clean up timers should have been stopped, got %d holes", holes)
+	}
+}
+
+// TestFlushPartial tests that the partial policy reports the data received.
+func TestFlushPartial(t *testing.T) {
+	b := &bytes.Buffer{}
+	h := NewMsgHandler(5000, func(transID, off uint32) {
+		t.Error("holes shouldn't be reported")
+	}, nil)
+	h.SetOutput(b)
+	data := make([]byte, 10)
+	h.AddFragment(createValidFrag(false, 1, 0, data))
+	h.Flush(FlushPartial)
+	shaHash := sha256.New()
+	shaHash.Write(data)
+	exp := `msg="message partial" trans_id=1 length=10 sha256=` +
+		hex.EncodeToString(shaHash.Sum(nil)) + " reason=shutdown\n"
+	if !strings.HasSuffix(b.String(), exp) {
+		t.Errorf("expected %q, got %q", exp, b.String())
+	}
+}
+
+// TestFlushDiscard tests that the discard policy reports nothing.
+func TestFlushDiscard(t *testing.T) {
+	b := &bytes.Buffer{}
+	h := NewMsgHandler(5000, func(transID, off uint32) {
+		t.Error("holes shouldn't be reported")
+	}, nil)
+	h.SetOutput(b)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	if sum := h.Flush(FlushDiscard); sum.Messages != 1 {
+		t.Errorf("expected 1 message to be discarded, got %d", sum.Messages)
+	}
+	if b.Len() != 0 {
+		t.Errorf("nothing should have been reported, got %q", b.String())
+	}
+}
+
+// TestSetShards tests that the messages in flight move to the shard of their
+// transaction ID and can still be completed there.
+func TestSetShards(t *testing.T) {
+	rebuilt := 0
+	h := NewMsgHandler(60000, nil, func(transID uint32, sha string) {
+		rebuilt++
+	})
+	h.SetOutput(ioutil.Discard)
+	for id := uint32(0); id < 8; id++ {
+		h.AddFragment(createValidFrag(false, id, 0, make([]byte, 10)))
+	}
+	h.setShards(4)
+	for i, sh := range *h.shards.Load() {
+		if len(sh.msgMap) != 2 || len(sh.cleanUpMap) != 2 {
+			t.Errorf("expected 2 messages in shard %d, got %d", i, len(sh.msgMap))
+		}
+		for transID := range sh.msgMap {
+			if transID%4 != uint32(i) {
+				t.Errorf("message %d shouldn't be in shard %d", transID, i)
+			}
+		}
+	}
+	for id := uint32(0); id < 8; id++ {
+		h.AddFragment(createValidFrag(true, id, 10, make([]byte, 10)))
+	}
+	if rebuilt != 8 || h.inFlight.Load() != 0 {
+		t.Errorf("expected 8 messages rebuilt and none left, got %d and %d", rebuilt, h.inFlight.Load())
+	}
+}
+
+// TestSetShardsConcurrent tests that fragments added while the shards change
+// still complete their messages.
+func TestSetShardsConcurrent(t *testing.T) {
+	var rebuilt atomic.Int64
+	h := NewMsgHandler(60000, nil, func(transID uint32, sha string) {
+		rebuilt.Add(1)
+	})
+	h.SetOutput(ioutil.Discard)
+	var wg sync.WaitGroup
+	for w := uint32(0); w < 4; w++ {
+		wg.Add(1)
+		go func(w uint32) {
+			defer wg.Done()
+			for id := w; id < 400; id += 4 {
+				h.AddFragment(createValidFrag(false, id, 0, make([]byte, 10)))
+				h.AddFragment(createValidFrag(true, id, 10, make([]byte, 10)))
+			}
+		}(w)
+	}
+	for n := 1; n <= 8; n++ {
+		h.setShards(n%4 + 1)
+	}
+	wg.Wait()
+	if n := rebuilt.Load(); n != 400 || h.inFlight.Load() != 0 {
+		t.Errorf("expected 400 messages rebuilt and none left, got %d and %d", n, h.inFlight.Load())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MulticastConfig describes a listener that receives fragments sent to one
+// or more multicast groups.
+type MulticastConfig struct {
+	// Groups are the IPv4 and IPv6 multicast groups to join.
+	Groups []net.IP
+	// Port is the UDP port the fragments are sent to.
+	Port int
+	// Interface is the name of the interface to join the groups on. The
+	// system picks one when it is empty.
+	Interface string
+	// Sources are the only senders accepted when it isn't empty. Datagrams
+	// from any other address are dropped and counted as filtered.
+	Sources []net.IP
+}
+
+// multicastAddr is the address the stats for a multicast listener are
+// reported under.
+type multicastAddr struct {
+	groups []net.IP
+	port   int
+}
+
+func (a *multicastAddr) Network() string {
+	return "udp"
+}
+
+func (a *multicastAddr) String() string {
+	addrs := make([]string, len(a.groups))
+	for i, g := range a.groups {
+		addrs[i] = net.JoinHostPort(g.String(), strconv.Itoa(a.port))
+	}
+	return strings.Join(addrs, ",")
+}
+
+// sourceAllowed checks a datagram's source against a list of allowed
+// senders. An empty list allows everyone.
+func sourceAllowed(sources []net.IP, src net.Addr) bool {
+	if len(sources) == 0 {
+		return true
+	}
+	udpAddr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, ip := range sources {
+		if ip.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenMulticast opens the sockets for every multicast listener. IPv4 and
+// IPv6 groups can't share a socket so each listener gets up to one socket
+// per family, both counted under the same stats.
+func (s *Server) listenMulticast() error {
+	for _, mc := range s.cfg.Multicast {
+		var ifi *net.Interface
+		if mc.Interface != "" {
+			var err error
+			if ifi, err = net.InterfaceByName(mc.Interface); err != nil {
+				return err
+			}
+		}
+		var v4, v6 []net.IP
+		for _, g := range mc.Groups {
+			if g.To4() != nil {
+				v4 = append(v4, g)
+			} else {
+				v6 = append(v6, g)
+			}
+		}
+		stats := newListenerStats("udp", &multicastAddr{groups: mc.Groups, port: mc.Port})
+		s.stats = append(s.stats, stats)
+		for _, fam := range []struct {
+			network string
+			groups  []net.IP
+		}{{"udp4", v4}, {"udp6", v6}} {
+			if len(fam.groups) == 0 {
+				continue
+			}
+			conn, err := s.netPack.ListenMulticastUDP(fam.network, ifi, fam.groups, mc.Port)
+			if err != nil {
+				return err
+			}
+			s.sockets = append(s.sockets, udpSocket{conn: conn, stats: stats, sources: mc.Sources})
+		}
+	}
+	return nil
+}
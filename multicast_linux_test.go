@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// multicastSender opens a socket bound to ip that sends multicast datagrams
+// out of lo, skipping the test if it can't.
+func multicastSender(t *testing.T, lo *net.Interface, ip net.IP) *net.UDPConn {
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	raw, _ := sender.SyscallConn()
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF,
+			&syscall.IPMreqn{Ifindex: int32(lo.Index)})
+	})
+	if err != nil {
+		sender.Close()
+		t.Skipf("can't send multicast on loopback: %v", err)
+	}
+	return sender
+}
+
+// TestMulticastLoopback tests receiving a message sent to a multicast group
+// on the loopback interface.
+func TestMulticastLoopback(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	group := net.ParseIP("239.7.7.7")
+	rebuilt := make(chan uint32, 1)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		rebuilt <- transID
+	})
+	s := NewServerFromConfig(ServerConfig{
+		Multicast: []MulticastConfig{{
+			Groups:    []net.IP{group, net.ParseIP("239.7.7.8")},
+			Interface: "lo",
+		}},
+		ReadWait: 10 * time.Millisecond,
+	}, &NetImp{}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Skipf("can't join multicast groups on loopback: %v", err)
+	}
+	defer s.Stop()
+	port := s.sockets[0].conn.LocalAddr().(*net.UDPAddr).Port
+
+	sender := multicastSender(t, lo, net.IPv4(127, 0, 0, 1))
+	defer sender.Close()
+	data, _ := ioutil.ReadAll(createFrag(true, 9, 0, make([]byte, 10), false))
+	if _, err = sender.WriteTo(data, &net.UDPAddr{IP: group, Port: port}); err != nil {
+		t.Skipf("can't send multicast on loopback: %v", err)
+	}
+	select {
+	case transID := <-rebuilt:
+		if transID != 9 {
+			t.Errorf("expected trans ID 9 to be rebuilt, got %d", transID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("multicast message was never received")
+	}
+}
+
+// TestMulticastLoopbackSecondGroup tests that a group other than the first
+// is joined too and that its datagrams go through the source filter.
+func TestMulticastLoopbackSecondGroup(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	group := net.ParseIP("239.7.7.10")
+	rebuilt := make(chan uint32, 2)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		rebuilt <- transID
+	})
+	h.SetOutput(ioutil.Discard)
+	s := NewServerFromConfig(ServerConfig{
+		Multicast: []MulticastConfig{{
+			Groups:    []net.IP{net.ParseIP("239.7.7.9"), group},
+			Interface: "lo",
+			Sources:   []net.IP{net.IPv4(127, 0, 0, 1)},
+		}},
+		ReadWait: 10 * time.Millisecond,
+	}, &NetImp{}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Skipf("can't join multicast groups on loopback: %v", err)
+	}
+	defer s.Stop()
+	dst := &net.UDPAddr{IP: group, Port: s.sockets[0].conn.LocalAddr().(*net.UDPAddr).Port}
+
+	filtered := multicastSender(t, lo, net.IPv4(127, 0, 0, 2))
+	defer filtered.Close()
+	allowed := multicastSender(t, lo, net.IPv4(127, 0, 0, 1))
+	defer allowed.Close()
+	data, _ := ioutil.ReadAll(createFrag(true, 10, 0, make([]byte, 10), false))
+	if _, err = filtered.WriteTo(data, dst); err != nil {
+		t.Skipf("can't send multicast on loopback: %v", err)
+	}
+	data, _ = ioutil.ReadAll(createFrag(true, 11, 0, make([]byte, 10), false))
+	if _, err = allowed.WriteTo(data, dst); err != nil {
+		t.Skipf("can't send multicast on loopback: %v", err)
+	}
+	select {
+	case transID := <-rebuilt:
+		if transID != 11 {
+			t.Errorf("expected trans ID 11 to be rebuilt, got %d", transID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("multicast message to the second group was never received")
+	}
+	for deadline := time.Now().Add(time.Second); s.ListenerStats()[0].Filtered == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the datagram from the other source to be filtered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(rebuilt) != 0 {
+		t.Error("the filtered datagram shouldn't be reassembled")
+	}
+}
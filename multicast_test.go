@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSourceAllowed tests the multicast source filter.
+func TestSourceAllowed(t *testing.T) {
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	if !sourceAllowed(nil, src) {
+		t.Error("an empty source list should allow everyone")
+	}
+	if !sourceAllowed([]net.IP{net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 1)}, src) {
+		t.Error("source should have been allowed")
+	}
+	if sourceAllowed([]net.IP{net.IPv4(10, 0, 0, 2)}, src) {
+		t.Error("source shouldn't have been allowed")
+	}
+}
+
+// TestMulticastFamilies tests that IPv4 and IPv6 groups are joined on
+// separate sockets that share the listener's stats.
+func TestMulticastFamilies(t *testing.T) {
+	n := &FakeNet{conn: createFakeConn(nil)}
+	s := NewServerFromConfig(ServerConfig{
+		Multicast: []MulticastConfig{{
+			Groups: []net.IP{net.ParseIP("239.1.1.1"), net.ParseIP("ff05::1"), net.ParseIP("239.1.1.2")},
+			Port:   6789,
+		}},
+	}, n, nil)
+	if err := s.listenMulticast(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(n.multicastJoins) != 2 || len(n.multicastJoins[0]) != 2 || len(n.multicastJoins[1]) != 1 {
+		t.Errorf("expected an IPv4 socket with 2 groups and an IPv6 socket with 1, got %v", n.multicastJoins)
+	}
+	if len(s.sockets) != 2 || s.sockets[0].stats != s.sockets[1].stats {
+		t.Error("both sockets should share the listener's stats")
+	}
+	exp := "239.1.1.1:6789,[ff05::1]:6789,239.1.1.2:6789"
+	if addr := s.ListenerStats()[0].Address; addr != exp {
+		t.Errorf("expected address %s, got %s", exp, addr)
+	}
+}
+
+// TestMulticastSourceFilter tests that datagrams from senders that aren't
+// allowed are counted and never reach the MsgHandler.
+func TestMulticastSourceFilter(t *testing.T) {
+	data, _ := ioutil.ReadAll(createFrag(true, 1, 0, make([]byte, 10), false))
+	conn := createFakeConn(data)
+	conn.src = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		t.Error("filtered datagrams shouldn't be reassembled")
+	})
+	s := NewServerFromConfig(ServerConfig{
+		Multicast: []MulticastConfig{{
+			Groups:  []net.IP{net.ParseIP("239.1.1.1")},
+			Sources: []net.IP{net.IPv4(10, 0, 0, 2)},
+		}},
+		ReadWait: time.Millisecond,
+	}, &FakeNet{conn: conn}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for s.ListenerStats()[0].Filtered == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+}
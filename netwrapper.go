@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"time"
@@ -10,6 +12,15 @@ import (
 // tests
 type NetWrapper interface {
 	ListenUDP(network string, address *net.UDPAddr) (Conn, error)
+	// ListenUDPReusePort is the same as ListenUDP except the socket is
+	// opened with SO_REUSEPORT so several sockets can bind the same address
+	ListenUDPReusePort(network string, address *net.UDPAddr) (Conn, error)
+	// ListenMulticastUDP opens a socket receiving port on the interface for
+	// every group in groups, which must all be IPv4 or all IPv6. A nil
+	// interface lets the system pick one.
+	ListenMulticastUDP(network string, ifi *net.Interface, groups []net.IP, port int) (Conn, error)
+	// Listen opens a stream listener, network is "tcp" or "unix"
+	Listen(network, address string) (net.Listener, error)
 }
 
 // Conn wraps the necessary interface for this server's calls to
@@ -19,7 +30,29 @@ type NetWrapper interface {
 type Conn interface {
 	io.Reader
 	io.Closer
+	// ReadFrom reads a datagram like Read and also returns who sent it
+	ReadFrom(p []byte) (n int, addr net.Addr, err error)
 	SetReadDeadline(t time.Time) error
+	LocalAddr() net.Addr
+}
+
+// batchSource is a Conn that can read many datagrams per system call. Each
+// reader of the Conn gets a batchReader of its own so they don't share any
+// state.
+type batchSource interface {
+	newBatchReader() batchReader
+}
+
+// batchReader reads datagrams a batch at a time straight into the caller's
+// buffers.
+type batchReader interface {
+	// readBatch reads up to len(ps) datagrams, the i-th into ps[i], and
+	// returns how many it read, filling in each one's length in ns and
+	// source in addrs. It blocks until at least one datagram arrives or the
+	// read deadline passes.
+	readBatch(ps [][]byte, ns []int, addrs []net.Addr) (int, error)
+	// size is the most datagrams readBatch reads at once
+	size() int
 }
 
 // ConnImp actually holds a reference to the UDPConn structure that's
@@ -33,6 +66,11 @@ func (c *ConnImp) Read(p []byte) (n int, err error) {
 	return c.conn.Read(p)
 }
 
+// ReadFrom passes the call to the UDPConn's ReadFrom method.
+func (c *ConnImp) ReadFrom(p []byte) (int, net.Addr, error) {
+	return c.conn.ReadFrom(p)
+}
+
 // Close passes the call to the underlying UDPConn's Close method.
 func (c *ConnImp) Close() error {
 	return c.conn.Close()
@@ -43,15 +81,80 @@ func (c *ConnImp) SetReadDeadline(t time.Time) error {
 	return c.conn.SetReadDeadline(t)
 }
 
+// LocalAddr returns the UDPConn's local address.
+func (c *ConnImp) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
 // NetImp is the wrapped implementation for the NetWrapper interface
 type NetImp struct {
+	// BatchSize is the number of datagrams read per system call. Values
+	// above 1 use recvmmsg on Linux, other platforms always read one
+	// datagram at a time.
+	BatchSize int
+	// ReadBuffer sets the size of each UDP socket's receive buffer, 0
+	// leaves the system default. The system may cap it.
+	ReadBuffer int
 }
 
-// ListenUDP embeds the returned UDPConn in a ConnImp struct
+// ListenUDP embeds the returned UDPConn in a ConnImp struct, or a batching
+// Conn when BatchSize is above 1.
 func (n *NetImp) ListenUDP(network string, address *net.UDPAddr) (Conn, error) {
 	c, err := net.ListenUDP(network, address)
 	if err != nil {
 		return nil, err
 	}
+	return n.wrapUDP(c)
+}
+
+// ListenUDPReusePort sets SO_REUSEPORT on the socket before binding it. It
+// returns an error on platforms that don't support SO_REUSEPORT.
+func (n *NetImp) ListenUDPReusePort(network string, address *net.UDPAddr) (Conn, error) {
+	lc := &net.ListenConfig{Control: setReusePort}
+	pc, err := lc.ListenPacket(context.Background(), network, address.String())
+	if err != nil {
+		return nil, err
+	}
+	return n.wrapUDP(pc.(*net.UDPConn))
+}
+
+// Listen passes the call to net.Listen.
+func (n *NetImp) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+// ListenMulticastUDP joins the first group with net.ListenMulticastUDP and
+// the rest on the same socket. Joining more than one group is only supported
+// on Linux.
+func (n *NetImp) ListenMulticastUDP(network string, ifi *net.Interface, groups []net.IP, port int) (Conn, error) {
+	if len(groups) == 0 {
+		return nil, errors.New("no multicast groups to join")
+	}
+	c, err := net.ListenMulticastUDP(network, ifi, &net.UDPAddr{IP: groups[0], Port: port})
+	if err != nil {
+		return nil, err
+	}
+	if err = joinGroups(c, ifi, groups[1:]); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return n.wrapUDP(c)
+}
+
+func (n *NetImp) wrapUDP(c *net.UDPConn) (Conn, error) {
+	if n.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(n.ReadBuffer); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if n.BatchSize > 1 {
+		bc, err := newBatchConn(c, n.BatchSize)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return bc, nil
+	}
 	return &ConnImp{conn: c}, nil
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options the syscall package doesn't define for every architecture.
+// soReusePort differs between architectures so it is defined in
+// reuseport_linux.go and reuseport_linux_mipsx.go.
+const (
+	// ipMulticastAll is IP_MULTICAST_ALL from <linux/in.h>
+	ipMulticastAll = 0x31
+	// ipv6MulticastAll is IPV6_MULTICAST_ALL from <linux/in6.h>
+	ipv6MulticastAll = 0x1d
+)
+
+// setReusePort is a net.ListenConfig Control function that sets
+// SO_REUSEPORT on the socket before it is bound.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// joinGroups joins the extra multicast groups on c. It also turns off
+// IP_MULTICAST_ALL so c only receives the groups joined on it rather than
+// every group joined on the host for the same port.
+func joinGroups(c *net.UDPConn, ifi *net.Interface, groups []net.IP) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ifIndex := 0
+	if ifi != nil {
+		ifIndex = ifi.Index
+	}
+	v6 := c.LocalAddr().(*net.UDPAddr).IP.To4() == nil
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if v6 {
+			// IPV6_MULTICAST_ALL needs Linux 4.20 so failing to set it
+			// isn't fatal
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6MulticastAll, 0)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipMulticastAll, 0)
+		}
+		for _, g := range groups {
+			if sockErr != nil {
+				return
+			}
+			if ip4 := g.To4(); ip4 != nil && !v6 {
+				mreq := &syscall.IPMreqn{Ifindex: int32(ifIndex)}
+				copy(mreq.Multiaddr[:], ip4)
+				sockErr = syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+			} else {
+				mreq := &syscall.IPv6Mreq{Interface: uint32(ifIndex)}
+				copy(mreq.Multiaddr[:], g.To16())
+				sockErr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// sockaddrToUDP converts the source address filled in by recvmmsg.
+func sockaddrToUDP(rsa *syscall.RawSockaddrAny) net.Addr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	}
+	return nil
+}
+
+// mmsghdr mirrors struct mmsghdr from <sys/socket.h>. Go pads the struct to
+// the same size the kernel expects.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// batchConn is a Conn whose readers can read many datagrams per system call
+// with recvmmsg. Read and ReadFrom read one datagram at a time like a
+// UDPConn, the batches are read through the batchReaders it hands out.
+type batchConn struct {
+	ConnImp
+	raw       syscall.RawConn
+	batchSize int
+}
+
+// newBatchConn wraps conn so up to batchSize datagrams are read per system
+// call.
+func newBatchConn(conn *net.UDPConn, batchSize int) (Conn, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	return &batchConn{ConnImp: ConnImp{conn: conn}, raw: raw, batchSize: batchSize}, nil
+}
+
+// newBatchReader returns the recvmmsg state for one reader of the socket.
+func (c *batchConn) newBatchReader() batchReader {
+	r := &mmsgReader{
+		raw:   c.raw,
+		iovs:  make([]syscall.Iovec, c.batchSize),
+		names: make([]syscall.RawSockaddrAny, c.batchSize),
+		msgs:  make([]mmsghdr, c.batchSize),
+	}
+	for i := range r.msgs {
+		r.msgs[i].hdr.Iov = &r.iovs[i]
+		r.msgs[i].hdr.Iovlen = 1
+		r.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&r.names[i]))
+	}
+	return r
+}
+
+// mmsgReader is one reader's recvmmsg state. Its iovecs are pointed at the
+// caller's buffers for each call, so the datagrams land where the caller
+// wants them without being copied.
+type mmsgReader struct {
+	raw   syscall.RawConn
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+	msgs  []mmsghdr
+}
+
+func (r *mmsgReader) size() int {
+	return len(r.msgs)
+}
+
+// readBatch reads as many datagrams as the socket has waiting, up to
+// len(ps).
+func (r *mmsgReader) readBatch(ps [][]byte, ns []int, addrs []net.Addr) (int, error) {
+	msgs := r.msgs[:len(ps)]
+	for i, p := range ps {
+		r.iovs[i].Base = &p[0]
+		r.iovs[i].SetLen(len(p))
+		// the kernel overwrites the address lengths with what it filled in
+		msgs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+	}
+	// don't keep the caller's buffers from being collected
+	defer func() {
+		for i := range ps {
+			r.iovs[i].Base = nil
+		}
+	}()
+	var n int
+	var errno syscall.Errno
+	err := r.raw.Read(func(fd uintptr) bool {
+		ret, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)),
+			syscall.MSG_DONTWAIT, 0, 0)
+		if e == syscall.EAGAIN {
+			// tell the poller to wait for the socket to be readable
+			return false
+		}
+		n, errno = int(ret), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, &net.OpError{Op: "recvmmsg", Net: "udp", Err: errno}
+	}
+	for i := 0; i < n; i++ {
+		ns[i] = int(msgs[i].len)
+		addrs[i] = sockaddrToUDP(&r.names[i])
+	}
+	return n, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestBatchConnRead tests that a batch reader puts every datagram straight
+// into the caller's buffers in the order it was sent and times out once the
+// socket is empty.
+func TestBatchConnRead(t *testing.T) {
+	n := &NetImp{BatchSize: 4}
+	conn, err := n.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer conn.Close()
+	bc, ok := conn.(*batchConn)
+	if !ok {
+		t.Fatal("expected a batching Conn")
+	}
+	sender, err := net.DialUDP("udp", nil, bc.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer sender.Close()
+	for i := 0; i < 10; i++ {
+		sender.Write(bytes.Repeat([]byte{byte(i)}, i+1))
+	}
+
+	br := bc.newBatchReader()
+	if br.size() != 4 {
+		t.Fatalf("expected batches of 4, got %d", br.size())
+	}
+	buf := make([]byte, 4*100)
+	ps := [][]byte{buf[0:100], buf[100:200], buf[200:300], buf[300:400]}
+	ns := make([]int, 4)
+	srcs := make([]net.Addr, 4)
+	for i := 0; i < 10; {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		got, err := br.readBatch(ps, ns, srcs)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		for j := 0; j < got; j, i = j+1, i+1 {
+			if srcs[j].String() != sender.LocalAddr().String() {
+				t.Errorf("expected source %v, got %v", sender.LocalAddr(), srcs[j])
+			}
+			if !bytes.Equal(buf[j*100:j*100+ns[j]], bytes.Repeat([]byte{byte(i)}, i+1)) {
+				t.Errorf("expected datagram %d in slot %d, got %v", i, j, buf[j*100:j*100+ns[j]])
+			}
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err = br.readBatch(ps, ns, srcs)
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	// reading one datagram at a time still works
+	sender.Write([]byte("one"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "one" {
+		t.Errorf("unexpected read %q %v", buf[:n], err)
+	}
+}
+
+// TestServerBatchRead tests that the server reassembles messages read in
+// batches by several readers of one socket.
+func TestServerBatchRead(t *testing.T) {
+	const msgs = 50
+	shas := make(chan string, msgs)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		shas <- fmt.Sprintf("%d %s", transID, sha)
+	})
+	h.SetOutput(ioutil.Discard)
+	s := NewServerFromConfig(ServerConfig{
+		Addresses:  []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1)}},
+		NumReaders: 2,
+		ReadWait:   10 * time.Millisecond,
+	}, &NetImp{BatchSize: 8}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	sender, err := net.DialUDP("udp", nil, s.sockets[0].conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer sender.Close()
+	expected := make(map[string]bool)
+	for i := uint32(0); i < msgs; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 100+int(i))
+		sum := sha256.Sum256(msg)
+		expected[fmt.Sprintf("%d %s", i, hex.EncodeToString(sum[:]))] = true
+		first, _ := ioutil.ReadAll(createFrag(false, i, 0, msg[:50], false))
+		last, _ := ioutil.ReadAll(createFrag(true, i, 50, msg[50:], false))
+		sender.Write(first)
+		sender.Write(last)
+	}
+	for i := 0; i < msgs; i++ {
+		select {
+		case got := <-shas:
+			if !expected[got] {
+				t.Errorf("unexpected message %s", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d messages were reassembled", i, msgs)
+		}
+	}
+}
+
+// TestListenUDPReusePort tests that two sockets can be bound to the same
+// address with SO_REUSEPORT.
+func TestListenUDPReusePort(t *testing.T) {
+	n := &NetImp{}
+	first, err := n.ListenUDPReusePort("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer first.Close()
+	second, err := n.ListenUDPReusePort("udp", first.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("second listen on the same address failed: %v", err)
+	}
+	second.Close()
+}
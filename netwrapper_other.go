@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setReusePort reports that SO_REUSEPORT sockets aren't supported on this
+// platform.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
+
+// joinGroups only supports the single group net.ListenMulticastUDP joins.
+func joinGroups(c *net.UDPConn, ifi *net.Interface, groups []net.IP) error {
+	if len(groups) > 0 {
+		return errors.New("joining several multicast groups on one socket is not supported on this platform")
+	}
+	return nil
+}
+
+// newBatchConn falls back to reading a datagram per system call on platforms
+// without recvmmsg.
+func newBatchConn(conn *net.UDPConn, batchSize int) (Conn, error) {
+	return &ConnImp{conn: conn}, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reorderWait is how long the proxy holds a datagram back for reordering
+// when no other datagram comes after it.
+const reorderWait = 50 * time.Millisecond
+
+// Proxy forwards the datagrams it receives to a target through an
+// impairment, to see how the assembler copes with a bad network.
+type Proxy struct {
+	in  *net.UDPConn
+	out net.Conn
+	im  *impairer
+	// pending are the delayed datagrams not yet forwarded. lock keeps
+	// new ones from being added once the proxy is closed.
+	pending sync.WaitGroup
+	lock    sync.Mutex
+	closed  bool
+	// closeOnce makes every Close wait for the first one to finish
+	closeOnce sync.Once
+	closeErr  error
+	// sendErrors counts the datagrams the target couldn't be sent
+	sendErrors atomic.Uint64
+}
+
+// NewProxy listens for datagrams on the UDP address listen and forwards
+// them to target with the impairment applied. seed makes the impairment
+// repeatable for the same datagrams.
+func NewProxy(listen, target string, imp Impairment, seed int64) (*Proxy, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	in, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	out, err := net.Dial("udp", target)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &Proxy{in: in, out: out, im: newImpairer(imp, seed)}, nil
+}
+
+// Addr returns the address the proxy receives on.
+func (p *Proxy) Addr() net.Addr {
+	return p.in.LocalAddr()
+}
+
+// Stats returns what the impairment did so far.
+func (p *Proxy) Stats() ImpairmentStats {
+	return p.im.snapshot()
+}
+
+// SendErrors returns how many datagrams failed to be sent to the target,
+// like when nothing is listening there.
+func (p *Proxy) SendErrors() uint64 {
+	return p.sendErrors.Load()
+}
+
+// send writes a datagram to the target, counting the failures.
+func (p *Proxy) send(data []byte) {
+	if _, err := p.out.Write(data); err != nil {
+		p.sendErrors.Add(1)
+	}
+}
+
+// Serve forwards datagrams until Close is called. It returns nil once the
+// proxy is closed or the error that stopped it.
+func (p *Proxy) Serve() error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		p.in.SetReadDeadline(time.Now().Add(reorderWait))
+		n, err := p.in.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				p.forward(p.im.release())
+				continue
+			}
+			return err
+		}
+		p.forward(p.im.impair(packet{data: append([]byte(nil), buf[:n]...)}))
+	}
+}
+
+// forward sends the datagrams to the target after the impairment's delay.
+func (p *Proxy) forward(ps []packet) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return
+	}
+	for _, pkt := range ps {
+		d := p.im.delay()
+		if d == 0 {
+			p.send(pkt.data)
+			continue
+		}
+		p.pending.Add(1)
+		data := pkt.data
+		time.AfterFunc(d, func() {
+			defer p.pending.Done()
+			p.send(data)
+		})
+	}
+}
+
+// Close stops receiving, waits for the delayed datagrams to be forwarded
+// and closes the proxy. Calling it again waits for the first call to finish.
+func (p *Proxy) Close() error {
+	p.closeOnce.Do(func() {
+		p.lock.Lock()
+		p.closed = true
+		p.lock.Unlock()
+		p.closeErr = p.in.Close()
+		p.pending.Wait()
+		p.out.Close()
+	})
+	return p.closeErr
+}
+
+// runProxy is the proxy subcommand. It forwards datagrams through an
+// impairment until SIGINT or SIGTERM and returns the exit status.
+func runProxy(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("msg-assembler proxy", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	listen := fs.String("listen", "127.0.0.1:6788", "UDP `address` to receive fragments on")
+	target := fs.String("target", "127.0.0.1:6789", "UDP `address` of the assembler")
+	impair := fs.String("impair", "wan", "impairment `profile` or settings, like \"wan,loss=0.1\" or \"loss=0.05,delay=10ms\"")
+	seed := fs.Int64("seed", 1, "random seed, the same seed impairs the same datagrams the same way")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	logger := slog.New(slog.NewTextHandler(stderr, nil))
+	imp, err := ParseImpairment(*impair)
+	if err != nil {
+		logger.Error("invalid arguments", "err", err)
+		return 2
+	}
+	p, err := NewProxy(*listen, *target, imp, *seed)
+	if err != nil {
+		logger.Error("starting proxy", "err", err)
+		return 1
+	}
+	logger.Info("proxying", "listen", p.Addr().String(), "target", *target,
+		"impairment", fmt.Sprintf("%+v", imp), "seed", *seed)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		<-sigs
+		p.Close()
+	}()
+	err = p.Serve()
+	// Serve returns as soon as a signal closes the proxy, wait for the
+	// delayed datagrams to go out before counting them
+	p.Close()
+	if err != nil {
+		logger.Error("proxying", "err", err)
+		return 1
+	}
+	st := p.Stats()
+	slog.New(slog.NewTextHandler(stdout, nil)).Info("proxy stopped", "datagrams", st.Datagrams,
+		"lost", st.Lost, "duplicated", st.Duplicated, "reordered", st.Reordered, "corrupted", st.Corrupted,
+		"send_errors", p.SendErrors())
+	return 0
+}
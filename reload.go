@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// sinkWriter reports to the currently open sinks. The sinks can be swapped
+// while messages are being reported.
+type sinkWriter struct {
+	lock  sync.Mutex
+	w     io.Writer
+	close func()
+}
+
+func newSinkWriter(w io.Writer, close func()) *sinkWriter {
+	return &sinkWriter{w: w, close: close}
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.w.Write(p)
+}
+
+// swap replaces the sinks and closes the old ones.
+func (s *sinkWriter) swap(w io.Writer, close func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.close()
+	s.w, s.close = w, close
+}
+
+// Close closes the current sinks.
+func (s *sinkWriter) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.close()
+}
+
+// assembler is a running server together with the config it is running
+// with, so the config can be reloaded.
+type assembler struct {
+	// args is the command line the config is read from again on reload
+	args    []string
+	cfg     *Config
+	server  *Server
+	handler *MsgHandler
+	sinks   *sinkWriter
+	level   *slog.LevelVar
+	logger  *slog.Logger
+}
+
+// reload reads the command line and config file again and applies the
+// settings that can change while the server is running: the timeout, the
+// limits, spilling to disk, the sinks, the log level, the number of workers,
+// the shutdown policy and the error policy. Every change is logged. Other
+// settings need a restart, changes to them are logged and ignored. If the new
+// config is invalid nothing changes and the error is returned.
+func (a *assembler) reload() error {
+	cfg, _, err := ParseArgs(a.args, io.Discard)
+	if err != nil {
+		return err
+	}
+	// the new sinks are opened first so one that can't be opened rejects the
+	// whole reload
+	sinksChanged := fmt.Sprint(cfg.Sinks) != fmt.Sprint(a.cfg.Sinks)
+	var out io.Writer
+	var closeSinks func()
+	if sinksChanged {
+		if out, closeSinks, err = openSinks(cfg.Sinks); err != nil {
+			return err
+		}
+	}
+
+	next := *a.cfg
+	changes := 0
+	changed := func(field string, old, new interface{}) {
+		changes++
+		a.logger.Info("config changed", "field", field, "old", old, "new", new)
+	}
+	if cfg.Workers != next.Workers || cfg.Limits.QueueSize != next.Limits.QueueSize {
+		if err = a.server.SetWorkers(cfg.Workers, cfg.Limits.QueueSize); err != nil {
+			if sinksChanged {
+				closeSinks()
+			}
+			return err
+		}
+		if cfg.Workers != next.Workers {
+			changed("workers", next.Workers, cfg.Workers)
+		}
+		if cfg.Limits.QueueSize != next.Limits.QueueSize {
+			changed("limits.queue_size", next.Limits.QueueSize, cfg.Limits.QueueSize)
+		}
+		next.Workers, next.Limits.QueueSize = cfg.Workers, cfg.Limits.QueueSize
+	}
+	if sinksChanged {
+		a.sinks.swap(out, closeSinks)
+		changed("sinks", next.Sinks, cfg.Sinks)
+		next.Sinks = cfg.Sinks
+	}
+	if cfg.Timeout != next.Timeout {
+		a.handler.SetCleanUpWait(int(cfg.TimeoutDuration() / time.Millisecond))
+		changed("timeout", next.Timeout, cfg.Timeout)
+		next.Timeout = cfg.Timeout
+	}
+	if cfg.Limits.MaxMessages != next.Limits.MaxMessages ||
+		cfg.Limits.MaxMessageSize != next.Limits.MaxMessageSize {
+		a.handler.SetLimits(cfg.Limits.MaxMessages, cfg.Limits.MaxMessageSize)
+		if cfg.Limits.MaxMessages != next.Limits.MaxMessages {
+			changed("limits.max_messages", next.Limits.MaxMessages, cfg.Limits.MaxMessages)
+		}
+		if cfg.Limits.MaxMessageSize != next.Limits.MaxMessageSize {
+			changed("limits.max_message_size", next.Limits.MaxMessageSize, cfg.Limits.MaxMessageSize)
+		}
+		next.Limits.MaxMessages = cfg.Limits.MaxMessages
+		next.Limits.MaxMessageSize = cfg.Limits.MaxMessageSize
+	}
+	if cfg.Limits.SpillThreshold != next.Limits.SpillThreshold ||
+		cfg.Limits.SpillDir != next.Limits.SpillDir ||
+		cfg.Limits.MaxSpillFiles != next.Limits.MaxSpillFiles {
+		a.handler.SetSpill(cfg.Limits.SpillDir, cfg.Limits.SpillThreshold, cfg.Limits.MaxSpillFiles,
+			logSpillErrors(a.logger))
+		if cfg.Limits.SpillThreshold != next.Limits.SpillThreshold {
+			changed("limits.spill_threshold", next.Limits.SpillThreshold, cfg.Limits.SpillThreshold)
+		}
+		if cfg.Limits.SpillDir != next.Limits.SpillDir {
+			changed("limits.spill_dir", next.Limits.SpillDir, cfg.Limits.SpillDir)
+		}
+		if cfg.Limits.MaxSpillFiles != next.Limits.MaxSpillFiles {
+			changed("limits.max_spill_files", next.Limits.MaxSpillFiles, cfg.Limits.MaxSpillFiles)
+		}
+		next.Limits.SpillThreshold = cfg.Limits.SpillThreshold
+		next.Limits.SpillDir = cfg.Limits.SpillDir
+		next.Limits.MaxSpillFiles = cfg.Limits.MaxSpillFiles
+	}
+	if cfg.Log.Level != next.Log.Level {
+		level, _ := parseLogLevel(cfg.Log.Level)
+		a.level.Set(level)
+		changed("log.level", next.Log.Level, cfg.Log.Level)
+		next.Log.Level = cfg.Log.Level
+	}
+	if cfg.ShutdownPolicy != next.ShutdownPolicy {
+		changed("shutdown_policy", next.ShutdownPolicy, cfg.ShutdownPolicy)
+		next.ShutdownPolicy = cfg.ShutdownPolicy
+	}
+	if cfg.Errors.Policy != next.Errors.Policy {
+		a.server.SetErrorPolicy(errorPolicies[cfg.Errors.Policy])
+		changed("errors.policy", next.Errors.Policy, cfg.Errors.Policy)
+		next.Errors.Policy = cfg.Errors.Policy
+	}
+
+	for _, f := range []struct {
+		field           string
+		running, loaded interface{}
+	}{
+		{"listen", next.Listen, cfg.Listen},
+		{"streams", next.Streams, cfg.Streams},
+		{"multicast", next.Multicast, cfg.Multicast},
+		{"sockets", next.Sockets, cfg.Sockets},
+		{"readers", next.Readers, cfg.Readers},
+		{"batch_size", next.BatchSize, cfg.BatchSize},
+		{"read_wait", next.ReadWait, cfg.ReadWait},
+		{"log.format", next.Log.Format, cfg.Log.Format},
+		{"log.sample", next.Log.Sample, cfg.Log.Sample},
+		{"journal", next.Journal, cfg.Journal},
+		{"http_addr", next.HTTPAddr, cfg.HTTPAddr},
+		{"trace", next.Trace, cfg.Trace},
+		{"errors.recent", next.Errors.Recent, cfg.Errors.Recent},
+	} {
+		if fmt.Sprint(f.running) != fmt.Sprint(f.loaded) {
+			a.logger.Warn("config change needs a restart, ignored", "field", f.field,
+				"running", f.running, "loaded", f.loaded)
+		}
+	}
+	a.cfg = &next
+	a.logger.Info("config reloaded", "changes", changes)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+// newTestAssembler starts a server on a fake network with the config file
+// at path.
+func newTestAssembler(t *testing.T, path string) *assembler {
+	args := []string{"-config", path}
+	cfg, _, err := ParseArgs(args, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, _ := cfg.ServerConfig()
+	h := NewMsgHandler(int(cfg.TimeoutDuration().Milliseconds()), nil, nil)
+	s := NewServerFromConfig(sc, &FakeNet{conn: createFakeConn(nil)}, h)
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go s.HandleErrors(func(e error) {})
+	t.Cleanup(s.Stop)
+	level := &slog.LevelVar{}
+	return &assembler{
+		args:    args,
+		cfg:     cfg,
+		server:  s,
+		handler: h,
+		sinks:   newSinkWriter(&bytes.Buffer{}, func() {}),
+		level:   level,
+		logger:  newLogger(cfg.Log, ioutil.Discard, level),
+	}
+}
+
+// TestReload tests that a reload applies the live settings without
+// touching the messages in flight.
+func TestReload(t *testing.T) {
+	path := writeConfigFile(t, `{"listen": ["127.0.0.1:0"], "workers": 2}`)
+	a := newTestAssembler(t, path)
+	a.handler.AddFragment(createValidFrag(false, 7, 0, make([]byte, 10)))
+
+	out := filepath.Join(filepath.Dir(path), "out.txt")
+	ioutil.WriteFile(path, []byte(`{"listen": ["127.0.0.1:1"], "workers": 3,
+		"timeout": "2s", "limits": {"queue_size": 30, "max_messages": 5},
+		"sinks": ["file:`+out+`"], "log": {"level": "debug"},
+		"shutdown_policy": "partial", "errors": {"policy": "ring"}}`), 0644)
+	if err := a.reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if workers, queueSize := a.server.Workers(); workers != 3 || queueSize != 30 {
+		t.Errorf("expected 3 workers and a queue of 30, got %d and %d", workers, queueSize)
+	}
+	if n := len(*a.handler.shards.Load()); n != 3 {
+		t.Errorf("expected a handler shard for each worker, got %d", n)
+	}
+	if cfg := a.handler.cfg(); cfg.cleanUpDelay != 2000 || cfg.maxMsgs != 5 {
+		t.Errorf("expected the handler's timeout and limits to change, got %d and %d",
+			cfg.cleanUpDelay, cfg.maxMsgs)
+	}
+	if a.level.Level() != slog.LevelDebug {
+		t.Errorf("expected the debug log level, got %v", a.level.Level())
+	}
+	if a.cfg.FlushPolicy() != FlushPartial {
+		t.Error("expected the shutdown policy to change")
+	}
+	if ErrorPolicy(a.server.errPolicy.Load()) != ErrorsRing {
+		t.Error("expected the error policy to change")
+	}
+	if a.cfg.Listen[0] != "127.0.0.1:0" {
+		t.Error("the listen address needs a restart and shouldn't change")
+	}
+	if inFlightMsg(a.handler, 7) == nil {
+		t.Error("the message in flight should have been kept")
+	}
+	a.sinks.Write([]byte("hello\n"))
+	if b, _ := ioutil.ReadFile(out); string(b) != "hello\n" {
+		t.Errorf("expected output to go to the new sink, got %q", b)
+	}
+	a.sinks.Close()
+}
+
+// TestReloadInvalid tests that an invalid config is rejected and the
+// running config is kept.
+func TestReloadInvalid(t *testing.T) {
+	path := writeConfigFile(t, `{"listen": ["127.0.0.1:0"], "workers": 2}`)
+	a := newTestAssembler(t, path)
+	for _, contents := range []string{
+		`{"workers": 3, "timeout": "soon"}`,
+		`{"workers": 3, "sinks": ["file:/nonexistent/dir/out.txt"]}`,
+		`{"workers": `,
+	} {
+		ioutil.WriteFile(path, []byte(contents), 0644)
+		if err := a.reload(); err == nil {
+			t.Errorf("expected %s to be rejected", contents)
+		}
+		if workers, _ := a.server.Workers(); workers != 2 || a.cfg.Workers != 2 {
+			t.Errorf("expected to keep 2 workers after %s", contents)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!sparc64
+
+package main
+
+// soReusePort is SO_REUSEPORT from <asm-generic/socket.h>, which most
+// architectures use.
+const soReusePort = 0xf
@@ -0,0 +1,9 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le || sparc64)
+// +build linux
+// +build mips mipsle mips64 mips64le sparc64
+
+package main
+
+// soReusePort is SO_REUSEPORT from the MIPS and SPARC <asm/socket.h>, which
+// don't use the generic socket option numbers.
+const soReusePort = 0x200
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// pacer spaces sends out to a steady rate.
+type pacer struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newPacer creates a pacer for rate sends a second, 0 for no limit.
+func newPacer(rate float64) *pacer {
+	p := &pacer{}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return p
+}
+
+// wait blocks until the next send is due. Sends that fell behind catch up
+// without waiting rather than bursting later.
+func (p *pacer) wait() {
+	if p.interval == 0 {
+		return
+	}
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	time.Sleep(p.next.Sub(now))
+	p.next = p.next.Add(p.interval)
+}
+
+// SendResult describes a message sent by Send.
+type SendResult struct {
+	TransID   uint32
+	Fragments int
+	Bytes     int64
+	// Sha256 is the hex encoded hash the assembler reports once it has
+	// reassembled the message
+	Sha256 string
+}
+
+// Send splits the message read from r with f and writes each fragment to
+// conn as one datagram, at most rate fragments a second, 0 for no limit.
+func Send(conn io.Writer, r io.Reader, f *Fragmenter, rate float64) (SendResult, error) {
+	var res SendResult
+	h := sha256.New()
+	p := newPacer(rate)
+	buf := make([]byte, 0, FragHdrLen+f.payloadSize)
+	transID, err := f.Split(io.TeeReader(r, h), func(frag *Fragment) error {
+		p.wait()
+		buf = appendFragment(buf[:0], frag)
+		if _, err := conn.Write(buf); err != nil {
+			return err
+		}
+		res.Fragments++
+		res.Bytes += int64(frag.DataLen)
+		return nil
+	})
+	res.TransID = transID
+	res.Sha256 = hex.EncodeToString(h.Sum(nil))
+	return res, err
+}
+
+// runSend is the send subcommand. It sends the file named on the command
+// line, or standard input for "-", to an assembler over UDP and returns the
+// exit status.
+func runSend(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("msg-assembler send", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	addr := fs.String("addr", "127.0.0.1:6789", "UDP `address` of the assembler")
+	payloadSize := fs.Int("payload-size", DefaultPayloadSize, "most bytes of the message in each fragment")
+	transID := fs.Int64("trans-id", -1, "transaction `ID` of the message, random when negative")
+	rate := fs.Float64("rate", 0, "most fragments sent a second, 0 for no limit")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: msg-assembler send [flags] <file>\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	logger := slog.New(slog.NewTextHandler(stderr, nil))
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *payloadSize < 1 || *payloadSize > MaxPayloadSize {
+		logger.Error("invalid arguments", "err", fmt.Sprintf("payload-size must be between 1 and %d", MaxPayloadSize))
+		return 2
+	}
+	if *transID > int64(^uint32(0)) {
+		logger.Error("invalid arguments", "err", "trans-id must fit in 32 bits")
+		return 2
+	}
+
+	in := io.Reader(os.Stdin)
+	if name := fs.Arg(0); name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			logger.Error("opening message", "err", err)
+			return 1
+		}
+		defer file.Close()
+		in = file
+	}
+	conn, err := net.Dial("udp", *addr)
+	if err != nil {
+		logger.Error("connecting", "err", err)
+		return 1
+	}
+	defer conn.Close()
+
+	var nextID func() uint32
+	if *transID >= 0 {
+		nextID = SequentialIDs(uint32(*transID))
+	}
+	res, err := Send(conn, in, NewFragmenter(*payloadSize, nextID), *rate)
+	if err != nil {
+		logger.Error("sending message", "trans_id", res.TransID, "err", err)
+		return 1
+	}
+	slog.New(slog.NewTextHandler(stdout, nil)).Info("message sent", "trans_id", res.TransID,
+		"fragments", res.Fragments, "length", res.Bytes, "sha256", res.Sha256)
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunSend tests the send subcommand sends a file as fragments over UDP.
+func TestRunSend(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	path := filepath.Join(t.TempDir(), "msg")
+	ioutil.WriteFile(path, make([]byte, 2500), 0644)
+
+	var stdout, stderr bytes.Buffer
+	status := runSend([]string{"-addr", l.LocalAddr().String(), "-payload-size", "1000",
+		"-trans-id", "42", "-rate", "1000", path}, &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("expected status 0, got %d: %s", status, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "trans_id=42 fragments=3 length=2500") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxDatagramSize)
+	for i := 0; i < 3; i++ {
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frag, err := ParseFragment(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frag.TransID != 42 || frag.Offset != uint32(i*1000) || frag.IsEnd != (i == 2) {
+			t.Errorf("unexpected fragment %+v", frag.FragmentHdr)
+		}
+	}
+}
+
+// TestRunSendMaxPayload tests that a fragment of the largest payload size
+// fits in one UDP datagram.
+func TestRunSendMaxPayload(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	path := filepath.Join(t.TempDir(), "msg")
+	ioutil.WriteFile(path, make([]byte, MaxPayloadSize), 0644)
+
+	var stderr bytes.Buffer
+	status := runSend([]string{"-addr", l.LocalAddr().String(), "-payload-size", strconv.Itoa(MaxPayloadSize),
+		path}, ioutil.Discard, &stderr)
+	if status != 0 {
+		t.Fatalf("expected status 0, got %d: %s", status, stderr.String())
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 65507 {
+		t.Errorf("expected a datagram of 65507 bytes, got %d", n)
+	}
+}
+
+// TestRunSendArgs tests the send subcommand rejects bad arguments.
+func TestRunSendArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"-payload-size", "70000", "msg"},
+		{"-payload-size", strconv.Itoa(MaxPayloadSize + 1), "msg"},
+		{"-trans-id", "5000000000", "msg"},
+	} {
+		if status := runSend(args, ioutil.Discard, ioutil.Discard); status != 2 {
+			t.Errorf("expected status 2 for %v, got %d", args, status)
+		}
+	}
+}
+
+// TestPacer tests sends are spaced out to the rate.
+func TestPacer(t *testing.T) {
+	p := newPacer(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		p.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected 6 sends at 100 a second to take 50ms, took %v", elapsed)
+	}
+}
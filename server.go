@@ -1,100 +1,700 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Server structure handles receiving UDP messages
+const (
+	// maxDatagramSize is the largest UDP payload the server will read. A
+	// fragment header plus a full 16 bit data length always fits.
+	maxDatagramSize = 65535
+	// defaultQueueSize is the total number of datagrams that can wait for
+	// a worker before the readers start dropping them.
+	defaultQueueSize = 4096
+	// transIDOffset is where the transaction ID starts in the fragment header.
+	// The readers peek at it to pick a worker without parsing the fragment.
+	transIDOffset = 8
+)
+
+// ServerConfig holds the settings used to build a Server.
+type ServerConfig struct {
+	// Addresses are the UDP addresses the server listens on. They can be
+	// IPv4 or IPv6, an unspecified IPv6 address listens on both.
+	Addresses []*net.UDPAddr
+	// NumSockets is the number of sockets bound to each address. More than one
+	// socket opens them all with SO_REUSEPORT so the kernel spreads the
+	// senders across them.
+	NumSockets int
+	// NumReaders is the number of goroutines reading datagrams off each
+	// socket.
+	NumReaders int
+	// NumWorkers is the number of goroutines parsing datagrams and handing
+	// the fragments to the MsgHandler. Every fragment of a message is
+	// processed by the same worker.
+	NumWorkers int
+	// QueueSize bounds the number of datagrams waiting for a worker. It is
+	// split evenly between the workers. When a worker's queue is full new
+	// datagrams for it are dropped.
+	QueueSize int
+	// Multicast are the multicast groups the server receives from.
+	Multicast []MulticastConfig
+	// Streams are the TCP and Unix domain socket addresses the server
+	// accepts fragment streams on.
+	Streams []StreamAddr
+	// ReadWait is how long a reader blocks on the socket before checking
+	// if the server is stopping.
+	ReadWait time.Duration
+	// ErrorPolicy decides whether errors wait for HandleErrors, are dropped
+	// when it falls behind or are only kept as recent errors.
+	ErrorPolicy ErrorPolicy
+	// RecentErrors is how many errors RecentErrors keeps, 0 for 100.
+	RecentErrors int
+}
+
+// datagram is a single UDP payload waiting for a worker. buf is the pooled
+// buffer data was read into, the datagram holds one reference on it. src is
+// who sent it and stats belongs to the listener it was received on.
+type datagram struct {
+	data  []byte
+	buf   *buffer
+	src   net.Addr
+	stats *listenerStats
+}
+
+// Server structure handles receiving UDP messages. Reader goroutines only
+// pull datagrams off the socket and put them on a bounded queue. Worker
+// goroutines take the datagrams off the queue, parse them and add them to
+// the MsgHandler. Datagrams are routed to a worker by transaction ID so a
+// message's fragments are always handled in order by one worker, even when
+// they arrive on different sockets.
 type Server struct {
-	numThreads int
-	netPack    NetWrapper
-	handler    *MsgHandler
-	address    *net.UDPAddr
-	quit       chan bool
-	wg         *sync.WaitGroup
-	readWait   time.Duration
-	errChan    chan error
-	conn       Conn
-}
-
-// Start spins up the requested number of threads and handles the UDP data
-func (s *Server) Start() error {
-	conn, err := s.netPack.ListenUDP("udp", s.address)
-	s.conn = conn
-	if err != nil {
+	cfg     ServerConfig
+	netPack NetWrapper
+	handler *MsgHandler
+	// ctx is cancelled to stop the readers, done is closed once the
+	// server has completely stopped
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	readerWg *sync.WaitGroup
+	workerWg *sync.WaitGroup
+	// runErr is the first error a reader stopped with
+	runErr  error
+	errOnce sync.Once
+	errChan chan error
+	// errCounts counts the errors reported by class, errDrops the ones
+	// HandleErrors didn't get because of the error policy
+	errCounts errorCounts
+	errDrops  atomic.Uint64
+	errPolicy atomic.Int32
+	recent    *errorRing
+	sockets   []udpSocket
+	// listeners accept the stream connections tracked in streams
+	listeners  []streamListener
+	streams    map[net.Conn]bool
+	streamLock sync.Mutex
+	// queues are the worker queues. queueLock is held for reading while
+	// datagrams are queued so SetWorkers can swap them out.
+	queues    []chan datagram
+	queueLock sync.RWMutex
+	drops     atomic.Uint64
+	stats     []*listenerStats
+	pool      *bufferPool
+	// parseErrors and processing are only set once the server is
+	// instrumented, they ignore updates until then
+	parseErrors *Counter
+	processing  *Histogram
+	// logger gets a debug record for every datagram a worker handles
+	logger *slog.Logger
+	// now is the clock the readers' deadlines are set by. Tests replace it
+	// with a MemClock's so they control when reads time out.
+	now func() time.Time
+
+	// queuesSwapped is closed when SetWorkers replaces the queues and
+	// queueSenders counts the enqueueWait calls that may still send to them,
+	// both are replaced along with the queues
+	queuesSwapped chan struct{}
+	queueSenders  *sync.WaitGroup
+}
+
+// Start spins up the reader and worker goroutines and handles the UDP data.
+// The server shuts down when ctx is cancelled, Shutdown is called or a
+// reader fails.
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.listen(); err != nil {
 		return err
 	}
-	for i := 0; i < s.numThreads; i++ {
-		go s.handleMsgs()
+	if err := s.listenMulticast(); err != nil {
+		s.closeSockets()
+		return err
+	}
+	if err := s.listenStreams(); err != nil {
+		s.closeSockets()
+		return err
+	}
+	s.queueLock.Lock()
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.startWorkers()
+	s.queueLock.Unlock()
+	for _, sock := range s.sockets {
+		for i := 0; i < s.cfg.NumReaders; i++ {
+			sock := sock
+			s.goReader(func() error { return s.readDatagrams(sock) })
+		}
 	}
+	for _, l := range s.listeners {
+		l := l
+		s.goReader(func() error { return s.acceptStreams(l) })
+	}
+	go s.stopWhenDone()
 	return nil
 }
 
-// Stop shuts down the  server
-func (s *Server) Stop() {
-	s.quit <- true
-	s.wg.Wait()
+// Run starts the server and blocks until it has stopped. It returns the
+// error that made a reader fail, or nil if the server was shut down.
+func (s *Server) Run(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		return err
+	}
+	return s.Wait()
+}
+
+// Wait blocks until a started server has completely stopped and returns the
+// same error as Run.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.runErr
+}
+
+// goReader runs a reader goroutine. If the reader returns an error the
+// server is shut down and Run returns the error.
+func (s *Server) goReader(f func() error) {
+	s.readerWg.Add(1)
+	go func() {
+		defer s.readerWg.Done()
+		if err := f(); err != nil {
+			s.errOnce.Do(func() {
+				s.runErr = err
+			})
+			s.cancel()
+		}
+	}()
+}
+
+// listen opens the sockets for every UDP address.
+func (s *Server) listen() error {
+	for _, addr := range s.cfg.Addresses {
+		if err := s.listenAddr(addr); err != nil {
+			s.closeSockets()
+			return err
+		}
+	}
+	return nil
+}
+
+// listenAddr opens the sockets for a single address. When there is more than
+// one socket the rest are bound to the first one's local address so they
+// share its port even if the address asked for any free port.
+func (s *Server) listenAddr(addr *net.UDPAddr) error {
+	var stats *listenerStats
+	for i := 0; i < s.cfg.NumSockets; i++ {
+		var conn Conn
+		var err error
+		if s.cfg.NumSockets == 1 {
+			conn, err = s.netPack.ListenUDP("udp", addr)
+		} else {
+			conn, err = s.netPack.ListenUDPReusePort("udp", addr)
+		}
+		if err != nil {
+			return err
+		}
+		if stats == nil {
+			stats = newListenerStats("udp", conn.LocalAddr())
+			s.stats = append(s.stats, stats)
+		}
+		s.sockets = append(s.sockets, udpSocket{conn: conn, stats: stats})
+		if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			addr = local
+		}
+	}
+	return nil
+}
+
+func (s *Server) closeSockets() {
+	for _, sock := range s.sockets {
+		sock.conn.Close()
+	}
+	s.sockets = nil
+}
+
+// stopWhenDone shuts the server down once its context is cancelled. The
+// readers are stopped first, then the workers finish the datagrams that are
+// already queued.
+func (s *Server) stopWhenDone() {
+	<-s.ctx.Done()
+	// stream readers block on their connections so closing them is the
+	// only way to wake them up
+	s.closeListeners()
+	s.closeStreams()
+	s.readerWg.Wait()
+	s.queueLock.Lock()
+	for _, q := range s.queues {
+		close(q)
+	}
+	s.queues = nil
+	s.queueLock.Unlock()
+	s.workerWg.Wait()
 	close(s.errChan)
-	s.conn.Close()
+	s.closeSockets()
+	close(s.done)
+}
+
+// startWorkers runs a worker for each queue and gives the handler a shard
+// for each, so the workers don't contend for its lock. queueLock must be
+// held.
+func (s *Server) startWorkers() {
+	if s.handler != nil {
+		s.handler.setShards(len(s.queues))
+	}
+	for _, q := range s.queues {
+		s.workerWg.Add(1)
+		go s.processDatagrams(q)
+	}
+}
+
+// SetWorkers changes the number of workers and the total queue size while
+// the server is running. New queues and workers replace the old ones, the old
+// workers exit once they have finished the datagrams already queued for them.
+// Until then fragments of a message can briefly be handled by an old and a
+// new worker at the same time, the MsgHandler's shard serializes them. Stream readers
+// waiting for room in a full old queue move to the new ones. It returns an
+// error if the server has stopped.
+func (s *Server) SetWorkers(numWorkers, queueSize int) error {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	if s.ctx != nil && s.queues == nil {
+		return errors.New("server stopped")
+	}
+	old, swapped, senders := s.queues, s.queuesSwapped, s.queueSenders
+	s.cfg.NumWorkers, s.cfg.QueueSize = numWorkers, queueSize
+	s.queues = newQueues(&s.cfg)
+	s.queuesSwapped, s.queueSenders = make(chan struct{}), &sync.WaitGroup{}
+	if s.ctx == nil {
+		// not started yet, Start runs the workers
+		return nil
+	}
+	s.startWorkers()
+	// the senders waiting on the old queues move to the new ones, they
+	// can't be closed until none is left to send to them
+	close(swapped)
+	s.queueLock.Unlock()
+	senders.Wait()
+	s.queueLock.Lock()
+	for _, q := range old {
+		close(q)
+	}
+	return nil
+}
+
+// Workers returns the current number of workers and total queue size.
+func (s *Server) Workers() (numWorkers, queueSize int) {
+	s.queueLock.RLock()
+	defer s.queueLock.RUnlock()
+	return s.cfg.NumWorkers, s.cfg.QueueSize
+}
+
+// Shutdown stops the server and waits for the queued datagrams to be
+// processed. If ctx ends first its error is returned and the server keeps
+// draining in the background.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.cancel == nil {
+		// never started
+		return nil
+	}
+	s.cancel()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop shuts down the server and waits for it to finish draining.
+func (s *Server) Stop() {
+	s.Shutdown(context.Background())
+}
+
+// stopping reports whether the server is shutting down.
+func (s *Server) stopping() bool {
+	return s.ctx.Err() != nil
 }
 
 // HandleErrors sends any recieved errors from the udp connection to the
-// caller to handle.
+// caller to handle. Errors about a single fragment are *FragmentError and
+// errors reading or accepting on a listener are *SocketError, see ErrorClass.
+// Which errors it gets depends on the error policy.
 func (s *Server) HandleErrors(cb func(err error)) {
 	for e := range s.errChan {
 		cb(e)
 	}
 }
 
-func (s *Server) handleMsgs() {
-	s.wg.Add(1)
-	defer s.wg.Done()
-	for {
-		// This allows the read to break from the blocking call
-		// so the thread can check for the quit signal
-		s.conn.SetReadDeadline(time.Now().Add(s.readWait))
+// reportError counts the error by class, keeps it among the recent errors
+// and hands it to HandleErrors as the error policy says.
+func (s *Server) reportError(err error) {
+	s.errCounts.add(err)
+	s.recent.add(err)
+	switch ErrorPolicy(s.errPolicy.Load()) {
+	case ErrorsBlock:
+		s.errChan <- err
+	case ErrorsDrop:
 		select {
-		case <-s.quit:
-			return
+		case s.errChan <- err:
 		default:
-			bufReader := bufio.NewReader(s.conn)
-			// Create the fragment from the udp traffic
-			f, err := CreateFragment(bufReader)
-			e, ok := err.(net.Error)
-			// check for the timeout or other errors
+			s.errDrops.Add(1)
+		}
+	}
+}
+
+// CountError counts an error found outside the server, like a corrupted
+// journal record, by class and keeps it among the recent errors. It isn't
+// handed to HandleErrors so it is safe to call before the server starts and
+// after it stops.
+func (s *Server) CountError(err error) {
+	s.errCounts.add(err)
+	s.recent.add(err)
+}
+
+// SetErrorPolicy changes what happens to the errors reported from now on.
+func (s *Server) SetErrorPolicy(p ErrorPolicy) {
+	s.errPolicy.Store(int32(p))
+}
+
+// RecentErrors returns the last errors reported, oldest first, whatever the
+// error policy.
+func (s *Server) RecentErrors() []ErrorRecord {
+	return s.recent.records()
+}
+
+// DroppedErrors returns how many errors HandleErrors didn't get because it
+// fell behind under ErrorsDrop.
+func (s *Server) DroppedErrors() uint64 {
+	return s.errDrops.Load()
+}
+
+// ErrorCounts returns how many errors of each class, as named by
+// ErrorClass, the server has reported.
+func (s *Server) ErrorCounts() map[string]uint64 {
+	return s.errCounts.byClass()
+}
+
+// ListenerStats returns the counters for each UDP and stream address the
+// server is listening on, in the order they were configured.
+func (s *Server) ListenerStats() []ListenerStats {
+	stats := make([]ListenerStats, len(s.stats))
+	for i, l := range s.stats {
+		stats[i] = l.snapshot()
+	}
+	return stats
+}
+
+// SetLogger logs every datagram the workers handle to l at debug level: the
+// fragment's trans_id, source, offset and length and the outcome of adding
+// it, or the reason it couldn't be parsed. It must be called before Start.
+// With a busy server l should sample debug records, see newLogger.
+func (s *Server) SetLogger(l *slog.Logger) {
+	s.logger = l
+}
+
+// Instrument registers the server's metrics with r. It must be called
+// before Start.
+func (s *Server) Instrument(r *Registry) {
+	s.parseErrors = r.NewCounter("msg_assembler_parse_errors_total",
+		"Datagrams that couldn't be parsed as a fragment.")
+	s.processing = r.NewHistogram("msg_assembler_fragment_processing_seconds",
+		"Time a worker took to parse a datagram and add its fragment.", latencyBuckets)
+	r.NewCounterFunc("msg_assembler_drops_total",
+		"Datagrams dropped because a worker's queue was full.",
+		func() float64 { return float64(s.Drops()) })
+	r.NewGaugeFunc("msg_assembler_queue_depth", "Datagrams waiting for a worker.",
+		func() float64 { return float64(s.QueueDepth()) })
+	r.NewGaugeFunc("msg_assembler_workers", "Worker goroutines.",
+		func() float64 {
+			workers, _ := s.Workers()
+			return float64(workers)
+		})
+	r.register("msg_assembler_errors_total", "Errors reported by class.", "counter", func() []sample {
+		var samples []sample
+		for class, n := range s.ErrorCounts() {
+			samples = append(samples, sample{labels: labelPairs("class", class), value: float64(n)})
+		}
+		return samples
+	})
+	r.NewCounterFunc("msg_assembler_errors_dropped_total",
+		"Errors not handled because the error handler fell behind.",
+		func() float64 { return float64(s.DroppedErrors()) })
+	s.instrumentListeners(r)
+}
+
+// QueueDepth returns the number of datagrams waiting for a worker.
+func (s *Server) QueueDepth() int {
+	s.queueLock.RLock()
+	defer s.queueLock.RUnlock()
+	depth := 0
+	for _, q := range s.queues {
+		depth += len(q)
+	}
+	return depth
+}
+
+// Drops returns the number of datagrams dropped because a worker's queue
+// was full.
+func (s *Server) Drops() uint64 {
+	return s.drops.Load()
+}
+
+// workerFor picks the worker queue for a datagram by its transaction ID.
+// Datagrams too short to hold a transaction ID go to the first worker which
+// will report the parse error. queueLock must be held.
+func (s *Server) workerFor(datagram []byte) int {
+	if len(datagram) < transIDOffset+4 {
+		return 0
+	}
+	transID := binary.BigEndian.Uint32(datagram[transIDOffset:])
+	return int(transID % uint32(len(s.queues)))
+}
+
+// enqueue hands the datagram to its worker without blocking. It returns
+// false if the worker's queue was full and the datagram was dropped, in
+// which case the datagram's buffer reference is released.
+func (s *Server) enqueue(d datagram) bool {
+	s.queueLock.RLock()
+	defer s.queueLock.RUnlock()
+	select {
+	case s.queues[s.workerFor(d.data)] <- d:
+		return true
+	default:
+		s.drops.Add(1)
+		d.stats.drops.Add(1)
+		d.buf.release()
+		return false
+	}
+}
+
+// readDatagrams reads from sock until the server stops. It only returns an
+// error if the socket was closed out from under it. A socket that can read
+// batches has them read straight into the pooled buffer, each datagram in a
+// slot big enough for the largest one.
+func (s *Server) readDatagrams(sock udpSocket) error {
+	conn := sock.conn
+	var br batchReader
+	var ps [][]byte
+	var ns []int
+	var srcs []net.Addr
+	if bs, ok := conn.(batchSource); ok {
+		br = bs.newBatchReader()
+		ps, ns, srcs = make([][]byte, br.size()), make([]int, br.size()), make([]net.Addr, br.size())
+	}
+	// datagrams are read back to back into buf until there isn't room left
+	// for the largest possible datagram
+	var buf *buffer
+	defer func() {
+		buf.release()
+	}()
+	for {
+		if s.stopping() {
+			return nil
+		}
+		if buf == nil || len(buf.free()) < maxDatagramSize {
+			buf.release()
+			buf = s.pool.get()
+		}
+		// This allows the read to break from the blocking call
+		// so the thread can check if the server is stopping
+		conn.SetReadDeadline(s.now().Add(s.cfg.ReadWait))
+		if br == nil {
+			n, src, err := conn.ReadFrom(buf.free()[:maxDatagramSize])
 			if err != nil {
-				if !ok || !e.Timeout() {
-					s.errChan <- err
-					continue
-				} else { // timeout
-					continue
+				if s.readFailed(sock, err) {
+					return err
 				}
-			} else {
-				// Handle the fragment
-				s.handler.AddFragment(f)
+				continue
 			}
+			s.received(sock, buf, n, src)
+			continue
+		}
+		free := buf.free()
+		slots := 0
+		for ; slots < len(ps) && len(free) >= maxDatagramSize; slots++ {
+			ps[slots], free = free[:maxDatagramSize], free[maxDatagramSize:]
+		}
+		n, err := br.readBatch(ps[:slots], ns, srcs)
+		if err != nil {
+			if s.readFailed(sock, err) {
+				return err
+			}
+			continue
+		}
+		for i := 0; i < n; i++ {
+			used := 0
+			if s.received(sock, buf, ns[i], srcs[i]) {
+				used = ns[i]
+			}
+			// the next datagram is at the start of the next slot, the
+			// rest of the last one's is left for the next batch
+			if i < n-1 {
+				buf.skip(maxDatagramSize - used)
+			}
+		}
+	}
+}
+
+// readFailed counts and reports an error reading sock, apart from the
+// timeouts that let the readers check whether the server is stopping. It
+// returns true if the socket was closed.
+func (s *Server) readFailed(sock udpSocket, err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		sock.stats.errors.Add(1)
+		s.reportError(&SocketError{Op: "read", Network: sock.stats.network,
+			Addr: addrString(sock.stats.addr), Err: err})
+	}
+	return false
+}
+
+// received hands a datagram of n bytes read into the free part of buf to
+// its worker, unless its source is filtered out. It returns false if the
+// datagram was filtered and its bytes weren't claimed.
+func (s *Server) received(sock udpSocket, buf *buffer, n int, src net.Addr) bool {
+	sock.stats.received(n)
+	if !sourceAllowed(sock.sources, src) {
+		sock.stats.filtered.Add(1)
+		return false
+	}
+	s.enqueue(datagram{data: buf.claim(n), buf: buf, src: src, stats: sock.stats})
+	return true
+}
+
+func (s *Server) processDatagrams(queue chan datagram) {
+	defer s.workerWg.Done()
+	for d := range queue {
+		// Create the fragment from the udp traffic, its data stays in the
+		// pooled buffer
+		start := time.Now()
+		debug := s.logger != nil && s.logger.Enabled(context.Background(), slog.LevelDebug)
+		f, err := ParseFragment(d.data)
+		if fe, ok := err.(*FragmentError); ok {
+			fe.Source = d.src
+		}
+		if err != nil {
+			if debug {
+				s.logger.Debug("datagram rejected", "source", addrString(d.src),
+					"length", len(d.data), "reason", err.Error())
+			}
+			d.buf.release()
+			d.stats.errors.Add(1)
+			s.parseErrors.Inc()
+			s.reportError(err)
+			continue
+		}
+		f.buf = d.buf
+		hdr := f.FragmentHdr
+		status := s.handler.AddFragment(f)
+		s.processing.ObserveSince(start)
+		if status == TooLarge {
+			s.reportError(&FragmentError{Err: ErrTooLarge, Source: d.src,
+				Len: int(hdr.Offset) + int(hdr.DataLen), Want: int(s.handler.MaxMessageSize())})
+		}
+		if debug {
+			s.logger.Debug("fragment received", "trans_id", hdr.TransID, "source", addrString(d.src),
+				"offset", hdr.Offset, "length", hdr.DataLen, "outcome", statusNames[status])
 		}
 	}
 }
 
-// NewServer initializes a Server structure for handling UDP messages
+// addrString formats an address that may be nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// NewServer initializes a Server structure for handling UDP messages on a
+// single address. numThreads is used for both the number of readers and workers.
 func NewServer(numThreads int,
 	network NetWrapper,
 	handler *MsgHandler,
 	address *net.UDPAddr,
 	readWait time.Duration) *Server {
-	return &Server{
-		numThreads,
-		network,
-		handler,
-		address,
-		make(chan bool),
-		&sync.WaitGroup{},
-		readWait,
-		make(chan error, 100),
-		nil,
+	return NewServerFromConfig(ServerConfig{
+		Addresses:  []*net.UDPAddr{address},
+		NumReaders: numThreads,
+		NumWorkers: numThreads,
+		QueueSize:  defaultQueueSize,
+		ReadWait:   readWait,
+	}, network, handler)
+}
+
+// newQueues makes a queue for each of the config's workers, splitting the
+// queue size between them. Zero values are replaced with a single worker and
+// the default queue size.
+func newQueues(cfg *ServerConfig) []chan datagram {
+	if cfg.NumWorkers < 1 {
+		cfg.NumWorkers = 1
+	}
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	perWorker := cfg.QueueSize / cfg.NumWorkers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+	queues := make([]chan datagram, cfg.NumWorkers)
+	for i := range queues {
+		queues[i] = make(chan datagram, perWorker)
+	}
+	return queues
+}
+
+// NewServerFromConfig initializes a Server structure from a ServerConfig.
+// Zero values in the config are replaced with a single socket, reader and
+// worker and the default queue size.
+func NewServerFromConfig(cfg ServerConfig,
+	network NetWrapper,
+	handler *MsgHandler) *Server {
+	if cfg.NumSockets < 1 {
+		cfg.NumSockets = 1
+	}
+	if cfg.NumReaders < 1 {
+		cfg.NumReaders = 1
+	}
+	queues := newQueues(&cfg)
+	s := &Server{
+		cfg:      cfg,
+		netPack:  network,
+		handler:  handler,
+		done:     make(chan struct{}),
+		readerWg: &sync.WaitGroup{},
+		workerWg: &sync.WaitGroup{},
+		errChan:  make(chan error, 100),
+		queues:   queues,
+		streams:  make(map[net.Conn]bool),
+		pool:     newBufferPool(defaultBufferSize),
+		recent:   newErrorRing(cfg.RecentErrors),
+		now:      time.Now,
 	}
+	s.queuesSwapped, s.queueSenders = make(chan struct{}), &sync.WaitGroup{}
+	s.errPolicy.Store(int32(cfg.ErrorPolicy))
+	return s
 }
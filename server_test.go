@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net"
@@ -14,6 +15,8 @@ type FakeConn struct {
 	readDeadlineErr bool
 	readBytes       []byte
 	deadLineCB      func()
+	// src is returned by ReadFrom, createUDPAddr's address when nil
+	src net.Addr
 }
 
 func (c *FakeConn) Read(p []byte) (n int, err error) {
@@ -24,6 +27,14 @@ func (c *FakeConn) Read(p []byte) (n int, err error) {
 	return len(c.readBytes), nil
 }
 
+func (c *FakeConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, err = c.Read(p)
+	if c.src == nil {
+		return n, createUDPAddr(), err
+	}
+	return n, c.src, err
+}
+
 func (c *FakeConn) Close() error {
 	if c.closeErr {
 		return errors.New("close error")
@@ -41,9 +52,18 @@ func (c *FakeConn) SetReadDeadline(t time.Time) error {
 	return nil
 }
 
+func (c *FakeConn) LocalAddr() net.Addr {
+	return createUDPAddr()
+}
+
 type FakeNet struct {
 	listenErr bool
 	conn      *FakeConn
+	// reuseConns are handed out in order by ListenUDPReusePort
+	reuseConns []*FakeConn
+	opened     int
+	// multicastJoins are the groups passed to each ListenMulticastUDP call
+	multicastJoins [][]net.IP
 }
 
 func createUDPAddr() *net.UDPAddr {
@@ -60,6 +80,29 @@ func (n *FakeNet) ListenUDP(network string, address *net.UDPAddr) (Conn, error)
 	return n.conn, nil
 }
 
+func (n *FakeNet) Listen(network, address string) (net.Listener, error) {
+	if n.listenErr {
+		return nil, errors.New("listen error")
+	}
+	return net.Listen(network, address)
+}
+
+func (n *FakeNet) ListenMulticastUDP(network string, ifi *net.Interface, groups []net.IP, port int) (Conn, error) {
+	if n.listenErr {
+		return nil, errors.New("listen error")
+	}
+	n.multicastJoins = append(n.multicastJoins, groups)
+	return n.conn, nil
+}
+
+func (n *FakeNet) ListenUDPReusePort(network string, address *net.UDPAddr) (Conn, error) {
+	if n.listenErr || n.opened == len(n.reuseConns) {
+		return nil, errors.New("listen error")
+	}
+	n.opened++
+	return n.reuseConns[n.opened-1], nil
+}
+
 func TestNewServerErr(t *testing.T) {
 	h := NewMsgHandler(5000, nil, nil)
 	s := NewServer(4,
@@ -67,7 +110,7 @@ func TestNewServerErr(t *testing.T) {
 		h,
 		createUDPAddr(),
 		time.Second)
-	if err := s.Start(); err.Error() != "listen error" {
+	if err := s.Start(context.Background()); err.Error() != "listen error" {
 		t.Error("expected listen error")
 	}
 
@@ -97,13 +140,18 @@ func (e *FakeError) Error() string {
 func TestReadFragment(t *testing.T) {
 	r := createFrag(false, 1, 0, make([]byte, 100), false)
 	data, _ := ioutil.ReadAll(r)
-	end := make(chan bool)
+	end := make(chan bool, 1)
 
 	cl := func(transID, off uint32) {
 		if off != 100 {
 			t.Error("expected offset of 100")
 		}
-		end <- true
+		// the fake connection keeps returning the fragment so later
+		// clean ups mustn't block Stop
+		select {
+		case end <- true:
+		default:
+		}
 	}
 	h := NewMsgHandler(1, cl, nil)
 	s := NewServer(1,
@@ -111,7 +159,241 @@ func TestReadFragment(t *testing.T) {
 		h,
 		createUDPAddr(),
 		time.Millisecond)
-	s.Start()
+	s.Start(context.Background())
 	<-end
 	s.Stop()
 }
+
+// TestWorkerFor tests that datagrams are routed to a worker by their
+// transaction ID so every fragment of a message goes to the same worker.
+func TestWorkerFor(t *testing.T) {
+	s := NewServerFromConfig(ServerConfig{NumWorkers: 4}, &FakeNet{}, nil)
+	for off := uint32(0); off < 10; off++ {
+		data, _ := ioutil.ReadAll(createFrag(false, 6, off, make([]byte, 10), false))
+		if w := s.workerFor(data); w != 2 {
+			t.Errorf("expected worker 2 for trans ID 6, got %d", w)
+		}
+	}
+	if w := s.workerFor([]byte{1, 2, 3}); w != 0 {
+		t.Error("short datagrams should go to the first worker")
+	}
+}
+
+// TestEnqueueDrops tests that datagrams are dropped and counted once a
+// worker's queue is full.
+func TestEnqueueDrops(t *testing.T) {
+	s := NewServerFromConfig(ServerConfig{NumWorkers: 2, QueueSize: 4}, &FakeNet{}, nil)
+	data, _ := ioutil.ReadAll(createFrag(false, 1, 0, make([]byte, 10), false))
+	stats := newListenerStats("udp", createUDPAddr())
+	for i := 0; i < 2; i++ {
+		if !s.enqueue(datagram{data: data, stats: stats}) {
+			t.Error("expected the datagram to be queued")
+		}
+	}
+	if s.enqueue(datagram{data: data, stats: stats}) {
+		t.Error("expected the datagram to be dropped")
+	}
+	if s.QueueDepth() != 2 {
+		t.Errorf("expected a queue depth of 2, got %d", s.QueueDepth())
+	}
+	if s.Drops() != 1 {
+		t.Errorf("expected 1 drop, got %d", s.Drops())
+	}
+	if stats.drops.Load() != 1 {
+		t.Errorf("expected 1 drop for the listener, got %d", stats.drops.Load())
+	}
+}
+
+// TestStopAllThreads tests that Stop shuts down every reader and worker.
+func TestStopAllThreads(t *testing.T) {
+	h := NewMsgHandler(5000, nil, nil)
+	s := NewServer(4,
+		&FakeNet{conn: createFakeConn([]byte{})},
+		h,
+		createUDPAddr(),
+		time.Millisecond)
+	s.Start(context.Background())
+	stopped := make(chan bool)
+	go func() {
+		s.HandleErrors(func(e error) {})
+		stopped <- true
+	}()
+	s.Stop()
+	<-stopped
+}
+
+// TestReusePortSockets tests that fragments of one message arriving on
+// different sockets are reassembled together.
+func TestReusePortSockets(t *testing.T) {
+	first, _ := ioutil.ReadAll(createFrag(false, 3, 0, make([]byte, 10), false))
+	last, _ := ioutil.ReadAll(createFrag(true, 3, 10, make([]byte, 10), false))
+	rebuilt := make(chan uint32, 1)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		select {
+		case rebuilt <- transID:
+		default:
+		}
+	})
+	n := &FakeNet{reuseConns: []*FakeConn{createFakeConn(first), createFakeConn(last)}}
+	s := NewServerFromConfig(ServerConfig{
+		Addresses:  []*net.UDPAddr{createUDPAddr()},
+		NumSockets: 2,
+		NumWorkers: 2,
+		ReadWait:   time.Millisecond,
+	}, n, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.sockets) != 2 {
+		t.Errorf("expected 2 sockets, got %d", len(s.sockets))
+	}
+	if transID := <-rebuilt; transID != 3 {
+		t.Errorf("expected trans ID 3 to be rebuilt, got %d", transID)
+	}
+	s.Stop()
+}
+
+// TestReusePortListenErr tests that the sockets already opened are closed
+// when opening one of the others fails.
+func TestReusePortListenErr(t *testing.T) {
+	n := &FakeNet{reuseConns: []*FakeConn{createFakeConn(nil)}}
+	s := NewServerFromConfig(ServerConfig{Addresses: []*net.UDPAddr{createUDPAddr()}, NumSockets: 2}, n, nil)
+	if err := s.Start(context.Background()); err == nil {
+		t.Error("expected listen error")
+	}
+	if s.sockets != nil {
+		t.Error("opened sockets should have been closed")
+	}
+}
+
+// TestMultipleAddresses tests that the server listens on every configured
+// address, IPv4 and IPv6, and counts the traffic for each one separately.
+func TestMultipleAddresses(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	v6 := &net.UDPAddr{IP: net.IPv6loopback}
+	rebuilt := make(chan uint32, 2)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		rebuilt <- transID
+	})
+	s := NewServerFromConfig(ServerConfig{
+		Addresses: []*net.UDPAddr{v4, v6},
+		ReadWait:  time.Millisecond,
+	}, &NetImp{}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Skipf("can't listen on both loopback addresses: %v", err)
+	}
+	defer s.Stop()
+	for i, sock := range s.sockets {
+		c, err := net.DialUDP("udp", nil, sock.conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		data, _ := ioutil.ReadAll(createFrag(true, uint32(i), 0, make([]byte, 10+i), false))
+		c.Write(data)
+		c.Close()
+	}
+	<-rebuilt
+	<-rebuilt
+	stats := s.ListenerStats()
+	if len(stats) != 2 {
+		t.Fatalf("expected stats for 2 listeners, got %d", len(stats))
+	}
+	for i, l := range stats {
+		if l.Datagrams != 1 || l.Bytes != uint64(FragHdrLen+10+i) {
+			t.Errorf("unexpected stats for %s: %+v", l.Address, l)
+		}
+	}
+}
+
+// TestRunContextCancel tests that cancelling the context passed to Run
+// stops the server without an error.
+func TestRunContextCancel(t *testing.T) {
+	h := NewMsgHandler(5000, nil, nil)
+	s := NewServer(2, &FakeNet{conn: createFakeConn(nil)}, h, createUDPAddr(), time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+	go s.HandleErrors(func(e error) {})
+	cancel()
+	if err := <-runErr; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+// TestRunSocketClosed tests that Run returns an error when a socket is
+// closed while the server is running.
+func TestRunSocketClosed(t *testing.T) {
+	conn := &FakeConn{readErr: net.ErrClosed}
+	s := NewServer(1, &FakeNet{conn: conn}, NewMsgHandler(5000, nil, nil), createUDPAddr(), time.Millisecond)
+	if err := s.Run(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected the closed socket error, got %v", err)
+	}
+}
+
+// TestShutdownDeadline tests that Shutdown gives up when its context ends
+// before the queued datagrams are processed and that the server still
+// finishes draining afterwards.
+func TestShutdownDeadline(t *testing.T) {
+	data, _ := ioutil.ReadAll(createFrag(true, 1, 0, make([]byte, 10), false))
+	inCB := make(chan bool, 1)
+	release := make(chan bool)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		select {
+		case inCB <- true:
+			<-release
+		default:
+		}
+	})
+	s := NewServer(1, &FakeNet{conn: createFakeConn(data)}, h, createUDPAddr(), time.Millisecond)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	go s.HandleErrors(func(e error) {})
+	// the worker is now stuck reporting the message
+	<-inCB
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	close(release)
+	if err := s.Wait(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+// TestSetWorkers tests that the workers can be changed while the server is
+// running and that the datagrams already queued are still processed.
+func TestSetWorkers(t *testing.T) {
+	rebuilt := make(chan uint32, 2)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		rebuilt <- transID
+	})
+	s := NewServerFromConfig(ServerConfig{NumWorkers: 2, QueueSize: 8}, &FakeNet{}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats := newListenerStats("udp", createUDPAddr())
+	send := func(transID uint32) {
+		data, _ := ioutil.ReadAll(createFrag(true, transID, 0, make([]byte, 10), false))
+		if !s.enqueue(datagram{data: data, stats: stats}) {
+			t.Error("expected the datagram to be queued")
+		}
+	}
+	send(1)
+	if err := s.SetWorkers(3, 30); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.queues) != 3 || cap(s.queues[0]) != 10 {
+		t.Errorf("expected 3 queues of 10, got %d of %d", len(s.queues), cap(s.queues[0]))
+	}
+	send(2)
+	<-rebuilt
+	<-rebuilt
+	s.Stop()
+	if err := s.SetWorkers(1, 1); err == nil {
+		t.Error("expected an error once the server has stopped")
+	}
+}
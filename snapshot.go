@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// snapshotMagic starts every snapshot.
+	snapshotMagic = "MASN"
+	// snapshotVersion is the version of the snapshot format written by
+	// Snapshot. Restore rejects any other version.
+	snapshotVersion = 1
+	// snapshotNoDeadline is written for a message without a deadline. A
+	// zero time.Time is outside what UnixNano can represent.
+	snapshotNoDeadline = 0
+)
+
+// ErrBadSnapshot is returned by Restore when the data isn't a snapshot.
+var ErrBadSnapshot = errors.New("not a message snapshot")
+
+// snapshotMsg is a message read from a snapshot or copied to write one.
+type snapshotMsg struct {
+	// deadline is zero when the message has none
+	deadline time.Time
+	frags    []*Fragment
+}
+
+// encodeDeadline is the deadline as written in a snapshot.
+func encodeDeadline(deadline time.Time) int64 {
+	if deadline.IsZero() {
+		return snapshotNoDeadline
+	}
+	return deadline.UnixNano()
+}
+
+// decodeDeadline reads a deadline written by encodeDeadline. Deadlines
+// before 1970 can't have been written so they are an error.
+func decodeDeadline(n int64) (time.Time, error) {
+	if n == snapshotNoDeadline {
+		return time.Time{}, nil
+	}
+	if n < 0 {
+		return time.Time{}, fmt.Errorf("invalid deadline %d", n)
+	}
+	return time.Unix(0, n), nil
+}
+
+// Snapshot writes every message in flight to w: its fragments and when it
+// expires. The messages are copied with every shard locked, so the snapshot
+// is a consistent point in time, and written once they are unlocked so a slow
+// w doesn't hold up the handler. Spilled data is read back into memory for
+// the copy.
+//
+// The format is the magic "MASN", a uint16 version and a uint32 message
+// count, all big endian. Each message is its uint32 transaction ID, its
+// deadline in int64 Unix nanoseconds, 0 for none, and a uint32 fragment
+// count followed by its fragments in offset order, each written as it came
+// off the wire: the 12 byte header and then the data.
+func (h *MsgHandler) Snapshot(w io.Writer) error {
+	msgs, err := h.copyMsgs()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	var b [16]byte
+	copy(b[:], snapshotMagic)
+	binary.BigEndian.PutUint16(b[4:], snapshotVersion)
+	binary.BigEndian.PutUint32(b[6:], uint32(len(msgs)))
+	bw.Write(b[:10])
+	for transID, msg := range msgs {
+		binary.BigEndian.PutUint32(b[0:], transID)
+		binary.BigEndian.PutUint64(b[4:], uint64(encodeDeadline(msg.deadline)))
+		binary.BigEndian.PutUint32(b[12:], uint32(len(msg.frags)))
+		bw.Write(b[:])
+		for _, frag := range msg.frags {
+			encodeFragHeader(b[:], &frag.FragmentHdr)
+			bw.Write(b[:FragHdrLen])
+			bw.Write(frag.Data)
+		}
+	}
+	return bw.Flush()
+}
+
+// copyMsgs copies every message in flight for a snapshot. The data of a
+// stored fragment never changes so it is shared rather than copied, spilled
+// data is read from disk.
+func (h *MsgHandler) copyMsgs() (map[uint32]*snapshotMsg, error) {
+	shards := h.lockShards()
+	defer unlockShards(shards)
+	msgs := make(map[uint32]*snapshotMsg, h.inFlight.Load())
+	for _, sh := range shards {
+		for transID, msg := range sh.msgMap {
+			snap := &snapshotMsg{}
+			if clMsg, ok := sh.cleanUpMap[transID]; ok {
+				snap.deadline = clMsg.deadline
+			}
+			for _, f := range msg.fragTree.InOrderArr() {
+				frag := f.(*Fragment)
+				data := frag.Data
+				if frag.spilled {
+					data = make([]byte, frag.DataLen)
+					if _, err := io.ReadFull(msg.fragReader(frag), data); err != nil {
+						return nil, fmt.Errorf("reading message %d: %w", transID, err)
+					}
+				}
+				snap.frags = append(snap.frags, &Fragment{FragmentHdr: frag.FragmentHdr, Data: data})
+			}
+			msgs[transID] = snap
+		}
+	}
+	return msgs, nil
+}
+
+// readSnapshot reads a whole snapshot. Nothing is returned unless all of it
+// could be read.
+func readSnapshot(r io.Reader) (map[uint32]*snapshotMsg, error) {
+	br := bufio.NewReader(r)
+	var b [16]byte
+	if _, err := io.ReadFull(br, b[:10]); err != nil {
+		return nil, ErrBadSnapshot
+	}
+	if string(b[:4]) != snapshotMagic {
+		return nil, ErrBadSnapshot
+	}
+	if v := binary.BigEndian.Uint16(b[4:]); v != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	count := binary.BigEndian.Uint32(b[6:])
+	msgs := make(map[uint32]*snapshotMsg)
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return nil, fmt.Errorf("reading message %d: %w", i, io.ErrUnexpectedEOF)
+		}
+		transID := binary.BigEndian.Uint32(b[0:])
+		deadline, err := decodeDeadline(int64(binary.BigEndian.Uint64(b[4:])))
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", transID, err)
+		}
+		msg := &snapshotMsg{deadline: deadline}
+		numFrags := binary.BigEndian.Uint32(b[12:])
+		for j := uint32(0); j < numFrags; j++ {
+			frag, err := CreateFragment(br)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading message %d fragment %d: %w", transID, j, err)
+			}
+			if frag.TransID != transID {
+				return nil, fmt.Errorf("message %d has a fragment of message %d", transID, frag.TransID)
+			}
+			msg.frags = append(msg.frags, frag)
+		}
+		if len(msg.frags) == 0 {
+			return nil, fmt.Errorf("message %d has no fragments", transID)
+		}
+		msgs[transID] = msg
+	}
+	return msgs, nil
+}
+
+// Restore adds the messages in a snapshot written by Snapshot. Each message
+// keeps the deadline it had when the snapshot was taken, so messages whose
+// time has already run out expire right away. Messages already in flight are
+// merged with the snapshot's, keeping their own deadline, and fragments over
+// the handler's limits are dropped. A message that had no deadline gets the
+// handler's timeout from now. Nothing is restored if the snapshot can't be
+// read in full.
+func (h *MsgHandler) Restore(r io.Reader) error {
+	msgs, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	shards := h.lockShards()
+	defer unlockShards(shards)
+	for transID, msg := range msgs {
+		deadline := msg.deadline
+		if deadline.IsZero() {
+			deadline = h.cleanUpDeadline(time.Now())
+		}
+		sh := shards[transID%uint32(len(shards))]
+		for _, frag := range msg.frags {
+			sh.addFragment(frag, deadline, true)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// TestSnapshotRestore tests that a restored handler has the same messages,
+// fragments and deadlines as the one the snapshot was taken of.
+func TestSnapshotRestore(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.AddFragment(createValidFrag(false, 1, 0, []byte("0123456789")))
+	h.AddFragment(createValidFrag(true, 1, 20, []byte("klmnop")))
+	h.AddFragment(createValidFrag(false, 2, 5, make([]byte, 5)))
+	var buf bytes.Buffer
+	if err := h.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var sha string
+	restored := NewMsgHandler(10, nil, func(transID uint32, sha256 string) {
+		sha = sha256
+	})
+	restored.SetOutput(ioutil.Discard)
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := restored.inFlight.Load(); n != 2 {
+		t.Fatalf("expected 2 messages, got %d", n)
+	}
+	for _, transID := range []uint32{1, 2} {
+		cl, _ := inFlightCleanUp(h, transID)
+		if restoredCl, _ := inFlightCleanUp(restored, transID); !restoredCl.deadline.Equal(cl.deadline) {
+			t.Errorf("expected message %d to keep its deadline", transID)
+		}
+	}
+	if m := inFlightMsg(restored, 1); m.recvTotal != 16 || m.total != 26 {
+		t.Errorf("unexpected message 1 %+v", m)
+	}
+	restored.AddFragment(createValidFrag(false, 1, 10, []byte("abcdefghij")))
+	sum := sha256.Sum256([]byte("0123456789abcdefghijklmnop"))
+	if expected := hex.EncodeToString(sum[:]); sha != expected {
+		t.Errorf("expected sha256 %s, got %s", expected, sha)
+	}
+}
+
+// lockCheckWriter completes a message of its handler on the first write, which
+// would deadlock if the handler were still locked.
+type lockCheckWriter struct {
+	bytes.Buffer
+	h    *MsgHandler
+	done bool
+}
+
+func (w *lockCheckWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.done = true
+		w.h.AddFragment(createValidFrag(true, 1, 10, make([]byte, 10)))
+	}
+	return w.Buffer.Write(p)
+}
+
+// TestSnapshotUnlocked tests that the snapshot is written without the handler
+// locked and keeps the messages as they were when it was taken.
+func TestSnapshotUnlocked(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(ioutil.Discard)
+	h.AddFragment(createValidFrag(false, 1, 0, []byte("0123456789")))
+	w := &lockCheckWriter{h: h}
+	if err := h.Snapshot(w); err != nil {
+		t.Fatal(err)
+	}
+	if inFlightMsg(h, 1) != nil {
+		t.Error("expected the message to complete while the snapshot was written")
+	}
+	restored := NewMsgHandler(60000, nil, nil)
+	if err := restored.Restore(&w.Buffer); err != nil {
+		t.Fatal(err)
+	}
+	if m := inFlightMsg(restored, 1); m == nil || m.recvTotal != 10 {
+		t.Error("expected the snapshot to have the message as it was")
+	}
+}
+
+// TestSnapshotExpired tests that a message restored after its deadline
+// expires right away.
+func TestSnapshotExpired(t *testing.T) {
+	h := NewMsgHandler(1, nil, nil)
+	h.AddFragment(createValidFrag(false, 3, 10, make([]byte, 10)))
+	var buf bytes.Buffer
+	h.Snapshot(&buf)
+	time.Sleep(5 * time.Millisecond)
+
+	holes := make(chan uint32, 2)
+	restored := NewMsgHandler(60000, func(transID, off uint32) {
+		holes <- off
+	}, nil)
+	restored.Restore(&buf)
+	select {
+	case <-holes:
+	case <-time.After(time.Second):
+		t.Fatal("expected the restored message to expire")
+	}
+}
+
+// TestSnapshotNoDeadline tests that a message without a deadline is written
+// as such and gets the restoring handler's timeout.
+func TestSnapshotNoDeadline(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.AddFragment(createValidFrag(false, 4, 0, make([]byte, 10)))
+	sh := h.lockShard(4)
+	sh.cleanUpMap[4].cleanUpTimer.Stop()
+	delete(sh.cleanUpMap, 4)
+	sh.lock.Unlock()
+	var buf bytes.Buffer
+	h.Snapshot(&buf)
+	if n := binary.BigEndian.Uint64(buf.Bytes()[14:]); n != snapshotNoDeadline {
+		t.Errorf("expected no deadline to be written as %d, got %d", snapshotNoDeadline, n)
+	}
+
+	restored := NewMsgHandler(60000, nil, nil)
+	start := time.Now()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer restored.Flush(FlushDiscard)
+	cl, ok := inFlightCleanUp(restored, 4)
+	if !ok {
+		t.Fatal("expected the restored message to get a deadline")
+	}
+	if d := cl.deadline.Sub(start).Round(time.Second); d != time.Minute {
+		t.Errorf("expected the handler's timeout as the deadline, got %v from now", d)
+	}
+}
+
+// TestRestoreBad tests that nothing is restored from data that isn't a
+// complete snapshot.
+func TestRestoreBad(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	var buf bytes.Buffer
+	h.Snapshot(&buf)
+	full := buf.Bytes()
+
+	restored := NewMsgHandler(60000, nil, nil)
+	if err := restored.Restore(bytes.NewReader([]byte("nope"))); err != ErrBadSnapshot {
+		t.Errorf("expected ErrBadSnapshot, got %v", err)
+	}
+	future := append([]byte{}, full...)
+	future[5] = 2
+	if err := restored.Restore(bytes.NewReader(future)); err == nil {
+		t.Error("expected an unsupported version error")
+	}
+	negative := append([]byte{}, full...)
+	binary.BigEndian.PutUint64(negative[14:], uint64(-time.Second.Nanoseconds()))
+	if err := restored.Restore(bytes.NewReader(negative)); err == nil {
+		t.Error("expected an invalid deadline error")
+	}
+	for cut := 10; cut < len(full); cut++ {
+		err := restored.Restore(bytes.NewReader(full[:cut]))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected an unexpected EOF with %d bytes, got %v", cut, err)
+		}
+	}
+	if restored.inFlight.Load() != 0 {
+		t.Error("nothing should have been restored")
+	}
+}
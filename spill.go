@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// defaultMaxSpillFiles is how many messages can have a spill file open at
+// once when no other number is given.
+const defaultMaxSpillFiles = 64
+
+// errTooManySpillFiles is returned by spill when every spill file allowed is
+// in use.
+var errTooManySpillFiles = errors.New("too many messages spilled to disk, keeping the rest of it in memory")
+
+// spillFiles counts the spill files open across a handler's messages, so a
+// flood of large messages can't use up the process's file descriptors.
+type spillFiles struct {
+	max  atomic.Int64
+	open atomic.Int64
+}
+
+func newSpillFiles(max int) *spillFiles {
+	s := &spillFiles{}
+	s.setMax(max)
+	return s
+}
+
+// setMax changes how many files can be open, 0 for the default. Files
+// already open stay open.
+func (s *spillFiles) setMax(max int) {
+	if max < 1 {
+		max = defaultMaxSpillFiles
+	}
+	s.max.Store(int64(max))
+}
+
+// take claims a file. It returns false if they are all in use. A nil
+// spillFiles has no limit.
+func (s *spillFiles) take() bool {
+	if s == nil {
+		return true
+	}
+	if s.open.Add(1) > s.max.Load() {
+		s.open.Add(-1)
+		return false
+	}
+	return true
+}
+
+// put gives back a file claimed by take.
+func (s *spillFiles) put() {
+	if s != nil {
+		s.open.Add(-1)
+	}
+}
+
+// spill writes frag to the message's spill file if the message already
+// holds spillThreshold bytes in memory. The file is created on the first
+// fragment spilled, if the handler's limit on spill files allows it. The
+// fragments are appended to the file so fragments that overlap each keep
+// their own data, as they do in memory. A spilled fragment keeps only its
+// header in memory. If writing fails the fragment stays in memory and the
+// error is returned; running out of spill files is only returned the first
+// time.
+func (m *Msg) spill(frag *Fragment) error {
+	if m.spillThreshold < 1 || frag.spilled || m.memBytes <= m.spillThreshold {
+		return nil
+	}
+	if m.spillFile == nil {
+		if m.spillRefused {
+			return nil
+		}
+		if !m.spillFiles.take() {
+			m.spillRefused = true
+			return errTooManySpillFiles
+		}
+		f, err := os.CreateTemp(m.spillDir, fmt.Sprintf("msg-%d-*.spill", m.transID))
+		if err != nil {
+			m.spillFiles.put()
+			return err
+		}
+		m.spillFile = f
+	}
+	if _, err := m.spillFile.WriteAt(frag.Data, m.spillSize); err != nil {
+		return err
+	}
+	frag.release()
+	frag.Data = nil
+	frag.spilled = true
+	frag.spillOff = m.spillSize
+	m.spillSize += int64(frag.DataLen)
+	m.memBytes -= int64(frag.DataLen)
+	return nil
+}
+
+// fragReader returns a reader for the fragment's data, from memory or from
+// the spill file.
+func (m *Msg) fragReader(frag *Fragment) io.Reader {
+	if frag.spilled {
+		return io.NewSectionReader(m.spillFile, frag.spillOff, int64(frag.DataLen))
+	}
+	return bytes.NewReader(frag.Data)
+}
+
+// WriteTo streams the data received so far to w in offset order, skipping
+// over any holes. Spilled fragments are read back from disk.
+func (m *Msg) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	for _, f := range m.fragTree.InOrderArr() {
+		n, err := io.Copy(w, m.fragReader(f.(*Fragment)))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func spillDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "msg-assembler-spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func spillHandler(t *testing.T, dir string, rebuiltCB func(transID uint32, sha string)) *MsgHandler {
+	h := NewMsgHandler(60000, nil, rebuiltCB)
+	h.SetOutput(ioutil.Discard)
+	h.SetSpill(dir, 20, 0, func(err error) {
+		t.Errorf("unexpected spill error: %v", err)
+	})
+	return h
+}
+
+// TestMsgSpill tests that fragments past the threshold are written to disk,
+// that the hash is computed from the file and that the file is removed once
+// the message is complete.
+func TestMsgSpill(t *testing.T) {
+	dir := spillDir(t)
+	var sha string
+	h := spillHandler(t, dir, func(transID uint32, sha256 string) {
+		sha = sha256
+	})
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz0123")
+	h.AddFragment(createValidFrag(false, 1, 0, data[0:10]))
+	h.AddFragment(createValidFrag(true, 1, 30, data[30:40]))
+	h.AddFragment(createValidFrag(false, 1, 20, data[20:30]))
+	msg := inFlightMsg(h, 1)
+	if msg.memBytes != 20 {
+		t.Errorf("expected 20 bytes in memory, got %d", msg.memBytes)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.spill"))
+	if len(files) != 1 {
+		t.Fatalf("expected a spill file, got %v", files)
+	}
+	if fi, _ := os.Stat(files[0]); fi.Size() != 10 {
+		t.Errorf("expected only the spilled fragment in the file, file size %d", fi.Size())
+	}
+
+	var partial bytes.Buffer
+	msg.WriteTo(&partial)
+	if partial.String() != "0123456789"+"klmnopqrst"+"uvwxyz0123" {
+		t.Errorf("unexpected partial data %q", partial.String())
+	}
+
+	h.AddFragment(createValidFrag(false, 1, 10, data[10:20]))
+	sum := sha256.Sum256(data)
+	if expected := hex.EncodeToString(sum[:]); sha != expected {
+		t.Errorf("expected sha256 %s, got %s", expected, sha)
+	}
+	if files, _ = filepath.Glob(filepath.Join(dir, "*.spill")); len(files) != 0 {
+		t.Errorf("expected the spill file to be removed, got %v", files)
+	}
+}
+
+// TestSpillOverlap tests that spilled fragments overlapping each other keep
+// their own data, the same as in memory.
+func TestSpillOverlap(t *testing.T) {
+	frags := func() []*Fragment {
+		return []*Fragment{
+			createValidFrag(false, 3, 0, bytes.Repeat([]byte("a"), 10)),
+			createValidFrag(false, 3, 10, bytes.Repeat([]byte("b"), 10)),
+			createValidFrag(false, 3, 20, bytes.Repeat([]byte("c"), 10)),
+			createValidFrag(false, 3, 25, bytes.Repeat([]byte("d"), 10)),
+		}
+	}
+	inMemory := NewMsgHandler(60000, nil, nil)
+	spilled := spillHandler(t, spillDir(t), nil)
+	for _, h := range []*MsgHandler{inMemory, spilled} {
+		for _, frag := range frags() {
+			h.AddFragment(frag)
+		}
+	}
+	if inFlightMsg(spilled, 3).spillFile == nil {
+		t.Fatal("expected the message to spill")
+	}
+	var expected, got bytes.Buffer
+	inFlightMsg(inMemory, 3).WriteTo(&expected)
+	inFlightMsg(spilled, 3).WriteTo(&got)
+	if got.String() != expected.String() {
+		t.Errorf("expected %q, got %q", expected.String(), got.String())
+	}
+	inMemory.Flush(FlushDiscard)
+	spilled.Flush(FlushDiscard)
+}
+
+// TestSpillMaxFiles tests that only so many messages spill at once, the
+// rest keep their data in memory, and that a message finishing frees its
+// file.
+func TestSpillMaxFiles(t *testing.T) {
+	var errs []error
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(ioutil.Discard)
+	h.SetSpill(spillDir(t), 20, 1, func(err error) {
+		errs = append(errs, err)
+	})
+	for id := uint32(1); id <= 2; id++ {
+		for i := uint32(0); i < 4; i++ {
+			h.AddFragment(createValidFrag(false, id, i*10, make([]byte, 10)))
+		}
+	}
+	if inFlightMsg(h, 1).spillFile == nil || inFlightMsg(h, 2).spillFile != nil {
+		t.Fatal("expected only the first message to spill")
+	}
+	if inFlightMsg(h, 2).memBytes != 40 {
+		t.Errorf("expected the second message in memory, got %d bytes", inFlightMsg(h, 2).memBytes)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], errTooManySpillFiles) {
+		t.Errorf("expected the second message to be reported once, got %v", errs)
+	}
+	h.Expire(1)
+	h.AddFragment(createValidFrag(false, 3, 0, make([]byte, 30)))
+	h.AddFragment(createValidFrag(false, 3, 30, make([]byte, 10)))
+	if inFlightMsg(h, 3).spillFile == nil {
+		t.Error("expected a new message to spill once the file was freed")
+	}
+	h.Flush(FlushDiscard)
+	if n := h.spillFiles.open.Load(); n != 0 {
+		t.Errorf("expected every file to be given back, %d still open", n)
+	}
+}
+
+// TestSpillSnapshot tests that a snapshot includes the data of spilled
+// fragments.
+func TestSpillSnapshot(t *testing.T) {
+	h := spillHandler(t, spillDir(t), nil)
+	for i := uint32(0); i < 4; i++ {
+		h.AddFragment(createValidFrag(false, 2, i*10, bytes.Repeat([]byte{byte(i)}, 10)))
+	}
+	var buf bytes.Buffer
+	if err := h.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMsgHandler(60000, nil, nil)
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	sha, err := inFlightMsg(h, 2).GetPartialSha256()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := inFlightMsg(restored, 2).GetPartialSha256(); err != nil || restored != sha {
+		t.Errorf("expected the restored message to have the same data, got %v", err)
+	}
+	h.Flush(FlushDiscard)
+}
+
+// TestSpillReadError tests that a message whose spilled data can't be read
+// back is reported as failed rather than reassembled.
+func TestSpillReadError(t *testing.T) {
+	rebuilt := false
+	h := spillHandler(t, spillDir(t), func(transID uint32, sha256 string) {
+		rebuilt = true
+	})
+	var last TraceEvent
+	h.SetTracer(func(ev TraceEvent) { last = ev })
+	for i := uint32(0); i < 3; i++ {
+		h.AddFragment(createValidFrag(false, 1, i*10, make([]byte, 10)))
+	}
+	inFlightMsg(h, 1).spillFile.Close()
+	h.AddFragment(createValidFrag(true, 1, 30, make([]byte, 10)))
+	if rebuilt {
+		t.Error("expected the message not to be reported as reassembled")
+	}
+	if last.Type != TraceFailed || last.Reason == "" {
+		t.Errorf("expected the message to fail with a reason, got %+v", last)
+	}
+	if inFlightMsg(h, 1) != nil {
+		t.Error("expected the failed message to be removed")
+	}
+}
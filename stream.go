@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// acceptRetryDelay is how long an acceptor waits after a failed Accept
+// before trying again.
+const acceptRetryDelay = 10 * time.Millisecond
+
+// StreamAddr is a TCP or Unix domain socket address the server accepts
+// fragment streams on. A stream carries fragments back to back in the same
+// header format as the UDP datagrams.
+type StreamAddr struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix".
+	Network string
+	Address string
+}
+
+// readFrame reads the next fragment off a stream and returns its header and
+// data as a single datagram so the workers can treat it like one received
+// over UDP. io.EOF is returned only if the stream ended cleanly between
+// fragments, a *FragmentError if it ended in the middle of one.
+func readFrame(r io.Reader) (datagram, error) {
+	var hdr [FragHdrLen]byte
+	if n, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = &FragmentError{Err: ErrShortHeader, Len: n, Want: FragHdrLen}
+		}
+		return datagram{}, err
+	}
+	dataLen := int(binary.BigEndian.Uint16(hdr[2:]))
+	frame := make([]byte, FragHdrLen+dataLen)
+	copy(frame, hdr[:])
+	if n, err := io.ReadFull(r, frame[FragHdrLen:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = &FragmentError{Err: ErrShortPayload, Len: FragHdrLen + n, Want: len(frame)}
+		}
+		return datagram{}, err
+	}
+	return datagram{data: frame}, nil
+}
+
+// listenStreams opens a listener for each of the configured stream
+// addresses.
+func (s *Server) listenStreams() error {
+	for _, sa := range s.cfg.Streams {
+		l, err := s.netPack.Listen(sa.Network, sa.Address)
+		if err != nil {
+			s.closeListeners()
+			return err
+		}
+		stats := newListenerStats(sa.Network, l.Addr())
+		s.stats = append(s.stats, stats)
+		s.listeners = append(s.listeners, streamListener{l: l, stats: stats})
+	}
+	return nil
+}
+
+func (s *Server) closeListeners() {
+	for _, sl := range s.listeners {
+		sl.l.Close()
+	}
+	s.listeners = nil
+}
+
+// trackStream remembers an accepted connection so Stop can close it. It
+// returns false if the server is already stopping.
+func (s *Server) trackStream(c net.Conn) bool {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	if s.streams == nil {
+		return false
+	}
+	s.streams[c] = true
+	return true
+}
+
+func (s *Server) untrackStream(c net.Conn) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	delete(s.streams, c)
+	c.Close()
+}
+
+// closeStreams closes every open stream connection and stops new ones from
+// being tracked.
+func (s *Server) closeStreams() {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	for c := range s.streams {
+		c.Close()
+	}
+	s.streams = nil
+}
+
+// acceptStreams starts a reader for each connection accepted on sl. It
+// returns an error if the listener was closed before the server stopped.
+func (s *Server) acceptStreams(sl streamListener) error {
+	for {
+		c, err := sl.l.Accept()
+		if err != nil {
+			if s.stopping() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			sl.stats.errors.Add(1)
+			s.reportError(&SocketError{Op: "accept", Network: sl.stats.network,
+				Addr: addrString(sl.stats.addr), Err: err})
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		if !s.trackStream(c) {
+			c.Close()
+			return nil
+		}
+		sl.stats.conns.Add(1)
+		// a failed connection only closes itself, not the server
+		s.goReader(func() error {
+			s.readStream(c, sl.stats)
+			return nil
+		})
+	}
+}
+
+// readStream hands each fragment on the connection to its worker. Unlike
+// the UDP readers it waits for room in the worker's queue instead of
+// dropping the fragment, which pushes back on the sender. Any error only
+// closes this connection.
+func (s *Server) readStream(c net.Conn, stats *listenerStats) {
+	defer s.untrackStream(c)
+	r := bufio.NewReader(c)
+	for {
+		d, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && !s.stopping() {
+				stats.errors.Add(1)
+				var fe *FragmentError
+				if errors.As(err, &fe) {
+					fe.Source = c.RemoteAddr()
+				} else {
+					err = &SocketError{Op: "read", Network: stats.network, Addr: addrString(stats.addr),
+						Source: c.RemoteAddr(), Err: err}
+				}
+				s.reportError(err)
+			}
+			return
+		}
+		stats.received(len(d.data))
+		d.src = c.RemoteAddr()
+		d.stats = stats
+		if !s.enqueueWait(d) {
+			return
+		}
+	}
+}
+
+// enqueueWait hands the datagram to its worker, waiting for room in the
+// worker's queue. queueLock isn't held while waiting so SetWorkers isn't held
+// up by a full queue, if it swaps the queues in the meantime the datagram goes
+// to the new ones. It returns false if the server stopped first.
+func (s *Server) enqueueWait(d datagram) bool {
+	for {
+		s.queueLock.RLock()
+		if s.queues == nil {
+			s.queueLock.RUnlock()
+			return false
+		}
+		q, swapped, senders := s.queues[s.workerFor(d.data)], s.queuesSwapped, s.queueSenders
+		senders.Add(1)
+		s.queueLock.RUnlock()
+		select {
+		case q <- d:
+			senders.Done()
+			return true
+		case <-swapped:
+			senders.Done()
+		case <-s.ctx.Done():
+			senders.Done()
+			return false
+		}
+	}
+}
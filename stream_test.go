@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReadFrame tests that fragments written back to back are read off a
+// stream one at a time.
+func TestReadFrame(t *testing.T) {
+	b := &bytes.Buffer{}
+	io.Copy(b, createFrag(false, 1, 0, make([]byte, 10), false))
+	io.Copy(b, createFrag(true, 1, 10, make([]byte, 5), false))
+	d, err := readFrame(b)
+	if err != nil || len(d.data) != FragHdrLen+10 {
+		t.Fatalf("expected the first fragment, got %d bytes err: %v", len(d.data), err)
+	}
+	d, err = readFrame(b)
+	if err != nil || len(d.data) != FragHdrLen+5 {
+		t.Fatalf("expected the second fragment, got %d bytes err: %v", len(d.data), err)
+	}
+	if _, err = readFrame(b); err != io.EOF {
+		t.Errorf("expected EOF at the end of the stream, got %v", err)
+	}
+}
+
+// TestReadFrameShort tests that a stream ending in the middle of a fragment
+// is an error.
+func TestReadFrameShort(t *testing.T) {
+	data, _ := ioutil.ReadAll(createFrag(false, 1, 0, make([]byte, 10), false))
+	var fe *FragmentError
+	_, err := readFrame(bytes.NewReader(data[:FragHdrLen-2]))
+	if !errors.Is(err, ErrShortHeader) || !errors.As(err, &fe) || fe.Len != FragHdrLen-2 || fe.Want != FragHdrLen {
+		t.Errorf("expected a short header error, got %v", err)
+	}
+	_, err = readFrame(bytes.NewReader(data[:len(data)-1]))
+	if !errors.Is(err, ErrShortPayload) || !errors.As(err, &fe) || fe.Len != len(data)-1 || fe.Want != len(data) {
+		t.Errorf("expected a short data error, got %v", err)
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("expected a short fragment to still be an unexpected EOF")
+	}
+}
+
+func startStreamServer(t *testing.T, sa StreamAddr, rebuilt chan uint32) *Server {
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		rebuilt <- transID
+	})
+	s := NewServerFromConfig(ServerConfig{
+		Streams:    []StreamAddr{sa},
+		NumWorkers: 2,
+	}, &FakeNet{}, h)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s
+}
+
+func sendStream(t *testing.T, addr net.Addr, frags ...io.Reader) {
+	c, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer c.Close()
+	for _, f := range frags {
+		io.Copy(c, f)
+	}
+}
+
+// TestTCPStream tests that a message sent over TCP is reassembled.
+func TestTCPStream(t *testing.T) {
+	rebuilt := make(chan uint32, 1)
+	s := startStreamServer(t, StreamAddr{"tcp", "127.0.0.1:0"}, rebuilt)
+	sendStream(t, s.listeners[0].l.Addr(),
+		createFrag(false, 4, 0, make([]byte, 10), false),
+		createFrag(true, 4, 10, make([]byte, 10), false))
+	if transID := <-rebuilt; transID != 4 {
+		t.Errorf("expected trans ID 4 to be rebuilt, got %d", transID)
+	}
+	s.Stop()
+}
+
+// TestUnixStream tests that a message sent over a Unix domain socket is
+// reassembled.
+func TestUnixStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msg-assembler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rebuilt := make(chan uint32, 1)
+	s := startStreamServer(t, StreamAddr{"unix", filepath.Join(dir, "frags.sock")}, rebuilt)
+	sendStream(t, s.listeners[0].l.Addr(),
+		createFrag(true, 8, 0, make([]byte, 10), false))
+	if transID := <-rebuilt; transID != 8 {
+		t.Errorf("expected trans ID 8 to be rebuilt, got %d", transID)
+	}
+	s.Stop()
+}
+
+// TestMalformedStream tests that a stream cut off in the middle of a
+// fragment reports an error without affecting other connections.
+func TestMalformedStream(t *testing.T) {
+	rebuilt := make(chan uint32, 1)
+	s := startStreamServer(t, StreamAddr{"tcp", "127.0.0.1:0"}, rebuilt)
+	addr := s.listeners[0].l.Addr()
+
+	bad, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	good, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer good.Close()
+	data, _ := ioutil.ReadAll(createFrag(false, 5, 0, make([]byte, 10), false))
+	bad.Write(data[:len(data)-3])
+	bad.Close()
+	select {
+	case err := <-s.errChan:
+		if err == nil {
+			t.Error("expected an error for the malformed stream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error was reported for the malformed stream")
+	}
+
+	io.Copy(good, createFrag(true, 6, 0, make([]byte, 10), false))
+	if transID := <-rebuilt; transID != 6 {
+		t.Errorf("expected trans ID 6 to be rebuilt, got %d", transID)
+	}
+	s.Stop()
+}
+
+// gateWriter blocks every write until gate is closed.
+type gateWriter struct {
+	gate chan struct{}
+}
+
+func (w gateWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return len(p), nil
+}
+
+// TestEnqueueWaitSetWorkers tests that a stream reader waiting for room in a
+// full queue doesn't hold up SetWorkers, and that its datagram goes to the
+// new queues.
+func TestEnqueueWaitSetWorkers(t *testing.T) {
+	rebuilt := make(chan uint32, 3)
+	h := NewMsgHandler(5000, nil, func(transID uint32, sha string) {
+		rebuilt <- transID
+	})
+	h.SetOutput(ioutil.Discard)
+	s := NewServerFromConfig(ServerConfig{NumWorkers: 1, QueueSize: 1}, &FakeNet{}, h)
+	// the worker blocks logging the first datagram and the second fills the
+	// queue
+	w := gateWriter{gate: make(chan struct{})}
+	s.SetLogger(slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	stats := newListenerStats("tcp", createUDPAddr())
+	queued := make(chan bool, 3)
+	for id := uint32(1); id <= 3; id++ {
+		data, _ := ioutil.ReadAll(createFrag(true, id, 0, make([]byte, 10), false))
+		go func() { queued <- s.enqueueWait(datagram{data: data, stats: stats}) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	swapped := make(chan error, 1)
+	go func() { swapped <- s.SetWorkers(2, 10) }()
+	select {
+	case err := <-swapped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		close(w.gate)
+		t.Fatal("expected SetWorkers not to wait for room in the full queue")
+	}
+	for i := 0; i < 3; i++ {
+		if !<-queued {
+			t.Error("expected every datagram to be queued")
+		}
+	}
+	close(w.gate)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-rebuilt:
+		case <-time.After(time.Second):
+			t.Fatal("expected every message to be rebuilt")
+		}
+	}
+}
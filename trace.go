@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTraceKeep is how many finished messages a TraceRecorder keeps the
+// events of when no other number is given.
+const defaultTraceKeep = 1000
+
+// maxTraceEvents is the most events kept for one message, its last event
+// included. A message of many fragments would otherwise grow its timeline
+// by an event or two per fragment.
+const maxTraceEvents = 64
+
+// TraceEventType is a step in a message's lifecycle.
+type TraceEventType int
+
+const (
+	// TraceFirstFragment is the first fragment of a message arriving. An
+	// accepted event for the same fragment follows it.
+	TraceFirstFragment TraceEventType = iota
+	// TraceAccepted is a fragment added to its message.
+	TraceAccepted
+	// TraceDuplicate is a fragment dropped because its offset had already
+	// arrived.
+	TraceDuplicate
+	// TraceRejected is a fragment dropped for the Reason given, like
+	// too_large.
+	TraceRejected
+	// TraceContiguous is the data without a hole from offset 0 growing,
+	// Contiguous is its new length.
+	TraceContiguous
+	// TraceCompleted is a message reassembled.
+	TraceCompleted
+	// TraceExpired is a message removed before all of its fragments arrived,
+	// for the Reason given.
+	TraceExpired
+	// TraceFailed is a message with all of its fragments whose data couldn't
+	// be read back, the Reason is the error.
+	TraceFailed
+)
+
+var traceEventNames = [...]string{
+	TraceFirstFragment: "first_fragment",
+	TraceAccepted:      "accepted",
+	TraceDuplicate:     "duplicate",
+	TraceRejected:      "rejected",
+	TraceContiguous:    "contiguous",
+	TraceCompleted:     "completed",
+	TraceExpired:       "expired",
+	TraceFailed:        "failed",
+}
+
+func (t TraceEventType) String() string {
+	if t < 0 || int(t) >= len(traceEventNames) {
+		return "TraceEventType(" + strconv.Itoa(int(t)) + ")"
+	}
+	return traceEventNames[t]
+}
+
+// MarshalText writes the type's name so events read well as JSON.
+func (t TraceEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// TraceEvent is one step in a message's lifecycle.
+type TraceEvent struct {
+	Type    TraceEventType `json:"type"`
+	TransID uint32         `json:"trans_id"`
+	Time    time.Time      `json:"time"`
+	// Offset and Length are the fragment's, for the fragment events
+	Offset uint32 `json:"offset"`
+	Length uint16 `json:"length"`
+	// Contiguous is how many bytes from the start of the message had
+	// arrived without a hole after the event
+	Contiguous uint32 `json:"contiguous"`
+	// Reason is why a fragment was rejected or a message expired or failed
+	Reason string `json:"reason,omitempty"`
+	// Omitted is set on a message's last event to how many of its events
+	// were left out because its timeline was full
+	Omitted int `json:"omitted,omitempty"`
+}
+
+// ends reports whether the event is the last of its message.
+func (e TraceEvent) ends() bool {
+	return e.Type == TraceCompleted || e.Type == TraceExpired || e.Type == TraceFailed
+}
+
+// TraceRecorder collects the events of each message so its timeline can be
+// looked at. Pass its Trace method to MsgHandler.SetTracer. It keeps the
+// events of the messages in flight and of the last messages to finish, up to
+// 64 for each: once a message has that many only its last event is added and
+// the rest are counted. If it has an export writer each message is written to
+// it as a span once it finishes.
+type TraceRecorder struct {
+	lock sync.Mutex
+	keep int
+	msgs map[uint32][]TraceEvent
+	// omitted counts the events left out of the timelines that are full
+	omitted map[uint32]int
+	// finished are the finished messages still kept, oldest first
+	finished []uint32
+	export   io.Writer
+	exportCB func(err error)
+	// spans queues the finished timelines for the export goroutine, which
+	// closes exported once it has written them all. dropped counts the
+	// timelines that didn't fit in the queue.
+	spans    chan []TraceEvent
+	exported chan struct{}
+	dropped  atomic.Uint64
+	closed   bool
+}
+
+// NewTraceRecorder creates a TraceRecorder that keeps the events of the keep
+// most recently finished messages, 0 for the default of 1000. export can be
+// nil, otherwise every finished message is written to it as one line of
+// OpenTelemetry JSON, see WriteSpan. The spans are written by a goroutine of
+// their own so a slow writer doesn't hold up the handler, up to keep of them
+// wait to be written before the rest are dropped. Close stops it. errCB is
+// called with any error writing to export and the number of spans dropped,
+// it can be nil.
+func NewTraceRecorder(keep int, export io.Writer, errCB func(err error)) *TraceRecorder {
+	if keep < 1 {
+		keep = defaultTraceKeep
+	}
+	r := &TraceRecorder{
+		keep:     keep,
+		msgs:     make(map[uint32][]TraceEvent),
+		omitted:  make(map[uint32]int),
+		export:   export,
+		exportCB: errCB,
+	}
+	if export != nil {
+		r.spans = make(chan []TraceEvent, keep)
+		r.exported = make(chan struct{})
+		go r.exportSpans()
+	}
+	return r
+}
+
+// exportSpans writes the finished timelines to the export writer until
+// Close is called.
+func (r *TraceRecorder) exportSpans() {
+	defer close(r.exported)
+	for events := range r.spans {
+		if err := WriteSpan(r.export, events); err != nil && r.exportCB != nil {
+			r.exportCB(fmt.Errorf("exporting trace of message %d: %v", events[0].TransID, err))
+		}
+		r.reportDropped()
+	}
+	r.reportDropped()
+}
+
+// reportDropped passes the number of spans dropped since it was last called
+// to the error callback.
+func (r *TraceRecorder) reportDropped() {
+	if n := r.dropped.Swap(0); n > 0 && r.exportCB != nil {
+		r.exportCB(fmt.Errorf("dropped the traces of %d messages, the export fell behind", n))
+	}
+}
+
+// Close waits for the finished timelines to be exported and stops exporting.
+// Messages finishing afterwards are still recorded but not exported.
+func (r *TraceRecorder) Close() {
+	r.lock.Lock()
+	if r.spans == nil || r.closed {
+		r.lock.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.spans)
+	r.lock.Unlock()
+	<-r.exported
+}
+
+// Trace records an event. Only the events of messages in flight are kept, a
+// fragment rejected before its message started or after it finished has no
+// timeline to go in and is ignored.
+func (r *TraceRecorder) Trace(ev TraceEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events, ok := r.msgs[ev.TransID]
+	if ev.Type == TraceFirstFragment {
+		// the transaction ID is being reused, start a new timeline
+		r.forget(ev.TransID)
+		events = nil
+	} else if !ok || events[len(events)-1].ends() {
+		return
+	}
+	if !ev.ends() && len(events) >= maxTraceEvents-1 {
+		// leave room for the last event
+		r.omitted[ev.TransID]++
+		return
+	}
+	if ev.ends() {
+		ev.Omitted = r.omitted[ev.TransID]
+		delete(r.omitted, ev.TransID)
+	}
+	events = append(events, ev)
+	r.msgs[ev.TransID] = events
+	if !ev.ends() {
+		return
+	}
+	if r.spans != nil && !r.closed {
+		// the events of a finished message don't change, the queue can
+		// share them
+		select {
+		case r.spans <- events:
+		default:
+			r.dropped.Add(1)
+		}
+	}
+	r.finished = append(r.finished, ev.TransID)
+	for len(r.finished) > r.keep {
+		delete(r.msgs, r.finished[0])
+		r.finished = r.finished[1:]
+	}
+}
+
+// forget drops a finished message's events. r.lock must be held.
+func (r *TraceRecorder) forget(transID uint32) {
+	for i, id := range r.finished {
+		if id == transID {
+			r.finished = append(r.finished[:i], r.finished[i+1:]...)
+			break
+		}
+	}
+	delete(r.msgs, transID)
+	delete(r.omitted, transID)
+}
+
+// Timeline returns a copy of the message's events in the order they
+// happened, or nil if it isn't known.
+func (r *TraceRecorder) Timeline(transID uint32) []TraceEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events, ok := r.msgs[transID]
+	if !ok {
+		return nil
+	}
+	return append([]TraceEvent(nil), events...)
+}
+
+// WriteTimeline writes the message's events as text, one per line with the
+// time since its first fragment. It returns false if the message isn't
+// known.
+func (r *TraceRecorder) WriteTimeline(w io.Writer, transID uint32) (bool, error) {
+	events := r.Timeline(transID)
+	if len(events) == 0 {
+		return false, nil
+	}
+	start := events[0].Time
+	if _, err := fmt.Fprintf(w, "message %d started %s\n", transID, start.Format(time.RFC3339Nano)); err != nil {
+		return true, err
+	}
+	for _, ev := range events {
+		line := fmt.Sprintf("%12s %-14s", "+"+ev.Time.Sub(start).String(), ev.Type)
+		switch ev.Type {
+		case TraceCompleted, TraceExpired, TraceFailed, TraceContiguous:
+		default:
+			line += fmt.Sprintf(" offset=%d length=%d", ev.Offset, ev.Length)
+		}
+		line += fmt.Sprintf(" contiguous=%d", ev.Contiguous)
+		if ev.Reason != "" {
+			line += " reason=" + ev.Reason
+		}
+		if ev.Omitted > 0 {
+			line += fmt.Sprintf(" omitted=%d", ev.Omitted)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// The OpenTelemetry protocol's JSON encoding of a trace export request. 64
+// bit integers are written as strings and IDs as hex.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string      `json:"traceId"`
+		SpanID            string      `json:"spanId"`
+		Name              string      `json:"name"`
+		Kind              int         `json:"kind"`
+		StartTimeUnixNano string      `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+		Attributes        []otlpAttr  `json:"attributes"`
+		Events            []otlpEvent `json:"events"`
+		Status            otlpStatus  `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string     `json:"timeUnixNano"`
+		Name         string     `json:"name"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+)
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+func stringAttr(key, v string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: &v}}
+}
+
+func intAttr(key string, v int64) otlpAttr {
+	s := strconv.FormatInt(v, 10)
+	return otlpAttr{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// traceIDs derives the trace and span IDs of a message from its transaction
+// ID and start time, so exporting the same timeline twice gives the same
+// span.
+func traceIDs(transID uint32, start time.Time) (traceID, spanID string) {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[0:], transID)
+	binary.BigEndian.PutUint64(b[4:], uint64(start.UnixNano()))
+	sum := sha256.Sum256(b[:])
+	return hex.EncodeToString(sum[:16]), hex.EncodeToString(sum[16:24])
+}
+
+// WriteSpan writes a message's events, first to last, as one line of
+// OpenTelemetry protocol JSON holding a single span for the message. Each
+// event is a span event. A file of these lines can be read by the
+// OpenTelemetry Collector's otlpjsonfile receiver.
+func WriteSpan(w io.Writer, events []TraceEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	first, last := events[0], events[len(events)-1]
+	traceID, spanID := traceIDs(first.TransID, first.Time)
+	span := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            spanID,
+		Name:              "message",
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: unixNano(first.Time),
+		EndTimeUnixNano:   unixNano(last.Time),
+		Attributes: []otlpAttr{
+			intAttr("msg_assembler.trans_id", int64(first.TransID)),
+			intAttr("msg_assembler.contiguous", int64(last.Contiguous)),
+		},
+		Events: make([]otlpEvent, len(events)),
+	}
+	switch last.Type {
+	case TraceCompleted:
+		span.Status.Code = otlpStatusOK
+	case TraceExpired, TraceFailed:
+		span.Status = otlpStatus{Code: otlpStatusError, Message: last.Reason}
+	}
+	for i, ev := range events {
+		e := otlpEvent{TimeUnixNano: unixNano(ev.Time), Name: ev.Type.String()}
+		switch ev.Type {
+		case TraceCompleted, TraceExpired, TraceFailed, TraceContiguous:
+		default:
+			e.Attributes = append(e.Attributes,
+				intAttr("msg_assembler.offset", int64(ev.Offset)),
+				intAttr("msg_assembler.length", int64(ev.Length)))
+		}
+		e.Attributes = append(e.Attributes, intAttr("msg_assembler.contiguous", int64(ev.Contiguous)))
+		if ev.Reason != "" {
+			e.Attributes = append(e.Attributes, stringAttr("msg_assembler.reason", ev.Reason))
+		}
+		if ev.Omitted > 0 {
+			e.Attributes = append(e.Attributes, intAttr("msg_assembler.omitted", int64(ev.Omitted)))
+		}
+		span.Events[i] = e
+	}
+	return json.NewEncoder(w).Encode(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttr{stringAttr("service.name", "msg-assembler")}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "msg-assembler"}, Spans: []otlpSpan{span}}},
+	}}})
+}
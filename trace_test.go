@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func traceTypes(events []TraceEvent) []string {
+	types := make([]string, len(events))
+	for i, ev := range events {
+		types[i] = ev.Type.String()
+	}
+	return types
+}
+
+// TestTraceComplete tests the events of a message that arrives out of
+// order, with a duplicate, and completes.
+func TestTraceComplete(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	r := NewTraceRecorder(0, nil, nil)
+	h.SetTracer(r.Trace)
+	h.AddFragment(createValidFrag(false, 1, 10, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 1, 10, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 1, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(true, 1, 20, make([]byte, 5)))
+
+	events := r.Timeline(1)
+	expected := "first_fragment accepted duplicate accepted contiguous accepted contiguous completed"
+	if got := strings.Join(traceTypes(events), " "); got != expected {
+		t.Fatalf("expected events %q, got %q", expected, got)
+	}
+	if events[4].Contiguous != 20 || events[6].Contiguous != 25 {
+		t.Errorf("unexpected contiguous lengths %d and %d", events[4].Contiguous, events[6].Contiguous)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.Before(events[i-1].Time) {
+			t.Errorf("event %d is before the one preceding it", i)
+		}
+	}
+}
+
+// TestTraceRejectedExpired tests the events of rejected fragments and of
+// a message expiring.
+func TestTraceRejectedExpired(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	h.SetLimits(1, 100)
+	r := NewTraceRecorder(0, nil, nil)
+	h.SetTracer(r.Trace)
+	h.AddFragment(createValidFrag(false, 1, 10, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 1, 100, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 2, 0, make([]byte, 10)))
+	h.Expire(1)
+
+	events := r.Timeline(1)
+	expected := "first_fragment accepted rejected expired"
+	if got := strings.Join(traceTypes(events), " "); got != expected {
+		t.Fatalf("expected events %q, got %q", expected, got)
+	}
+	if events[2].Reason != "too_large" || events[3].Reason != "expired by admin" {
+		t.Errorf("unexpected reasons %q and %q", events[2].Reason, events[3].Reason)
+	}
+	// message 2 never started so its rejected fragment isn't kept
+	if events := r.Timeline(2); events != nil {
+		t.Errorf("unexpected events for the rejected message %+v", events)
+	}
+}
+
+// TestTraceKeep tests only the most recently finished messages are kept.
+func TestTraceKeep(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	r := NewTraceRecorder(2, nil, nil)
+	h.SetTracer(r.Trace)
+	for id := uint32(1); id <= 3; id++ {
+		h.AddFragment(createValidFrag(true, id, 0, make([]byte, 10)))
+	}
+	h.AddFragment(createValidFrag(false, 4, 0, make([]byte, 10)))
+	if r.Timeline(1) != nil {
+		t.Error("expected the oldest message to be forgotten")
+	}
+	for id := uint32(2); id <= 4; id++ {
+		if r.Timeline(id) == nil {
+			t.Errorf("expected message %d to be kept", id)
+		}
+	}
+}
+
+// TestTraceMaxEvents tests a message's timeline stops growing once it is
+// full but still ends with its last event.
+func TestTraceMaxEvents(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	r := NewTraceRecorder(0, nil, nil)
+	h.SetTracer(r.Trace)
+	for i := uint32(0); i < 100; i++ {
+		h.AddFragment(createValidFrag(i == 99, 5, i*10, make([]byte, 10)))
+	}
+
+	events := r.Timeline(5)
+	if len(events) != maxTraceEvents {
+		t.Fatalf("expected %d events, got %d", maxTraceEvents, len(events))
+	}
+	// a first fragment event, an accepted and a contiguous event for each
+	// fragment and the completed event
+	last := events[len(events)-1]
+	if last.Type != TraceCompleted || last.Omitted != 202-maxTraceEvents {
+		t.Errorf("unexpected last event %+v", last)
+	}
+}
+
+// TestWriteTimeline tests rendering a message's timeline as text.
+func TestWriteTimeline(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	r := NewTraceRecorder(0, nil, nil)
+	h.SetTracer(r.Trace)
+	h.AddFragment(createValidFrag(true, 7, 0, make([]byte, 10)))
+
+	var out bytes.Buffer
+	if ok, err := r.WriteTimeline(&out, 7); !ok || err != nil {
+		t.Fatalf("expected a timeline, got %v %v", ok, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "message 7 started") {
+		t.Fatalf("unexpected timeline\n%s", out.String())
+	}
+	if !strings.Contains(lines[2], "accepted") || !strings.Contains(lines[2], "offset=0 length=10") {
+		t.Errorf("unexpected accepted line %q", lines[2])
+	}
+	if ok, _ := r.WriteTimeline(&out, 8); ok {
+		t.Error("expected no timeline for an unknown message")
+	}
+}
+
+// TestExportSpans tests finished messages are written as OpenTelemetry
+// JSON spans.
+func TestExportSpans(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	var out bytes.Buffer
+	r := NewTraceRecorder(0, &out, nil)
+	h.SetTracer(r.Trace)
+	h.AddFragment(createValidFrag(true, 7, 0, make([]byte, 10)))
+	h.AddFragment(createValidFrag(false, 8, 0, make([]byte, 10)))
+	h.Expire(8)
+	r.Close()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(lines))
+	}
+	var traces otlpTraces
+	if err := json.Unmarshal([]byte(lines[0]), &traces); err != nil {
+		t.Fatal(err)
+	}
+	span := traces.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if len(span.TraceID) != 32 || len(span.SpanID) != 16 {
+		t.Errorf("unexpected IDs %q and %q", span.TraceID, span.SpanID)
+	}
+	if span.Status.Code != otlpStatusOK || len(span.Events) != 4 || span.Events[3].Name != "completed" {
+		t.Errorf("unexpected span %+v", span)
+	}
+	if a := span.Attributes[0]; a.Key != "msg_assembler.trans_id" || *a.Value.IntValue != "7" {
+		t.Errorf("unexpected attribute %+v", a)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &traces); err != nil {
+		t.Fatal(err)
+	}
+	if s := traces.ResourceSpans[0].ScopeSpans[0].Spans[0].Status; s.Code != otlpStatusError || s.Message != "expired by admin" {
+		t.Errorf("unexpected status %+v", s)
+	}
+}
+
+// blockedWriter blocks every write until release is closed.
+type blockedWriter struct {
+	release chan struct{}
+	out     bytes.Buffer
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.out.Write(p)
+}
+
+// TestExportSlow tests that a slow export doesn't hold up the handler and
+// that the spans that don't fit in the queue are dropped and reported.
+func TestExportSlow(t *testing.T) {
+	h := NewMsgHandler(60000, nil, nil)
+	h.SetOutput(&bytes.Buffer{})
+	w := &blockedWriter{release: make(chan struct{})}
+	var errs []error
+	r := NewTraceRecorder(1, w, func(err error) { errs = append(errs, err) })
+	h.SetTracer(r.Trace)
+	done := make(chan bool)
+	go func() {
+		for id := uint32(1); id <= 5; id++ {
+			h.AddFragment(createValidFrag(true, id, 0, make([]byte, 10)))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the handler not to wait for the export")
+	}
+	close(w.release)
+	r.Close()
+	spans := strings.Count(w.out.String(), "\n")
+	if spans < 1 || spans > 2 {
+		t.Errorf("expected the queued spans to be written, got %d", spans)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), fmt.Sprintf("dropped the traces of %d messages", 5-spans)) {
+		t.Errorf("expected the dropped spans to be reported, got %v", errs)
+	}
+	// closing again does nothing
+	r.Close()
+}
@@ -1,7 +1,9 @@
 // Package tree defines a generic binar tree structure
 package tree
 
-// Tree defines a binary tree structure
+// Tree defines a binary tree structure. It is kept balanced as an AVL tree
+// so values inserted in order, like fragments arriving in order, still take
+// O(log n) each.
 type Tree struct {
 	root    *node
 	compare Comparable
@@ -11,6 +13,8 @@ type node struct {
 	left  *node
 	right *node
 	value interface{}
+	// height is the number of nodes on the longest path down to a leaf
+	height int
 }
 
 // Comparable defines a function signature for comparing two objects
@@ -26,9 +30,60 @@ func NewTree(compareFun Comparable) *Tree {
 	return &Tree{compare: compareFun}
 }
 
+func height(n *node) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *node) update() {
+	n.height = 1 + max(height(n.left), height(n.right))
+}
+
+// balance is how much taller the left subtree is than the right.
+func (n *node) balance() int {
+	return height(n.left) - height(n.right)
+}
+
+func rotateRight(n *node) *node {
+	l := n.left
+	n.left, l.right = l.right, n
+	n.update()
+	l.update()
+	return l
+}
+
+func rotateLeft(n *node) *node {
+	r := n.right
+	n.right, r.left = r.left, n
+	n.update()
+	r.update()
+	return r
+}
+
+// rebalance rotates n if its subtrees' heights differ by more than one and
+// returns the subtree's new root.
+func rebalance(n *node) *node {
+	n.update()
+	switch b := n.balance(); {
+	case b > 1:
+		if n.left.balance() < 0 {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	case b < -1:
+		if n.right.balance() > 0 {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
 func (t *Tree) insert(n *node, val interface{}) *node {
 	if n == nil {
-		return &node{value: val}
+		return &node{value: val, height: 1}
 	}
 	r := t.compare(val, n.value)
 	if r < 0 {
@@ -38,7 +93,7 @@ func (t *Tree) insert(n *node, val interface{}) *node {
 	} else {
 		return n
 	}
-	return n
+	return rebalance(n)
 }
 
 type orderedArr struct {
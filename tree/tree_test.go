@@ -14,14 +14,12 @@ func compare(ob1 interface{}, ob2 interface{}) int {
 }
 
 func buildTree() *Tree {
-	// Tree will be:
-	//      6
-	//    /  \
-	//   3    7
-	//  / \
-	// 2   4
-	//      \
-	//       5
+	// Inserting 5 unbalances 6 so the tree will be:
+	//       4
+	//     /   \
+	//    3     6
+	//   /     / \
+	//  2     5   7
 	tree := NewTree(compare)
 	tree.Insert(6)
 	tree.Insert(3)
@@ -57,24 +55,41 @@ func TestNewTree(t *testing.T) {
 // insert multiple times.
 func TestInsert(t *testing.T) {
 	tree := buildTree()
-	if tree.root.value != 6 {
-		t.Error("Root node's value should have been 5")
+	if tree.root.value != 4 {
+		t.Error("Root node's value should have been 4")
 	}
 	if tree.root.left.value != 3 {
-		t.Error("Node's values should have been 4")
+		t.Error("Node's values should have been 3")
 	}
-	if tree.root.right.value != 7 {
-		t.Error("Node's value should have been 7")
+	if tree.root.right.value != 6 {
+		t.Error("Node's value should have been 6")
 	}
 	if tree.root.left.left.value != 2 {
-		t.Error("Node's value should have been 3")
-	}
-	if tree.root.left.right.value != 4 {
-		t.Error("Node's value should have been 4")
+		t.Error("Node's value should have been 2")
 	}
-	if tree.root.left.right.right.value != 5 {
+	if tree.root.right.left.value != 5 {
 		t.Error("Node's value should have been 5")
 	}
+	if tree.root.right.right.value != 7 {
+		t.Error("Node's value should have been 7")
+	}
+}
+
+// TestInsertInOrder tests that values inserted in order keep the tree
+// balanced.
+func TestInsertInOrder(t *testing.T) {
+	tree := NewTree(compare)
+	for i := 0; i < 1023; i++ {
+		tree.Insert(i)
+	}
+	if tree.root.height != 10 {
+		t.Errorf("expected a height of 10, got %d", tree.root.height)
+	}
+	for i, v := range tree.InOrderArr() {
+		if v != i {
+			t.Fatalf("Value was supposed to be: %d but was %d", i, v)
+		}
+	}
 }
 
 // TestInOrder builds a tree and tests that the InOrderArr creates a sorted